@@ -48,6 +48,11 @@ func RetryCommands() {
 		if err != nil {
 			ErrorLogger(LogHolder{Message: err.Error()})
 		}
+
+		err = retryErrorCommands()
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+		}
 	}
 
 	fn()
@@ -57,51 +62,69 @@ func RetryCommands() {
 	}
 }
 
+// pushNotNow pushes the devices with NotNow commands that are due, backing off each command by its retry policy
 func pushNotNow() error {
-	var command types.Command
 	var commands []types.Command
-	err := db.DB.Model(&command).
-		Select("DISTINCT(device_ud_id)").
-		Where("status = ?", "NotNow").
-		Scan(&commands).
+	err := db.DB.
+		Where("status = ? AND retries_exhausted IS NOT TRUE AND (next_retry_at IS NULL OR next_retry_at <= ?)", "NotNow", time.Now()).
+		Find(&commands).
 		Error
 	if err != nil {
 		return errors.Wrap(err, "Select NotNow Devices")
 	}
 
 	client := &http.Client{}
+	pushed := make(map[string]bool)
 	for i := range commands {
 		queuedCommand := commands[i]
-		endpoint, err := url.Parse(utils.ServerURL())
-		if err != nil {
-			ErrorLogger(LogHolder{Message: err.Error()})
-		}
-		retry := time.Now().Unix() + 3600
-		endpoint.Path = path.Join(endpoint.Path, "push", queuedCommand.DeviceUDID)
-
-		queryString := endpoint.Query()
-		queryString.Set("expiration", strconv.FormatInt(retry, 10))
-		endpoint.RawQuery = queryString.Encode()
-		req, err := http.NewRequest("GET", endpoint.String(), nil)
-		if err != nil {
-			ErrorLogger(LogHolder{Message: err.Error()})
+		if _, ok := pushed[queuedCommand.DeviceUDID]; !ok {
+			pushed[queuedCommand.DeviceUDID] = pushDevice(client, queuedCommand.DeviceUDID)
 		}
-		req.SetBasicAuth("micromdm", utils.APIKey())
-
-		resp, err := client.Do(req)
-		if err != nil {
-			ErrorLogger(LogHolder{Message: err.Error()})
+		if !pushed[queuedCommand.DeviceUDID] {
 			continue
 		}
 
-		resp.Body.Close()
-		if utils.Prometheus() {
-			TotalPushes.Inc()
+		attempt := max(queuedCommand.AttemptCount, 1) + 1
+		err = updateCommandRetry(queuedCommand, attempt, nextCommandRetry(commandRetryPolicy(queuedCommand.RequestType), attempt, time.Now()))
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: queuedCommand.DeviceUDID, CommandUUID: queuedCommand.CommandUUID, Message: err.Error()})
 		}
 	}
 	return nil
 }
 
+func pushDevice(client *http.Client, udid string) bool {
+	endpoint, err := url.Parse(utils.ServerURL())
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return false
+	}
+	retry := time.Now().Unix() + 3600
+	endpoint.Path = path.Join(endpoint.Path, "push", udid)
+
+	queryString := endpoint.Query()
+	queryString.Set("expiration", strconv.FormatInt(retry, 10))
+	endpoint.RawQuery = queryString.Encode()
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return false
+	}
+	req.SetBasicAuth("micromdm", utils.APIKey())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return false
+	}
+
+	resp.Body.Close()
+	if utils.Prometheus() {
+		TotalPushes.Inc()
+	}
+	return true
+}
+
 func UnconfiguredDevices() {
 	ticker := time.NewTicker(30 * time.Second)
 
@@ -44,6 +44,7 @@ func processCertificateList(certificateListData types.CertificateListData, devic
 		certificate.NotBefore = cert.NotBefore
 		certificate.Subject = cert.Subject.String()
 		certificate.Issuer = cert.Issuer.String()
+		certificate.IsIdentity = certListItem.IsIdentity
 		certificates = append(certificates, certificate)
 	}
 
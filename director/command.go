@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/mdmdirector/mdmdirector/db"
@@ -35,7 +36,7 @@ func SendCommand(commandPayload types.CommandPayload) (types.Command, error) {
 		},
 	)
 
-	jsonStr, err := json.Marshal(commandPayload)
+	jsonStr, err := commandRequestBody(commandPayload)
 	if err != nil {
 		return command, err
 	}
@@ -60,6 +61,21 @@ func SendCommand(commandPayload types.CommandPayload) (types.Command, error) {
 	command.DeviceUDID = commandPayload.UDID
 	command.CommandUUID = commandResponse.Payload.CommandUUID
 	command.RequestType = commandPayload.RequestType
+	command.ProfileIdentifier = commandPayload.ProfileIdentifier
+	command.ProfileUUID = commandPayload.ProfileUUID
+	// Kept so the command can be sent again by its retry policy. The profile payload isn't kept, a retried
+	// InstallProfile is built again, and neither are the params of request types that carry a secret.
+	command.Queries = commandPayload.Queries
+	command.Identifier = commandPayload.Identifier
+	command.ManifestURL = commandPayload.ManifestURL
+	command.AttemptCount = max(commandPayload.Attempt, 1)
+	if len(commandPayload.Params) > 0 && !neverResentRequestTypes[commandPayload.RequestType] {
+		params, err := json.Marshal(commandPayload.Params)
+		if err != nil {
+			return command, errors.Wrap(err, "SendCommand: marshal params")
+		}
+		command.Params = string(params)
+	}
 
 	InfoLogger(
 		LogHolder{
@@ -72,6 +88,10 @@ func SendCommand(commandPayload types.CommandPayload) (types.Command, error) {
 	)
 
 	db.DB.Create(&command)
+	err = recordProfileCommandSent(command)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: command.CommandUUID, Message: err.Error()})
+	}
 	if utils.Prometheus() {
 		if commandPayload.RequestType == "InstallProfile" {
 			ProfilesPushed.Inc()
@@ -145,33 +165,108 @@ OuterLoop:
 		},
 	)
 
+	errorChain := parseErrorChain(ackEvent.RawPayload)
+
 	if err := db.DB.Where("device_ud_id = ? AND command_uuid = ?", device.UDID, ackEvent.CommandUUID).Error; err != nil {
 		if intErrors.Is(err, gorm.ErrRecordNotFound) {
 			return errors.New("Command not found in the queue")
 		}
 	} else {
 		if ackEvent.Status == "Error" {
-			InfoLogger(LogHolder{Message: "Error response received", Metric: string(ackEvent.RawPayload), DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber})
-			err := db.DB.Model(&command).Select("status", "error_string").Where("device_ud_id = ? AND command_uuid = ?", device.UDID, ackEvent.CommandUUID).Updates(types.Command{
+			errorDomain, errorCode := errorChainTop(errorChain)
+			InfoLogger(LogHolder{Message: "Error response received", Metric: errorChainDescription(errorChain), DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, CommandRequestType: commandRequestType, ErrorDomain: errorDomain, ErrorCode: errorCode})
+			if utils.Prometheus() {
+				CommandErrors.WithLabelValues(errorDomain, strconv.Itoa(errorCode)).Inc()
+			}
+			err := db.DB.Model(&command).Select("status", "error_string", "error_chain", "error_domain", "error_code").Where("device_ud_id = ? AND command_uuid = ?", device.UDID, ackEvent.CommandUUID).Updates(types.Command{
 				Status:      ackEvent.Status,
 				ErrorString: string(ackEvent.RawPayload),
+				ErrorChain:  errorChain,
+				ErrorDomain: errorDomain,
+				ErrorCode:   errorCode,
 			}).Error
 			if err != nil {
 				return err
 			}
+
+			// The event is only recorded once the status is saved, a failed update is retried and would record it twice
+			err = recordCommandEvent(ackEvent, device, commandRequestType, errorChain)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			err = recordProfileRolloutError(ackEvent.CommandUUID)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			err = updateProfileAssignmentFromAck(ackEvent.CommandUUID, ackEvent.Status, string(ackEvent.RawPayload))
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			err = scheduleCommandRetry(ackEvent.CommandUUID, ackEvent.RawPayload)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			err = advanceWorkflows(device.UDID, ackEvent.CommandUUID)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
 		} else {
-			err := db.DB.Model(&command).Select("status", "error_string").Where("device_ud_id = ? AND command_uuid = ?", device.UDID, ackEvent.CommandUUID).Updates(types.Command{
+			err := db.DB.Model(&command).Select("status", "error_string", "error_chain", "error_domain", "error_code").Where("device_ud_id = ? AND command_uuid = ?", device.UDID, ackEvent.CommandUUID).Updates(types.Command{
 				Status:      ackEvent.Status,
 				ErrorString: "",
 			}).Error
 			if err != nil {
 				return err
 			}
+
+			err = recordCommandEvent(ackEvent, device, commandRequestType, errorChain)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			err = updateProfileAssignmentFromAck(ackEvent.CommandUUID, ackEvent.Status, "")
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+			}
+
+			if ackEvent.Status == "Acknowledged" {
+				err = advanceWorkflows(device.UDID, ackEvent.CommandUUID)
+				if err != nil {
+					ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandUUID: ackEvent.CommandUUID, Message: err.Error()})
+				}
+			}
 		}
 	}
 	return nil
 }
 
+// commandRequestBody is the JSON sent to MicroMDM. Params are added alongside the fields of the CommandPayload, but
+// never replace them.
+func commandRequestBody(commandPayload types.CommandPayload) ([]byte, error) {
+	body, err := json.Marshal(commandPayload)
+	if err != nil || len(commandPayload.Params) == 0 {
+		return body, err
+	}
+
+	var merged map[string]interface{}
+	err = json.Unmarshal(body, &merged)
+	if err != nil {
+		return nil, errors.Wrap(err, "commandRequestBody")
+	}
+
+	for key, value := range commandPayload.Params {
+		if _, ok := merged[key]; !ok {
+			merged[key] = value
+		}
+	}
+
+	return json.Marshal(merged)
+}
+
 func CommandInQueue(device types.Device, command string, afterDate time.Time) bool {
 	var commandModel types.Command
 
@@ -319,17 +414,50 @@ func DeletePendingCommands(w http.ResponseWriter, r *http.Request) {
 	// w.Write(output)
 }
 
+// GetErrorCommands returns the commands devices returned an Error for. They can be filtered by the domain, code and
+// request_type query parameters, and with group=true the number of commands for each domain and code is returned.
 func GetErrorCommands(w http.ResponseWriter, r *http.Request) {
-	var commands []types.Command
+	var output []byte
+	query := r.URL.Query()
 
-	err := db.DB.Find(&commands).Where("status = ?", "Error").Scan(&commands).Error
-	if err != nil {
-		log.Errorf("Couldn't scan to Commands model: %v", err)
+	tx := db.DB.Model(&types.Command{}).Where("status = ?", "Error")
+	if domain := query.Get("domain"); domain != "" {
+		tx = tx.Where("error_domain = ?", domain)
+	}
+	if code := query.Get("code"); code != "" {
+		errorCode, err := strconv.Atoi(code)
+		if err != nil {
+			http.Error(w, "code must be a number", http.StatusBadRequest)
+			return
+		}
+		tx = tx.Where("error_code = ?", errorCode)
+	}
+	if requestType := query.Get("request_type"); requestType != "" {
+		tx = tx.Where("request_type = ?", requestType)
+	}
+
+	var err error
+	if query.Get("group") == "true" {
+		var groups []types.CommandErrorGroup
+		err = tx.Select("error_domain, error_code, count(*) as count").
+			Group("error_domain, error_code").
+			Order("count desc").
+			Scan(&groups).
+			Error
+		if err == nil {
+			output, err = json.MarshalIndent(&groups, "", "    ")
+		}
+	} else {
+		var commands []types.Command
+		err = tx.Order("updated_at desc").Find(&commands).Error
+		if err == nil {
+			output, err = json.MarshalIndent(&commands, "", "    ")
+		}
 	}
-	output, err := json.MarshalIndent(&commands, "", "    ")
 	if err != nil {
 		ErrorLogger(LogHolder{Message: err.Error()})
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	_, err = w.Write(output)
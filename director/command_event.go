@@ -0,0 +1,148 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+// commandEventPayloadBytes caps the payload kept for each response
+const commandEventPayloadBytes = 16 * 1024
+
+// commandEventSummarizedKeys hold data that is saved on the device already, the history only keeps how many items
+// the response carried
+var commandEventSummarizedKeys = []string{
+	"CertificateList",
+	"InstalledApplicationList",
+	"ProfileList",
+	"QueryResponses",
+	"SecurityInfo",
+}
+
+// commandEventPayload summarizes the data of the response and caps it at commandEventPayloadBytes
+func commandEventPayload(rawPayload []byte) string {
+	var payload map[string]interface{}
+
+	err := plist.Unmarshal(rawPayload, &payload)
+	if err == nil {
+		summarized := false
+		for _, key := range commandEventSummarizedKeys {
+			value, ok := payload[key]
+			if !ok {
+				continue
+			}
+			summarized = true
+			switch items := value.(type) {
+			case []interface{}:
+				payload[key] = fmt.Sprintf("%v items, not kept", len(items))
+			case map[string]interface{}:
+				payload[key] = fmt.Sprintf("%v keys, not kept", len(items))
+			default:
+				payload[key] = "not kept"
+			}
+		}
+		if summarized {
+			summary, err := plist.MarshalIndent(payload, "\t")
+			if err == nil {
+				rawPayload = summary
+			}
+		}
+	}
+
+	if len(rawPayload) > commandEventPayloadBytes {
+		rawPayload = rawPayload[:commandEventPayloadBytes]
+	}
+
+	return strings.ToValidUTF8(string(rawPayload), "")
+}
+
+// recordCommandEvent keeps the response a device returned for a command
+func recordCommandEvent(ackEvent *types.AcknowledgeEvent, device types.Device, requestType string, errorChain types.ErrorChain) error {
+	event := types.CommandEvent{
+		CommandUUID: ackEvent.CommandUUID,
+		DeviceUDID:  device.UDID,
+		RequestType: requestType,
+		Status:      ackEvent.Status,
+		ErrorChain:  errorChain,
+		Payload:     commandEventPayload(ackEvent.RawPayload),
+	}
+
+	err := db.DB.Create(&event).Error
+	if err != nil {
+		return errors.Wrap(err, "recordCommandEvent")
+	}
+
+	return nil
+}
+
+// pruneCommandEvents deletes the responses older than -command-history-days
+func pruneCommandEvents() error {
+	days := utils.CommandHistoryDays()
+	if days <= 0 {
+		return nil
+	}
+
+	err := db.DB.Where("created_at < ?", time.Now().AddDate(0, 0, -days)).Delete(&types.CommandEvent{}).Error
+	if err != nil {
+		return errors.Wrap(err, "pruneCommandEvents")
+	}
+
+	return nil
+}
+
+// GetDeviceCommandHistoryHandler returns the responses a device returned for its commands, newest first. They can be
+// filtered with the request_type, since and until query parameters, since and until are RFC 3339 times.
+func GetDeviceCommandHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	var events []types.CommandEvent
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	tx := db.DB.Where("device_ud_id = ?", vars["udid"])
+	if requestType := query.Get("request_type"); requestType != "" {
+		tx = tx.Where("request_type = ?", requestType)
+	}
+	if since := query.Get("since"); since != "" {
+		sinceTime, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		tx = tx.Where("created_at >= ?", sinceTime)
+	}
+	if until := query.Get("until"); until != "" {
+		untilTime, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "until must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		tx = tx.Where("created_at <= ?", untilTime)
+	}
+
+	err := tx.Order("created_at desc").Order("id desc").Find(&events).Error
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: vars["udid"], Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&events, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
@@ -0,0 +1,113 @@
+package director
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestErrorChainValueScan(t *testing.T) {
+	chain := types.ErrorChain{{ErrorCode: 12021, ErrorDomain: "MDMErrorDomain"}}
+
+	value, err := chain.Value()
+	require.NoError(t, err)
+
+	var scanned types.ErrorChain
+	require.NoError(t, scanned.Scan(value))
+	require.Equal(t, chain, scanned)
+
+	value, err = types.ErrorChain(nil).Value()
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestCommandEventPayload(t *testing.T) {
+	profileList := testRawPayload(t, map[string]string{"UDID": "1234-5678-123456", "Status": "Acknowledged"})
+	profileList = []byte(strings.Replace(string(profileList), "</dict>", `<key>ProfileList</key><array>
+<dict><key>PayloadIdentifier</key><string>com.example.wifi</string></dict>
+<dict><key>PayloadIdentifier</key><string>com.example.vpn</string></dict>
+</array></dict>`, 1))
+	errorResponse := testRawPayload(t, map[string]string{"UDID": "1234-5678-123456", "Status": "Error"})
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		contains []string
+		excludes []string
+		maxBytes int
+	}{
+		{
+			name:     "profile list is summarized",
+			payload:  profileList,
+			contains: []string{"<string>2 items, not kept</string>", "<string>1234-5678-123456</string>"},
+			excludes: []string{"com.example.wifi"},
+		},
+		{
+			name:     "error response is kept",
+			payload:  errorResponse,
+			contains: []string{string(errorResponse)},
+		},
+		{
+			name:     "oversized payload is capped",
+			payload:  []byte(strings.Repeat("a", commandEventPayloadBytes*2)),
+			maxBytes: commandEventPayloadBytes,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := commandEventPayload(tt.payload)
+			for _, contains := range tt.contains {
+				require.Contains(t, payload, contains)
+			}
+			for _, excludes := range tt.excludes {
+				require.NotContains(t, payload, excludes)
+			}
+			if tt.maxBytes > 0 {
+				require.Len(t, payload, tt.maxBytes)
+			}
+		})
+	}
+}
+
+func TestGetDeviceCommandHistoryHandler(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "command_events" WHERE device_ud_id = \$1 AND request_type = \$2 AND created_at >= \$3 ORDER BY created_at desc,id desc`).
+		WithArgs("1234-5678-123456", "ProfileList", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "command_uuid", "device_ud_id", "request_type", "status"}).
+			AddRow(1, "command-1", "1234-5678-123456", "ProfileList", "Acknowledged"))
+
+	req := mux.SetURLVars(
+		httptest.NewRequest(http.MethodGet, "/device/1234-5678-123456/commands/history?request_type=ProfileList&since=2024-01-01T00:00:00Z", nil),
+		map[string]string{"udid": "1234-5678-123456"},
+	)
+	rr := httptest.NewRecorder()
+	GetDeviceCommandHistoryHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"command_uuid": "command-1"`)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+
+	req = mux.SetURLVars(
+		httptest.NewRequest(http.MethodGet, "/device/1234-5678-123456/commands/history?until=yesterday", nil),
+		map[string]string{"udid": "1234-5678-123456"},
+	)
+	rr = httptest.NewRecorder()
+	GetDeviceCommandHistoryHandler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,370 @@
+package director
+
+import (
+	"encoding/json"
+	intErrors "errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const defaultRetryPolicyKey = "default"
+
+// defaultCommandRetryPolicy pushes NotNow commands with a backoff from two minutes to six hours and leaves Error
+// commands alone until the codes worth retrying are configured
+var defaultCommandRetryPolicy = types.CommandRetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 120,
+	MaxBackoff:     21600,
+	Multiplier:     2,
+}
+
+// commandRetryPolicies are the retry policies by request type, loaded by LoadCommandRetryPolicies
+var commandRetryPolicies = map[string]types.CommandRetryPolicy{}
+
+// neverResentRequestTypes carry a PIN, password or unlock token that isn't stored, so they can't be sent again
+var neverResentRequestTypes = map[string]bool{
+	"ClearPasscode":          true,
+	"DeviceLock":             true,
+	"EraseDevice":            true,
+	"SetFirmwarePassword":    true,
+	"SetRecoveryLock":        true,
+	"VerifyFirmwarePassword": true,
+}
+
+// ClearStoredCommandSecrets blanks the profile payloads and secret params that earlier versions kept on commands
+func ClearStoredCommandSecrets() error {
+	requestTypes := make([]string, 0, len(neverResentRequestTypes))
+	for requestType := range neverResentRequestTypes {
+		requestTypes = append(requestTypes, requestType)
+	}
+
+	err := db.DB.Model(&types.Command{}).Where("payload <> ?", "").Update("payload", "").Error
+	if err != nil {
+		return errors.Wrap(err, "ClearStoredCommandSecrets: payload")
+	}
+	err = db.DB.Model(&types.Command{}).
+		Where("request_type IN ? AND params <> ?", requestTypes, "").
+		Update("params", "").
+		Error
+	if err != nil {
+		return errors.Wrap(err, "ClearStoredCommandSecrets: params")
+	}
+
+	return nil
+}
+
+// LoadCommandRetryPolicies reads the retry policies from a JSON file of policies keyed by request type. The
+// "default" policy applies to every other request type and fills in the fields a policy leaves out.
+func LoadCommandRetryPolicies(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "LoadCommandRetryPolicies")
+	}
+
+	policies, err := parseCommandRetryPolicies(data)
+	if err != nil {
+		return errors.Wrap(err, "LoadCommandRetryPolicies")
+	}
+
+	commandRetryPolicies = policies
+	return nil
+}
+
+func parseCommandRetryPolicies(data []byte) (map[string]types.CommandRetryPolicy, error) {
+	var policies map[string]types.CommandRetryPolicy
+	err := json.Unmarshal(data, &policies)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPolicy := fillCommandRetryPolicy(policies[defaultRetryPolicyKey], defaultCommandRetryPolicy)
+	for requestType, policy := range policies {
+		policy = fillCommandRetryPolicy(policy, defaultPolicy)
+		if policy.MaxAttempts < 1 || policy.InitialBackoff < 0 || policy.MaxBackoff < policy.InitialBackoff {
+			return nil, fmt.Errorf("invalid retry policy for %v", requestType)
+		}
+		if policy.Multiplier < 1 {
+			return nil, fmt.Errorf("multiplier of the %v retry policy must be at least 1", requestType)
+		}
+		policies[requestType] = policy
+	}
+	policies[defaultRetryPolicyKey] = defaultPolicy
+
+	return policies, nil
+}
+
+func fillCommandRetryPolicy(policy types.CommandRetryPolicy, defaults types.CommandRetryPolicy) types.CommandRetryPolicy {
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaults.InitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaults.MaxBackoff
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = defaults.Multiplier
+	}
+	if policy.RetryableErrorCodes == nil {
+		policy.RetryableErrorCodes = defaults.RetryableErrorCodes
+	}
+
+	return policy
+}
+
+func commandRetryPolicy(requestType string) types.CommandRetryPolicy {
+	if policy, ok := commandRetryPolicies[requestType]; ok {
+		return policy
+	}
+	if policy, ok := commandRetryPolicies[defaultRetryPolicyKey]; ok {
+		return policy
+	}
+
+	return defaultCommandRetryPolicy
+}
+
+// commandRetryBackoff is how long to wait after the given attempt before the next one
+func commandRetryBackoff(policy types.CommandRetryPolicy, attempt int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	return time.Duration(backoff) * time.Second
+}
+
+// nextCommandRetry is when the command is tried again after the given attempt, or nil when the attempts are used up
+func nextCommandRetry(policy types.CommandRetryPolicy, attempt int, now time.Time) *time.Time {
+	if attempt >= policy.MaxAttempts {
+		return nil
+	}
+
+	next := now.Add(commandRetryBackoff(policy, attempt))
+	return &next
+}
+
+// errorChainCodes returns the ErrorCode of each error in the ErrorChain of an Error response
+func errorChainCodes(rawPayload []byte) []int {
+	chain := parseErrorChain(rawPayload)
+	codes := make([]int, 0, len(chain))
+	for _, chained := range chain {
+		codes = append(codes, chained.ErrorCode)
+	}
+
+	return codes
+}
+
+// errorRetryable reports whether any error in the chain is one the policy retries
+func errorRetryable(policy types.CommandRetryPolicy, codes []int) bool {
+	for _, code := range codes {
+		for _, retryable := range policy.RetryableErrorCodes {
+			if code == retryable {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// scheduleCommandRetry decides when a command the device returned an Error for is sent again, or gives up on it
+func scheduleCommandRetry(commandUUID string, rawPayload []byte) error {
+	var command types.Command
+	err := db.DB.Where("command_uuid = ?", commandUUID).First(&command).Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "scheduleCommandRetry")
+	}
+
+	policy := commandRetryPolicy(command.RequestType)
+	var nextRetry *time.Time
+	if !neverResentRequestTypes[command.RequestType] && errorRetryable(policy, errorChainCodes(rawPayload)) {
+		nextRetry = nextCommandRetry(policy, max(command.AttemptCount, 1), time.Now())
+	}
+
+	return updateCommandRetry(command, max(command.AttemptCount, 1), nextRetry)
+}
+
+func updateCommandRetry(command types.Command, attempts int, nextRetry *time.Time) error {
+	if nextRetry == nil {
+		InfoLogger(LogHolder{DeviceUDID: command.DeviceUDID, CommandUUID: command.CommandUUID, CommandRequestType: command.RequestType, CommandStatus: command.Status, Message: "Command will not be retried"})
+	}
+
+	err := db.DB.Model(&types.Command{}).
+		Where("command_uuid = ?", command.CommandUUID).
+		Updates(map[string]interface{}{
+			"attempt_count":     attempts,
+			"next_retry_at":     nextRetry,
+			"retries_exhausted": nextRetry == nil,
+		}).Error
+	if err != nil {
+		return errors.Wrap(err, "updateCommandRetry")
+	}
+
+	return nil
+}
+
+// retryErrorCommands sends the Error commands that are due again
+func retryErrorCommands() error {
+	var commands []types.Command
+	err := db.DB.
+		Where("status = ? AND retries_exhausted IS NOT TRUE AND retried_as = ? AND next_retry_at <= ?", "Error", "", time.Now()).
+		Find(&commands).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "Select Error commands to retry")
+	}
+
+	for i := range commands {
+		err = retryCommand(commands[i])
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: commands[i].DeviceUDID, CommandUUID: commands[i].CommandUUID, CommandRequestType: commands[i].RequestType, Message: err.Error()})
+		}
+	}
+
+	return nil
+}
+
+// retryCommand sends a command again through SendCommand. A send that fails counts as an attempt.
+func retryCommand(command types.Command) error {
+	var retried types.Command
+	var err error
+
+	attempt := max(command.AttemptCount, 1) + 1
+	if command.RequestType == "InstallProfile" {
+		retried, err = retryInstallProfile(command, attempt)
+		if intErrors.Is(err, errProfileNotInstalled) {
+			return updateCommandRetry(command, attempt-1, nil)
+		}
+	} else {
+		payload := types.CommandPayload{
+			UDID:              command.DeviceUDID,
+			RequestType:       command.RequestType,
+			Queries:           command.Queries,
+			Identifier:        command.Identifier,
+			ManifestURL:       command.ManifestURL,
+			ProfileIdentifier: command.ProfileIdentifier,
+			ProfileUUID:       command.ProfileUUID,
+			Attempt:           attempt,
+		}
+		if command.Params != "" {
+			err = json.Unmarshal([]byte(command.Params), &payload.Params)
+			if err != nil {
+				return errors.Wrap(err, "retryCommand: unmarshal params")
+			}
+		}
+		retried, err = SendCommand(payload)
+	}
+	if err != nil {
+		updateErr := updateCommandRetry(command, attempt, nextCommandRetry(commandRetryPolicy(command.RequestType), attempt, time.Now()))
+		if updateErr != nil {
+			ErrorLogger(LogHolder{DeviceUDID: command.DeviceUDID, CommandUUID: command.CommandUUID, Message: updateErr.Error()})
+		}
+		return errors.Wrap(err, "retryCommand")
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: command.DeviceUDID, CommandUUID: retried.CommandUUID, CommandRequestType: command.RequestType, Message: "Retried command", Metric: fmt.Sprintf("attempt %v", attempt)})
+	err = db.DB.Model(&types.Command{}).
+		Where("command_uuid = ?", command.CommandUUID).
+		Updates(map[string]interface{}{"retried_as": retried.CommandUUID, "next_retry_at": nil}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "retryCommand")
+	}
+
+	err = replaceWorkflowPrerequisite(command.CommandUUID, retried.CommandUUID)
+	if err != nil {
+		return errors.Wrap(err, "retryCommand")
+	}
+
+	return nil
+}
+
+var errProfileNotInstalled = errors.New("profile is no longer installed for the device")
+
+// retryInstallProfile pushes the current version of the profile the command installed, rendered, encrypted and
+// signed again. Device profiles take precedence over group profiles, which take precedence over shared profiles.
+func retryInstallProfile(command types.Command, attempt int) (types.Command, error) {
+	var commands []types.Command
+	var deviceProfiles []types.DeviceProfile
+	var sharedProfiles []types.SharedProfile
+
+	device, err := GetDevice(command.DeviceUDID)
+	if err != nil {
+		return types.Command{}, errors.Wrap(err, "retryInstallProfile")
+	}
+
+	err = db.DB.Where("device_ud_id = ? AND payload_identifier = ? AND installed = ?", device.UDID, command.ProfileIdentifier, true).
+		Find(&deviceProfiles).
+		Error
+	if err != nil {
+		return types.Command{}, errors.Wrap(err, "retryInstallProfile: load device profile")
+	}
+	groupProfiles, err := groupProfilesForDevice(device.UDID)
+	if err != nil {
+		return types.Command{}, errors.Wrap(err, "retryInstallProfile: load group profiles")
+	}
+	groupProfile := groupProfileInstalled(groupProfiles, command.ProfileIdentifier)
+
+	switch {
+	case len(deviceProfiles) > 0:
+		commands, err = PushProfiles([]types.Device{device}, deviceProfiles)
+	case groupProfile != nil:
+		commands, err = PushGroupProfiles([]types.Device{device}, []types.GroupProfile{*groupProfile})
+	default:
+		err = db.DB.Where("payload_identifier = ? AND installed = ?", command.ProfileIdentifier, true).Find(&sharedProfiles).Error
+		if err != nil {
+			return types.Command{}, errors.Wrap(err, "retryInstallProfile: load shared profile")
+		}
+		if len(sharedProfiles) == 0 {
+			return types.Command{}, errProfileNotInstalled
+		}
+		// Devices in a rollout are retried with the version they are rolling out to
+		sharedProfiles, err = applyProfileRollouts(device.UDID, sharedProfiles)
+		if err != nil {
+			return types.Command{}, errors.Wrap(err, "retryInstallProfile: load profile rollouts")
+		}
+		commands, err = PushSharedProfiles([]types.Device{device}, sharedProfiles)
+	}
+	if err != nil {
+		return types.Command{}, errors.Wrap(err, "retryInstallProfile")
+	}
+
+	for _, retried := range commands {
+		if retried.CommandUUID == "" {
+			continue
+		}
+		err = db.DB.Model(&types.Command{}).Where("command_uuid = ?", retried.CommandUUID).Update("attempt_count", attempt).Error
+		if err != nil {
+			return retried, errors.Wrap(err, "retryInstallProfile")
+		}
+		return retried, nil
+	}
+
+	return types.Command{}, errors.New("retryInstallProfile: profile was not sent")
+}
+
+// groupProfileInstalled returns the installed group profile with the identifier, if there is one
+func groupProfileInstalled(groupProfiles []types.GroupProfile, payloadIdentifier string) *types.GroupProfile {
+	for i := range groupProfiles {
+		if groupProfiles[i].PayloadIdentifier == payloadIdentifier && groupProfileOverridesShared(groupProfiles[i]) {
+			return &groupProfiles[i]
+		}
+	}
+
+	return nil
+}
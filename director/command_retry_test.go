@@ -0,0 +1,120 @@
+package director
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommandRetryPolicies(t *testing.T) {
+	policies, err := parseCommandRetryPolicies([]byte(`{
+		"default": {"max_attempts": 4},
+		"InstallProfile": {"initial_backoff_seconds": 60, "retryable_error_codes": [4001]}
+	}`))
+	require.NoError(t, err)
+
+	require.Equal(t, types.CommandRetryPolicy{MaxAttempts: 4, InitialBackoff: 120, MaxBackoff: 21600, Multiplier: 2}, policies["default"])
+	require.Equal(t, types.CommandRetryPolicy{
+		MaxAttempts:         4,
+		InitialBackoff:      60,
+		MaxBackoff:          21600,
+		Multiplier:          2,
+		RetryableErrorCodes: []int{4001},
+	}, policies["InstallProfile"])
+
+	_, err = parseCommandRetryPolicies([]byte(`{"ProfileList": {"multiplier": 0.5}}`))
+	require.Error(t, err)
+
+	_, err = parseCommandRetryPolicies([]byte(`{"ProfileList": {"initial_backoff_seconds": 600, "max_backoff_seconds": 60}}`))
+	require.Error(t, err)
+}
+
+func TestNextCommandRetry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy := types.CommandRetryPolicy{MaxAttempts: 5, InitialBackoff: 60, MaxBackoff: 300, Multiplier: 2}
+
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		next := nextCommandRetry(policy, tt.attempt, now)
+		require.NotNil(t, next)
+		require.Equal(t, tt.expected, next.Sub(now))
+	}
+
+	require.Nil(t, nextCommandRetry(policy, 5, now))
+}
+
+func TestErrorChainCodes(t *testing.T) {
+	rawPayload := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>CommandUUID</key>
+	<string>5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f</string>
+	<key>ErrorChain</key>
+	<array>
+		<dict>
+			<key>ErrorCode</key>
+			<integer>4001</integer>
+			<key>ErrorDomain</key>
+			<string>MCProfileErrorDomain</string>
+		</dict>
+		<dict>
+			<key>ErrorCode</key>
+			<integer>12021</integer>
+			<key>ErrorDomain</key>
+			<string>MDMErrorDomain</string>
+		</dict>
+	</array>
+	<key>Status</key>
+	<string>Error</string>
+</dict>
+</plist>`)
+
+	codes := errorChainCodes(rawPayload)
+	require.Equal(t, []int{4001, 12021}, codes)
+
+	require.True(t, errorRetryable(types.CommandRetryPolicy{RetryableErrorCodes: []int{12021}}, codes))
+	require.False(t, errorRetryable(types.CommandRetryPolicy{RetryableErrorCodes: []int{1000}}, codes))
+	require.False(t, errorRetryable(defaultCommandRetryPolicy, codes))
+	require.Empty(t, errorChainCodes([]byte("not a plist")))
+}
+
+func TestNeverResentRequestTypes_CoverSecretParams(t *testing.T) {
+	for requestType, params := range genericCommands {
+		for name := range params {
+			if strings.Contains(name, "password") || strings.Contains(name, "token") || strings.Contains(name, "pin") {
+				require.True(t, neverResentRequestTypes[requestType], "%v carries %v", requestType, name)
+			}
+		}
+	}
+}
+
+func TestCommandJSON_LeavesOutParams(t *testing.T) {
+	output, err := json.Marshal(types.Command{CommandUUID: "command-1", RequestType: "SetRecoveryLock", Params: `{"new_password":"secret"}`})
+	require.NoError(t, err)
+	require.NotContains(t, string(output), "secret")
+}
+
+func TestGroupProfileInstalled(t *testing.T) {
+	groupProfiles := []types.GroupProfile{
+		{PayloadIdentifier: "com.example.disabled", Installed: false},
+		{PayloadIdentifier: "com.example.wifi", Installed: true},
+	}
+
+	require.Nil(t, groupProfileInstalled(groupProfiles, "com.example.disabled"))
+	require.Nil(t, groupProfileInstalled(groupProfiles, "com.example.missing"))
+	require.Equal(t, "com.example.wifi", groupProfileInstalled(groupProfiles, "com.example.wifi").PayloadIdentifier)
+}
@@ -18,12 +18,27 @@ import (
 )
 
 func UpdateDevice(newDevice types.Device) (*types.Device, error) {
+	device, err := saveDevice(&newDevice)
+	if err != nil {
+		return device, err
+	}
+
+	err = configureDevice(newDevice)
+	if err != nil {
+		return device, err
+	}
+
+	return device, nil
+}
+
+// saveDevice creates or updates the device, without sending it anything
+func saveDevice(newDevice *types.Device) (*types.Device, error) {
 	var device types.Device
 	var oldDevice types.Device
 
 	if newDevice.UDID == "" && device.SerialNumber == "" {
 		err := fmt.Errorf("no device UDID or serial set")
-		return &newDevice, errors.Wrap(err, "UpdateDevice")
+		return newDevice, errors.Wrap(err, "UpdateDevice")
 	}
 	now := time.Now()
 
@@ -31,12 +46,12 @@ func UpdateDevice(newDevice types.Device) (*types.Device, error) {
 	if newDevice.UDID != "" {
 		if err := db.DB.Where("ud_id = ?", newDevice.UDID).First(&device).Scan(&oldDevice).Error; err != nil {
 			if intErrors.Is(err, gorm.ErrRecordNotFound) {
-				db.DB.Create(&newDevice)
+				db.DB.Create(newDevice)
 			}
 		} else {
-			err := db.DB.Model(&device).Where("ud_id = ?", newDevice.UDID).Assign(&newDevice).FirstOrCreate(&device).Error
+			err := db.DB.Model(&device).Where("ud_id = ?", newDevice.UDID).Assign(newDevice).FirstOrCreate(&device).Error
 			if err != nil {
-				return &newDevice, errors.Wrap(err, "Update device first or create udid")
+				return newDevice, errors.Wrap(err, "Update device first or create udid")
 			}
 		}
 	}
@@ -44,36 +59,50 @@ func UpdateDevice(newDevice types.Device) (*types.Device, error) {
 	if newDevice.SerialNumber != "" {
 		if err := db.DB.Where("serial_number = ?", newDevice.SerialNumber).First(&device).Scan(&oldDevice).Error; err != nil {
 			if intErrors.Is(err, gorm.ErrRecordNotFound) {
-				db.DB.Create(&newDevice)
+				db.DB.Create(newDevice)
 			}
 		} else {
-			err := db.DB.Model(&device).Where("serial_number = ?", newDevice.SerialNumber).Assign(&newDevice).FirstOrCreate(&device).Error
+			err := db.DB.Model(&device).Where("serial_number = ?", newDevice.SerialNumber).Assign(newDevice).FirstOrCreate(&device).Error
 			if err != nil {
-				return &newDevice, errors.Wrap(err, "Update device first or create serial")
+				return newDevice, errors.Wrap(err, "Update device first or create serial")
 			}
 		}
 	}
 
-	err := UpdateDeviceBools(&newDevice)
+	err := UpdateDeviceBools(newDevice)
 	if err != nil {
 		return &device, errors.Wrap(err, "UpdateDevice")
 	}
 
+	return &device, nil
+}
+
+// configureDevice queues an evaluation of the smart groups of a saved device and sends it DeviceConfigured or its
+// initial tasks when it is waiting for them
+func configureDevice(newDevice types.Device) error {
+	evaluateSmartGroupsLater(newDevice.UDID)
+
 	if newDevice.AwaitingConfiguration && newDevice.InitialTasksRun {
-		err := SendDeviceConfigured(newDevice)
+		held, err := deviceHasWaitingStep(newDevice.UDID, "DeviceConfigured")
 		if err != nil {
-			return &device, errors.Wrap(err, "UpdateDevice:SendDeviceConfigured")
+			return errors.Wrap(err, "UpdateDevice")
+		}
+		if !held {
+			err = SendDeviceConfigured(newDevice)
+			if err != nil {
+				return errors.Wrap(err, "UpdateDevice:SendDeviceConfigured")
+			}
 		}
 	}
 
 	if !newDevice.InitialTasksRun && newDevice.AwaitingConfiguration {
 		err := RunInitialTasks(newDevice.UDID)
 		if err != nil {
-			return &device, errors.Wrap(err, "UpdateDevice:RunInitialTasks")
+			return errors.Wrap(err, "UpdateDevice:RunInitialTasks")
 		}
 	}
 
-	return &device, nil
+	return nil
 }
 
 func UpdateDeviceBools(newDevice *types.Device) error {
@@ -183,127 +212,86 @@ func GetAllDevicesAndAssociations() ([]types.Device, error) {
 	return devices, nil
 }
 
+// PostDeviceCommandHandler queues a device_command job that locks, erases or clears the queue of each device, and
+// responds with the job to poll at /jobs/{id}
 func PostDeviceCommandHandler(w http.ResponseWriter, r *http.Request) {
 	var out types.DeviceCommandPayload
-	var devices []types.Device
 	vars := mux.Vars(r)
 
 	err := json.NewDecoder(r.Body).Decode(&out)
 	if err != nil {
 		ErrorLogger(LogHolder{Message: err.Error()})
-		http.Error(
-			w,
-			http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError,
-		)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 
 	command := vars["command"]
-	pushNow := out.PushNow
-	value := out.Value
-	pin := out.Pin
-	if out.DeviceUDIDs != nil {
-		for i := range out.DeviceUDIDs {
-			device, err := GetDevice(out.DeviceUDIDs[i])
-			if err != nil {
-				ErrorLogger(LogHolder{Message: err.Error()})
-				http.Error(
-					w,
-					http.StatusText(http.StatusInternalServerError),
-					http.StatusInternalServerError,
-				)
-			}
-			devices = append(devices, device)
-		}
+	if command != "clear_queue" && command != "device_lock" && command != "erase_device" {
+		http.Error(w, "command must be clear_queue, device_lock or erase_device", http.StatusBadRequest)
+		return
 	}
 
-	if out.SerialNumbers != nil {
-		for i := range out.SerialNumbers {
-			device, err := GetDeviceSerial(out.SerialNumbers[i])
-			if err != nil {
-				ErrorLogger(LogHolder{Message: err.Error()})
-				http.Error(
-					w,
-					http.StatusText(http.StatusInternalServerError),
-					http.StatusInternalServerError,
-				)
-			}
-			devices = append(devices, device)
+	// The lock or erase state and PIN are saved on the devices now, so the PIN is never kept in the job
+	if command != "clear_queue" {
+		err = setDeviceCommandState(command, out)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 	}
 
-	for i := range devices {
-		device := devices[i]
-		var deviceModel types.Device
-		if command == "clear_queue" {
-			err = clearCommandQueue(device)
-			if err != nil {
-				ErrorLogger(LogHolder{Message: err.Error()})
-				http.Error(
-					w,
-					http.StatusText(http.StatusInternalServerError),
-					http.StatusInternalServerError,
-				)
-			}
-			return
-		}
-		if command == "device_lock" {
-			if pin != "" {
-				err := db.DB.Model(&deviceModel).
-					Select("lock", "unlock_pin").
-					Where("ud_id = ?", device.UDID).
-					Updates(map[string]interface{}{
-						"lock":       value,
-						"unlock_pin": pin,
-					}).
-					Error
-				if err != nil {
-					ErrorLogger(LogHolder{Message: err.Error()})
-				}
-			} else {
-				err := db.DB.Model(&deviceModel).Select("lock", "unlock_pin").Where("ud_id = ?", device.UDID).Updates(map[string]interface{}{
-					"lock":       value,
-					"unlock_pin": "",
-				}).Error
-				if err != nil {
-					ErrorLogger(LogHolder{Message: err.Error()})
-				}
-			}
+	job, err := createJob(jobTypeDeviceCommand, types.DeviceCommandJobParams{
+		Command: command,
+		Value:   out.Value,
+		PushNow: out.PushNow,
+	}, jobItemsForTargets(out.DeviceUDIDs, out.SerialNumbers))
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 
-		}
+	writeQueuedJob(w, job)
+}
 
-		if command == "erase_device" {
-			if pin != "" {
-				err := db.DB.Model(&deviceModel).
-					Select("erase", "unlock_pin").
-					Where("ud_id = ?", device.UDID).
-					Updates(map[string]interface{}{
-						"erase":      value,
-						"unlock_pin": pin,
-					}).
-					Error
-				if err != nil {
-					ErrorLogger(LogHolder{Message: err.Error()})
-				}
-			} else {
-				err := db.DB.Model(&deviceModel).Select("erase", "unlock_pin").Where("ud_id = ?", device.UDID).Updates(map[string]interface{}{
-					"erase":      value,
-					"unlock_pin": "",
-				}).Error
-				if err != nil {
-					ErrorLogger(LogHolder{Message: err.Error()})
-				}
-			}
-		}
+// setDeviceCommandState sets the lock or erase state and unlock PIN of the requested devices
+func setDeviceCommandState(command string, out types.DeviceCommandPayload) error {
+	column := "lock"
+	if command == "erase_device" {
+		column = "erase"
+	}
 
-		if pushNow {
-			err = EraseLockDevice(device.UDID)
-			if err != nil {
-				ErrorLogger(LogHolder{Message: err.Error()})
-			}
-		}
+	err := db.DB.Model(&types.Device{}).
+		Select(column, "unlock_pin").
+		Where("ud_id IN ? OR serial_number IN ?", out.DeviceUDIDs, out.SerialNumbers).
+		Updates(map[string]interface{}{
+			column:       out.Value,
+			"unlock_pin": out.Pin,
+		}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "setDeviceCommandState")
+	}
 
+	return nil
+}
+
+// applyDeviceCommand sends the lock or erase command set on the device when push_now is set, or clears its queue.
+// EraseLockDevice leaves a command that is already in the queue alone, so applying it again doesn't send it twice.
+func applyDeviceCommand(device types.Device, params types.DeviceCommandJobParams) error {
+	if params.Command == "clear_queue" {
+		return clearCommandQueue(device)
 	}
+
+	if params.PushNow {
+		err := EraseLockDevice(device.UDID)
+		if err != nil {
+			return errors.Wrap(err, "applyDeviceCommand")
+		}
+	}
+
+	return nil
 }
 
 func DeviceHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,687 @@
+package director
+
+import (
+	"encoding/json"
+	intErrors "errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"gorm.io/gorm"
+)
+
+func GetDeviceGroup(name string) (types.DeviceGroup, error) {
+	var group types.DeviceGroup
+
+	if name == "" {
+		err := errors.New("no group name set")
+		return group, errors.Wrap(err, "GetDeviceGroup")
+	}
+
+	err := db.DB.Where("name = ?", name).First(&group).Error
+	if err != nil {
+		return group, errors.Wrapf(err, "GetDeviceGroup %v", name)
+	}
+
+	return group, nil
+}
+
+// getDeviceGroups loads every named group, so a request naming a group that doesn't exist can be refused before any
+// group is changed
+func getDeviceGroups(names []string) ([]types.DeviceGroup, error) {
+	groups := make([]types.DeviceGroup, 0, len(names))
+	for _, name := range names {
+		group, err := GetDeviceGroup(name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func GetDeviceGroupMembers(group types.DeviceGroup) ([]types.Device, error) {
+	var devices []types.Device
+
+	err := db.DB.Model(&types.Device{}).
+		Joins("JOIN device_group_members ON device_group_members.device_ud_id = devices.ud_id").
+		Where("device_group_members.group_id = ?", group.ID).
+		Find(&devices).
+		Error
+	if err != nil {
+		return devices, errors.Wrap(err, "GetDeviceGroupMembers")
+	}
+
+	return devices, nil
+}
+
+// groupProfilesForDevice returns the group profiles assigned to every group the device is a member of.
+// If more than one group carries the same PayloadIdentifier, an installed profile wins over a removed one and then
+// the group that sorts first by name wins.
+func groupProfilesForDevice(udid string) ([]types.GroupProfile, error) {
+	var groupProfiles []types.GroupProfile
+	var profiles []types.GroupProfile
+
+	err := db.DB.Model(&types.GroupProfile{}).
+		Select("group_profiles.*").
+		Joins("JOIN device_group_members ON device_group_members.group_id = group_profiles.group_id").
+		Joins("JOIN device_groups ON device_groups.id = group_profiles.group_id").
+		Where("device_group_members.device_ud_id = ?", udid).
+		Order("group_profiles.installed desc, device_groups.name").
+		Find(&groupProfiles).
+		Error
+	if err != nil {
+		return nil, errors.Wrap(err, "groupProfilesForDevice")
+	}
+
+	seen := make(map[string]struct{}, len(groupProfiles))
+	for _, profile := range groupProfiles {
+		if _, ok := seen[profile.PayloadIdentifier]; ok {
+			continue
+		}
+		seen[profile.PayloadIdentifier] = struct{}{}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// orphanedGroupProfiles returns the profiles of groups the device has left and is not a member of again, so they
+// can be removed from it.
+func orphanedGroupProfiles(udid string) ([]types.GroupProfile, error) {
+	var groupProfiles []types.GroupProfile
+
+	err := db.DB.Model(&types.GroupProfile{}).
+		Select("group_profiles.*").
+		Joins("JOIN device_group_departures ON device_group_departures.group_id = group_profiles.group_id").
+		Where("device_group_departures.device_ud_id = ?", udid).
+		Where("group_profiles.group_id NOT IN (?)", db.DB.Model(&types.DeviceGroupMember{}).Select("group_id").Where("device_ud_id = ?", udid)).
+		Find(&groupProfiles).
+		Error
+	if err != nil {
+		return nil, errors.Wrap(err, "orphanedGroupProfiles")
+	}
+
+	return groupProfiles, nil
+}
+
+// removeDeviceGroupMember takes the device out of the group and records the departure, so the group's profiles are
+// removed from the device when its next ProfileList is verified.
+func removeDeviceGroupMember(tx *gorm.DB, groupID uuid.UUID, udid string) error {
+	err := tx.Where("group_id = ? AND device_ud_id = ?", groupID, udid).Delete(&types.DeviceGroupMember{}).Error
+	if err != nil {
+		return errors.Wrap(err, "removeDeviceGroupMember: delete member")
+	}
+
+	departure := types.DeviceGroupDeparture{GroupID: groupID, DeviceUDID: udid}
+	err = tx.Where(&departure).Assign(types.DeviceGroupDeparture{LeftAt: time.Now()}).FirstOrCreate(&departure).Error
+	if err != nil {
+		return errors.Wrap(err, "removeDeviceGroupMember: record departure")
+	}
+
+	return nil
+}
+
+// settleDeviceGroupDepartures forgets the groups a device left once its ProfileList no longer contains their
+// profiles. pendingGroups are the groups with profiles that are still installed on the device.
+func settleDeviceGroupDepartures(udid string, pendingGroups map[uuid.UUID]struct{}) error {
+	query := db.DB.Where("device_ud_id = ?", udid)
+	if len(pendingGroups) > 0 {
+		groupIDs := make([]uuid.UUID, 0, len(pendingGroups))
+		for groupID := range pendingGroups {
+			groupIDs = append(groupIDs, groupID)
+		}
+		query = query.Where("group_id NOT IN ?", groupIDs)
+	}
+
+	err := query.Delete(&types.DeviceGroupDeparture{}).Error
+	if err != nil {
+		return errors.Wrap(err, "settleDeviceGroupDepartures")
+	}
+
+	return nil
+}
+
+// purgeDeletedGroupProfiles deletes the profiles of deleted groups once no device that left them still has to have
+// them removed.
+func purgeDeletedGroupProfiles() error {
+	err := db.DB.
+		Where("group_id NOT IN (?)", db.DB.Model(&types.DeviceGroup{}).Select("id")).
+		Where("group_id NOT IN (?)", db.DB.Model(&types.DeviceGroupDeparture{}).Select("group_id")).
+		Delete(&types.GroupProfile{}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "purgeDeletedGroupProfiles")
+	}
+
+	return nil
+}
+
+// groupProfileOverridesShared reports whether the group profile takes the place of the shared profile with the same
+// identifier. Only installed group profiles do, once a group profile is removed the shared profile applies again.
+// devicesWithGroupProfile follows the same rule.
+func groupProfileOverridesShared(groupProfile types.GroupProfile) bool {
+	return groupProfile.Installed
+}
+
+// devicesWithGroupProfile returns the UDIDs of devices that receive a version of the profile through a group, which
+// replaces the shared profile for them.
+func devicesWithGroupProfile(payloadIdentifier string) (map[string]struct{}, error) {
+	var members []types.DeviceGroupMember
+
+	err := db.DB.Model(&types.DeviceGroupMember{}).
+		Select("DISTINCT device_group_members.device_ud_id").
+		Joins("JOIN group_profiles ON group_profiles.group_id = device_group_members.group_id").
+		Where("group_profiles.payload_identifier = ? AND group_profiles.installed = ?", payloadIdentifier, true).
+		Find(&members).
+		Error
+	if err != nil {
+		return nil, errors.Wrap(err, "devicesWithGroupProfile")
+	}
+
+	udids := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		udids[member.DeviceUDID] = struct{}{}
+	}
+
+	return udids, nil
+}
+
+func groupProfileToDeviceProfile(groupProfile types.GroupProfile) types.DeviceProfile {
+	var deviceProfile types.DeviceProfile
+	deviceProfile.PayloadUUID = groupProfile.PayloadUUID
+	deviceProfile.PayloadIdentifier = groupProfile.PayloadIdentifier
+	deviceProfile.HashedPayloadUUID = groupProfile.HashedPayloadUUID
+	deviceProfile.MobileconfigData = groupProfile.MobileconfigData
+	deviceProfile.MobileconfigHash = groupProfile.MobileconfigHash
+	deviceProfile.Installed = groupProfile.Installed
+	deviceProfile.Encrypted = groupProfile.Encrypted
+	return deviceProfile
+}
+
+func groupProfileForVerification(groupProfile types.GroupProfile, udid string) ProfileForVerification {
+	var profileForVerification ProfileForVerification
+	profileForVerification.PayloadUUID = groupProfile.PayloadUUID
+	profileForVerification.PayloadIdentifier = groupProfile.PayloadIdentifier
+	profileForVerification.HashedPayloadUUID = groupProfile.HashedPayloadUUID
+	profileForVerification.MobileconfigData = groupProfile.MobileconfigData
+	profileForVerification.MobileconfigHash = groupProfile.MobileconfigHash
+	profileForVerification.DeviceUDID = udid
+	profileForVerification.Installed = groupProfile.Installed
+	profileForVerification.Encrypted = groupProfile.Encrypted
+	profileForVerification.Type = "group"
+	return profileForVerification
+}
+
+func SaveGroupProfiles(group types.DeviceGroup, profiles []types.DeviceProfile) ([]types.GroupProfile, error) {
+	var groupProfiles []types.GroupProfile
+
+	for _, profileData := range profiles {
+		var groupProfile types.GroupProfile
+		if profileData.PayloadIdentifier == "" {
+			continue
+		}
+
+		err := db.DB.Where("group_id = ? AND payload_identifier = ?", group.ID, profileData.PayloadIdentifier).
+			Delete(&types.GroupProfile{}).
+			Error
+		if err != nil {
+			return groupProfiles, errors.Wrap(err, "Deleting group profiles")
+		}
+
+		groupProfile.GroupID = group.ID
+		groupProfile.PayloadUUID = profileData.PayloadUUID
+		groupProfile.PayloadIdentifier = profileData.PayloadIdentifier
+		groupProfile.HashedPayloadUUID = profileData.HashedPayloadUUID
+		groupProfile.MobileconfigData = profileData.MobileconfigData
+		groupProfile.MobileconfigHash = profileData.MobileconfigHash
+		groupProfile.Installed = true
+		groupProfile.Encrypted = profileData.Encrypted
+
+		err = db.DB.Create(&groupProfile).Error
+		if err != nil {
+			return groupProfiles, errors.Wrap(err, "Saving group profiles")
+		}
+		groupProfiles = append(groupProfiles, groupProfile)
+	}
+
+	return groupProfiles, nil
+}
+
+func DisableGroupProfiles(group types.DeviceGroup, payload types.DeleteProfilePayload) ([]types.GroupProfile, error) {
+	var groupProfiles []types.GroupProfile
+
+	for _, profile := range payload.Mobileconfigs {
+		err := db.DB.Model(&types.GroupProfile{}).
+			Where("group_id = ? AND payload_identifier = ?", group.ID, profile.PayloadIdentifier).
+			Updates(map[string]interface{}{
+				"installed": false,
+			}).
+			Error
+		if err != nil {
+			return groupProfiles, errors.Wrap(err, "DisableGroupProfiles: Could not set installed = false")
+		}
+		groupProfiles = append(groupProfiles, types.GroupProfile{GroupID: group.ID, PayloadIdentifier: profile.PayloadIdentifier})
+	}
+
+	return groupProfiles, nil
+}
+
+// PushGroupProfiles pushes group profiles to the given devices, skipping any device that has a device-specific version
+func PushGroupProfiles(devices []types.Device, profiles []types.GroupProfile) ([]types.Command, error) {
+	var pushedCommands []types.Command
+	for i := range profiles {
+		profileData := profiles[i]
+
+		skipUDIDs, err := devicesWithDeviceProfile(profileData.PayloadIdentifier)
+		if err != nil {
+			return pushedCommands, errors.Wrap(err, "PushGroupProfiles")
+		}
+
+		var targets []types.Device
+		for _, device := range devices {
+			if _, ok := skipUDIDs[device.UDID]; ok {
+				continue
+			}
+			targets = append(targets, device)
+		}
+
+		commands, err := PushProfiles(targets, []types.DeviceProfile{groupProfileToDeviceProfile(profileData)})
+		if err != nil {
+			return pushedCommands, errors.Wrap(err, "PushGroupProfiles")
+		}
+		pushedCommands = append(pushedCommands, commands...)
+	}
+
+	return pushedCommands, nil
+}
+
+// DeleteGroupProfiles removes group profiles from the given devices, skipping any device that has a device-specific version
+func DeleteGroupProfiles(devices []types.Device, profiles []types.GroupProfile) ([]types.Command, error) {
+	var pushedCommands []types.Command
+	for i := range profiles {
+		profileData := profiles[i]
+
+		skipUDIDs, err := devicesWithDeviceProfile(profileData.PayloadIdentifier)
+		if err != nil {
+			return pushedCommands, errors.Wrap(err, "DeleteGroupProfiles")
+		}
+
+		var targets []types.Device
+		for _, device := range devices {
+			if _, ok := skipUDIDs[device.UDID]; ok {
+				continue
+			}
+			targets = append(targets, device)
+		}
+
+		commands, err := DeleteDeviceProfiles(targets, []types.DeviceProfile{groupProfileToDeviceProfile(profileData)})
+		if err != nil {
+			return pushedCommands, errors.Wrap(err, "DeleteGroupProfiles")
+		}
+		pushedCommands = append(pushedCommands, commands...)
+	}
+
+	return pushedCommands, nil
+}
+
+// devicesWithDeviceProfile returns the UDIDs of devices that have a device-specific version of the profile.
+func devicesWithDeviceProfile(payloadIdentifier string) (map[string]struct{}, error) {
+	var deviceProfiles []types.DeviceProfile
+	err := db.DB.Select("device_ud_id").Where("payload_identifier = ?", payloadIdentifier).Find(&deviceProfiles).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "devicesWithDeviceProfile")
+	}
+
+	udids := make(map[string]struct{}, len(deviceProfiles))
+	for _, deviceProfile := range deviceProfiles {
+		udids[deviceProfile.DeviceUDID] = struct{}{}
+	}
+
+	return udids, nil
+}
+
+func SaveGroupInstallApplications(group types.DeviceGroup, payload types.InstallApplicationPayload) error {
+	for _, ManifestURL := range payload.ManifestURLs {
+		var groupInstallApplication types.GroupInstallApplication
+		groupInstallApplication.GroupID = group.ID
+		groupInstallApplication.ManifestURL = ManifestURL.URL
+		err := db.DB.Model(&groupInstallApplication).Where("group_id = ? AND manifest_url = ?", group.ID, ManifestURL.URL).Assign(&groupInstallApplication).FirstOrCreate(&groupInstallApplication).Error
+		if err != nil {
+			return errors.Wrap(err, "SaveGroupInstallApplications")
+		}
+	}
+
+	return nil
+}
+
+func groupInstallApplicationsForDevice(udid string) ([]types.GroupInstallApplication, error) {
+	var groupInstallApplications []types.GroupInstallApplication
+
+	err := db.DB.Model(&types.GroupInstallApplication{}).
+		Select("group_install_applications.*").
+		Joins("JOIN device_group_members ON device_group_members.group_id = group_install_applications.group_id").
+		Where("device_group_members.device_ud_id = ?", udid).
+		Find(&groupInstallApplications).
+		Error
+	if err != nil {
+		return nil, errors.Wrap(err, "groupInstallApplicationsForDevice")
+	}
+
+	return groupInstallApplications, nil
+}
+
+func devicesFromIdentifiers(udids []string, serials []string) []types.Device {
+	var devices []types.Device
+	for _, udid := range udids {
+		device, err := GetDevice(udid)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: udid, Message: err.Error()})
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	for _, serial := range serials {
+		device, err := GetDeviceSerial(serial)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceSerial: serial, Message: err.Error()})
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
+func GetDeviceGroups(w http.ResponseWriter, r *http.Request) {
+	var groups []types.DeviceGroup
+
+	err := db.DB.Find(&groups).Error
+	if err != nil {
+		log.Errorf("Couldn't scan to DeviceGroup model: %v", err)
+	}
+	output, err := json.MarshalIndent(&groups, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+func PostDeviceGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.DeviceGroupPayload
+	var group types.DeviceGroup
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if out.Name == "" {
+		http.Error(w, "group name is required", http.StatusBadRequest)
+		return
+	}
+
+	rules := normalizeSmartGroupRules(out.Rules)
+	if out.Smart {
+		err = validateSmartGroupRules(rules)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if len(rules) > 0 {
+		http.Error(w, "rules can only be set on smart groups", http.StatusBadRequest)
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("name = ?", out.Name).
+			Assign(map[string]interface{}{"description": out.Description, "smart": out.Smart}).
+			FirstOrCreate(&group, types.DeviceGroup{Name: out.Name}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("group_id = ?", group.ID).Delete(&types.DeviceGroupRule{}).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range rules {
+			rules[i].GroupID = group.ID
+		}
+		if len(rules) > 0 {
+			err = tx.Create(&rules).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	group.Rules = rules
+
+	if group.Smart {
+		go evaluateSmartGroupForAllDevices(group)
+	}
+
+	output, err := json.MarshalIndent(&group, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+func GetDeviceGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var group types.DeviceGroup
+	vars := mux.Vars(r)
+
+	err := db.DB.Preload("Rules").Preload("Members").Where("name = ?", vars["name"]).First(&group).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	output, err := json.MarshalIndent(&group, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+func DeleteDeviceGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var installedCount int64
+	vars := mux.Vars(r)
+
+	group, err := GetDeviceGroup(vars["name"])
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Deleting a group with installed profiles would orphan them on the member devices
+	err = db.DB.Model(&types.GroupProfile{}).Where("group_id = ? AND installed = ?", group.ID, true).Count(&installedCount).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if installedCount > 0 {
+		http.Error(w, "group still has installed profiles, remove them before deleting the group", http.StatusConflict)
+		return
+	}
+
+	// The group's profiles are kept until every member's ProfileList shows they have been removed, they are purged
+	// by purgeDeletedGroupProfiles afterwards
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		var members []types.DeviceGroupMember
+		if err := tx.Where("group_id = ?", group.ID).Find(&members).Error; err != nil {
+			return err
+		}
+		for _, member := range members {
+			if err := removeDeviceGroupMember(tx, group.ID, member.DeviceUDID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&types.DeviceGroupRule{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&types.GroupInstallApplication{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&group).Error
+	})
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func PostDeviceGroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.DeviceGroupMembersPayload
+	var groupProfiles []types.GroupProfile
+	var groupInstallApplications []types.GroupInstallApplication
+	vars := mux.Vars(r)
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	group, err := GetDeviceGroup(vars["name"])
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if group.Smart {
+		http.Error(w, "membership of smart groups is calculated from their rules", http.StatusConflict)
+		return
+	}
+
+	devices := devicesFromIdentifiers(out.DeviceUDIDs, out.SerialNumbers)
+	for _, device := range devices {
+		member := types.DeviceGroupMember{GroupID: group.ID, DeviceUDID: device.UDID}
+		err = db.DB.Where(&member).FirstOrCreate(&member).Error
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: "Added device to group", Metric: group.Name})
+	}
+
+	if !out.PushNow {
+		return
+	}
+
+	err = db.DB.Where("group_id = ? AND installed = ?", group.ID, true).Find(&groupProfiles).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+	_, err = PushGroupProfiles(devices, groupProfiles)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+
+	err = db.DB.Where("group_id = ?", group.ID).Find(&groupInstallApplications).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+	for _, groupInstallApplication := range groupInstallApplications {
+		_, err = PushInstallApplication(devices, types.DeviceInstallApplication{ManifestURL: groupInstallApplication.ManifestURL})
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+		}
+	}
+}
+
+func DeleteDeviceGroupMembersHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.DeviceGroupMembersPayload
+	vars := mux.Vars(r)
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	group, err := GetDeviceGroup(vars["name"])
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if group.Smart {
+		http.Error(w, "membership of smart groups is calculated from their rules", http.StatusConflict)
+		return
+	}
+
+	devices := devicesFromIdentifiers(out.DeviceUDIDs, out.SerialNumbers)
+	for _, device := range devices {
+		err = db.DB.Transaction(func(tx *gorm.DB) error {
+			return removeDeviceGroupMember(tx, group.ID, device.UDID)
+		})
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: "Removed device from group", Metric: group.Name})
+
+		// The group's profiles are removed when the next ProfileList is verified
+		if out.PushNow {
+			err = RequestProfileList(device)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+			}
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package director
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestGroupProfilesForDevice_Precedence(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	alpha := uuid.New()
+	beta := uuid.New()
+
+	// Installed profiles come first, then groups by name
+	mockSpy.ExpectQuery(`^SELECT group_profiles.\* FROM "group_profiles" JOIN device_group_members .* JOIN device_groups .* WHERE device_group_members.device_ud_id = \$1 ORDER BY group_profiles.installed desc, device_groups.name`).
+		WithArgs("1234-5678-123456").
+		WillReturnRows(sqlmock.NewRows([]string{"group_id", "payload_identifier", "installed"}).
+			AddRow(alpha, "com.example.wifi", true).
+			AddRow(beta, "com.example.vpn", true).
+			AddRow(beta, "com.example.wifi", true).
+			AddRow(alpha, "com.example.vpn", false).
+			AddRow(alpha, "com.example.dock", false))
+
+	profiles, err := groupProfilesForDevice("1234-5678-123456")
+	require.NoError(t, err)
+	require.Equal(t, []types.GroupProfile{
+		{GroupID: alpha, PayloadIdentifier: "com.example.wifi", Installed: true},
+		{GroupID: beta, PayloadIdentifier: "com.example.vpn", Installed: true},
+		{GroupID: alpha, PayloadIdentifier: "com.example.dock", Installed: false},
+	}, profiles)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestGroupProfileOverridesShared(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed bool
+		want      bool
+	}{
+		{name: "installed group profile replaces the shared profile", installed: true, want: true},
+		{name: "removed group profile leaves the shared profile", installed: false, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groupProfile := types.GroupProfile{PayloadIdentifier: "com.example.wifi", Installed: tt.installed}
+			require.Equal(t, tt.want, groupProfileOverridesShared(groupProfile))
+		})
+	}
+}
+
+func TestDevicesWithGroupProfile_OnlyInstalled(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT DISTINCT device_group_members.device_ud_id FROM "device_group_members" JOIN group_profiles .* WHERE group_profiles.payload_identifier = \$1 AND group_profiles.installed = \$2`).
+		WithArgs("com.example.wifi", true).
+		WillReturnRows(sqlmock.NewRows([]string{"device_ud_id"}).AddRow("1234-5678-123456"))
+
+	udids, err := devicesWithGroupProfile("com.example.wifi")
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{"1234-5678-123456": {}}, udids)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestOrphanedGroupProfiles_OnlyDepartedGroups(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	groupID := uuid.New()
+	mockSpy.ExpectQuery(`^SELECT group_profiles.\* FROM "group_profiles" JOIN device_group_departures .* WHERE device_group_departures.device_ud_id = \$1 AND group_profiles.group_id NOT IN \(SELECT "group_id" FROM "device_group_members" WHERE device_ud_id = \$2\)`).
+		WithArgs("1234-5678-123456", "1234-5678-123456").
+		WillReturnRows(sqlmock.NewRows([]string{"group_id", "payload_identifier", "installed"}).AddRow(groupID, "com.example.wifi", true))
+
+	profiles, err := orphanedGroupProfiles("1234-5678-123456")
+	require.NoError(t, err)
+	require.Equal(t, []types.GroupProfile{{GroupID: groupID, PayloadIdentifier: "com.example.wifi", Installed: true}}, profiles)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestSettleDeviceGroupDepartures(t *testing.T) {
+	pendingGroup := uuid.New()
+	tests := []struct {
+		name    string
+		pending map[uuid.UUID]struct{}
+		query   string
+		args    []driver.Value
+	}{
+		{
+			name:  "all profiles removed",
+			query: `^DELETE FROM "device_group_departures" WHERE device_ud_id = \$1$`,
+			args:  []driver.Value{"1234-5678-123456"},
+		},
+		{
+			name:    "profiles still installed",
+			pending: map[uuid.UUID]struct{}{pendingGroup: {}},
+			query:   `^DELETE FROM "device_group_departures" WHERE device_ud_id = \$1 AND group_id NOT IN \(\$2\)$`,
+			args:    []driver.Value{"1234-5678-123456", pendingGroup},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectBegin()
+			mockSpy.ExpectExec(tt.query).WithArgs(tt.args...).WillReturnResult(sqlmock.NewResult(0, 1))
+			mockSpy.ExpectCommit()
+
+			require.NoError(t, settleDeviceGroupDepartures("1234-5678-123456", tt.pending))
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGroupProfileInstalled_SkipsRemoved(t *testing.T) {
+	groupProfiles := []types.GroupProfile{
+		{PayloadIdentifier: "com.example.wifi", Installed: false},
+		{PayloadIdentifier: "com.example.vpn", Installed: true},
+	}
+
+	require.Nil(t, groupProfileInstalled(groupProfiles, "com.example.wifi"))
+	require.NotNil(t, groupProfileInstalled(groupProfiles, "com.example.vpn"))
+}
+
+func TestProfileHandlers_UnknownGroupChangesNothing(t *testing.T) {
+	if flag.Lookup("enrollment-profile") == nil {
+		flag.String("enrollment-profile", "", "")
+	}
+
+	mobileconfig := base64.StdEncoding.EncodeToString(testMobileconfig(`<key>PayloadIdentifier</key><string>com.example.wifi</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><array>
+<dict><key>PayloadType</key><string>com.apple.wifi.managed</string><key>PayloadUUID</key><string>A</string></dict>
+</array>`))
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		handler http.HandlerFunc
+	}{
+		{
+			name:    "post",
+			method:  http.MethodPost,
+			body:    `{"groups": ["engineering", "unknown"], "profiles": ["` + mobileconfig + `"], "push_now": true}`,
+			handler: PostProfileHandler,
+		},
+		{
+			name:    "delete",
+			method:  http.MethodDelete,
+			body:    `{"groups": ["engineering", "unknown"], "profiles": [{"payload_identifier": "com.example.wifi"}], "push_now": true}`,
+			handler: DeleteProfileHandler,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectQuery(`^SELECT \* FROM "device_groups" WHERE name = \$1`).
+				WithArgs("engineering").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(uuid.New(), "engineering"))
+			mockSpy.ExpectQuery(`^SELECT \* FROM "device_groups" WHERE name = \$1`).
+				WithArgs("unknown").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+
+			rr := httptest.NewRecorder()
+			tt.handler(rr, httptest.NewRequest(tt.method, "/profile", strings.NewReader(tt.body)))
+
+			require.Equal(t, http.StatusNotFound, rr.Code)
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeviceGroupMembersHandlers(t *testing.T) {
+	groupID := uuid.New()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		rows    *sqlmock.Rows
+		status  int
+	}{
+		{
+			name:    "add to unknown group",
+			handler: PostDeviceGroupMembersHandler,
+			rows:    sqlmock.NewRows([]string{"id", "name"}),
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "add to smart group",
+			handler: PostDeviceGroupMembersHandler,
+			rows:    sqlmock.NewRows([]string{"id", "name", "smart"}).AddRow(groupID, "engineering", true),
+			status:  http.StatusConflict,
+		},
+		{
+			name:    "remove from unknown group",
+			handler: DeleteDeviceGroupMembersHandler,
+			rows:    sqlmock.NewRows([]string{"id", "name"}),
+			status:  http.StatusNotFound,
+		},
+		{
+			name:    "remove from smart group",
+			handler: DeleteDeviceGroupMembersHandler,
+			rows:    sqlmock.NewRows([]string{"id", "name", "smart"}).AddRow(groupID, "engineering", true),
+			status:  http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectQuery(`^SELECT \* FROM "device_groups" WHERE name = \$1`).
+				WithArgs("engineering").
+				WillReturnRows(tt.rows)
+
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/devicegroups/engineering/members", strings.NewReader(`{"udids": ["1234-5678-123456"]}`)),
+				map[string]string{"name": "engineering"})
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+
+			require.Equal(t, tt.status, rr.Code)
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPostDeviceGroupMembersHandler_AddsMembers(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	groupID := uuid.New()
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_groups" WHERE name = \$1`).
+		WithArgs("engineering").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(groupID, "engineering"))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "devices" WHERE ud_id = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"ud_id", "serial_number"}).AddRow("1234-5678-123456", "C02ABC123"))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "devices" WHERE ud_id = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"ud_id", "serial_number"}).AddRow("1234-5678-123456", "C02ABC123"))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_group_members" WHERE "device_group_members"."group_id" = \$1 AND "device_group_members"."device_ud_id" = \$2`).
+		WithArgs(groupID, "1234-5678-123456", groupID, "1234-5678-123456").
+		WillReturnRows(sqlmock.NewRows([]string{"group_id", "device_ud_id"}))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^INSERT INTO "device_group_members"`).
+		WithArgs(groupID, "1234-5678-123456").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/devicegroups/engineering/members", strings.NewReader(`{"udids": ["1234-5678-123456"]}`)),
+		map[string]string{"name": "engineering"})
+	rr := httptest.NewRecorder()
+	PostDeviceGroupMembersHandler(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestPostProfileHandler_SharedSaveFails(t *testing.T) {
+	if flag.Lookup("enrollment-profile") == nil {
+		flag.String("enrollment-profile", "", "")
+	}
+
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mobileconfig := base64.StdEncoding.EncodeToString(testMobileconfig(`<key>PayloadIdentifier</key><string>com.example.wifi</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><array>
+<dict><key>PayloadType</key><string>com.apple.wifi.managed</string><key>PayloadUUID</key><string>A</string></dict>
+</array>`))
+
+	mockSpy.ExpectQuery(`^SELECT "ud_id","serial_number" FROM "devices"`).
+		WillReturnRows(sqlmock.NewRows([]string{"ud_id", "serial_number"}).AddRow("1234-5678-123456", "C02ABC123"))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "profile_rollouts" SET "status"=\$1`).
+		WillReturnError(errors.New("connection refused"))
+	mockSpy.ExpectRollback()
+
+	body := `{"udids": ["*"], "profiles": ["` + mobileconfig + `"], "push_now": true}`
+	rr := httptest.NewRecorder()
+	PostProfileHandler(rr, httptest.NewRequest(http.MethodPost, "/profile", strings.NewReader(body)))
+
+	// Nothing was saved or queued, so the client must not be told otherwise
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestDeleteDeviceGroupHandler_KeepsProfilesForMembers(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	groupID := uuid.New()
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_groups" WHERE name = \$1`).
+		WithArgs("engineering").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(groupID, "engineering"))
+	mockSpy.ExpectQuery(`^SELECT count\(\*\) FROM "group_profiles" WHERE group_id = \$1 AND installed = \$2`).
+		WithArgs(groupID, true).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_group_members" WHERE group_id = \$1`).
+		WithArgs(groupID).
+		WillReturnRows(sqlmock.NewRows([]string{"group_id", "device_ud_id"}).AddRow(groupID, "1234-5678-123456"))
+	mockSpy.ExpectExec(`^DELETE FROM "device_group_members" WHERE group_id = \$1 AND device_ud_id = \$2`).
+		WithArgs(groupID, "1234-5678-123456").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_group_departures"`).
+		WillReturnRows(sqlmock.NewRows([]string{"group_id", "device_ud_id"}))
+	mockSpy.ExpectExec(`^INSERT INTO "device_group_departures"`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectExec(`^DELETE FROM "device_group_rules" WHERE group_id = \$1`).
+		WithArgs(groupID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSpy.ExpectExec(`^DELETE FROM "group_install_applications" WHERE group_id = \$1`).
+		WithArgs(groupID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSpy.ExpectExec(`^DELETE FROM "device_groups" WHERE "device_groups"."id" = \$1`).
+		WithArgs(groupID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/devicegroups/engineering", nil),
+		map[string]string{"name": "engineering"})
+	rr := httptest.NewRecorder()
+	DeleteDeviceGroupHandler(rr, req)
+
+	// The group's profiles stay behind so they are removed from the former members
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
@@ -0,0 +1,224 @@
+package director
+
+import (
+	"context"
+	intErrors "errors"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	deviceLockKeyPrefix     = "mdmdirector:device_lock:"
+	deviceSequenceKeyPrefix = "mdmdirector:device_sequence:"
+	// deviceLockTTL is how long a lock outlives a worker that stopped without releasing it. Held locks are refreshed.
+	deviceLockTTL = 30 * time.Second
+	// deviceSequenceTTL is how long the event numbers of a device are kept after its last event
+	deviceSequenceTTL = 7 * 24 * time.Hour
+)
+
+var ErrDeviceLocked = errors.New("timed out waiting for the device lock")
+
+var (
+	errDeviceEventNotNext = errors.New("an earlier event of the device has not been processed yet")
+	errDeviceEventLate    = errors.New("a later event of the device was processed first")
+)
+
+// deviceLocker serializes work on a device across workers and mdmdirector instances
+type deviceLocker interface {
+	// lock blocks until the device is held or ctx is done, in which case ErrDeviceLocked is returned. The returned
+	// func releases the device.
+	lock(ctx context.Context, udid string) (func(), error)
+}
+
+type redisDeviceLocker struct {
+	client *redislock.Client
+}
+
+func (locker redisDeviceLocker) lock(ctx context.Context, udid string) (func(), error) {
+	held, err := locker.client.Obtain(ctx, deviceLockKeyPrefix+udid, deviceLockTTL, &redislock.Options{
+		RetryStrategy: redislock.LinearBackoff(50 * time.Millisecond),
+	})
+	if intErrors.Is(err, redislock.ErrNotObtained) {
+		return nil, ErrDeviceLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(deviceLockTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := held.Refresh(context.Background(), deviceLockTTL, nil)
+				if err != nil {
+					ErrorLogger(LogHolder{DeviceUDID: udid, Message: errors.Wrap(err, "refreshing device lock").Error()})
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		err := held.Release(context.Background())
+		if err != nil && !intErrors.Is(err, redislock.ErrLockNotHeld) {
+			ErrorLogger(LogHolder{DeviceUDID: udid, Message: errors.Wrap(err, "releasing device lock").Error()})
+		}
+	}, nil
+}
+
+// deviceSequencer numbers the events of a device in the order they are received and records the last one processed
+type deviceSequencer interface {
+	next(ctx context.Context, udid string) (int64, error)
+	processed(ctx context.Context, udid string) (int64, error)
+	// advance records sequence as the last event processed, if the last one is still previous
+	advance(ctx context.Context, udid string, previous int64, sequence int64) error
+}
+
+var advanceDeviceSequence = redis.NewScript(`
+local processed = tonumber(redis.call("HGET", KEYS[1], "processed") or "0")
+if processed == tonumber(ARGV[1]) then
+	redis.call("HSET", KEYS[1], "processed", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+type redisDeviceSequencer struct {
+	client *redis.Client
+}
+
+func (sequencer redisDeviceSequencer) next(ctx context.Context, udid string) (int64, error) {
+	pipe := sequencer.client.TxPipeline()
+	next := pipe.HIncrBy(ctx, deviceSequenceKeyPrefix+udid, "next", 1)
+	pipe.Expire(ctx, deviceSequenceKeyPrefix+udid, deviceSequenceTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return next.Val(), nil
+}
+
+func (sequencer redisDeviceSequencer) processed(ctx context.Context, udid string) (int64, error) {
+	processed, err := sequencer.client.HGet(ctx, deviceSequenceKeyPrefix+udid, "processed").Int64()
+	if intErrors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+
+	return processed, err
+}
+
+func (sequencer redisDeviceSequencer) advance(ctx context.Context, udid string, previous int64, sequence int64) error {
+	return advanceDeviceSequence.Run(ctx, sequencer.client, []string{deviceSequenceKeyPrefix + udid}, previous, sequence).Err()
+}
+
+// deviceLocks and deviceSequences are nil until StartDeviceLocks is called, devices aren't locked and events aren't
+// ordered until then
+var (
+	deviceLocks     deviceLocker
+	deviceSequences deviceSequencer
+)
+
+// StartDeviceLocks locks each device in Redis while one of its webhook events is processed, and processes the events
+// of a device in the order they were received
+func StartDeviceLocks(client *redis.Client) {
+	deviceLocks = redisDeviceLocker{client: redislock.New(client)}
+	deviceSequences = redisDeviceSequencer{client: client}
+}
+
+// withDeviceLock runs fn once no other event for the device is being processed. If the device stays locked for
+// -device-lock-timeout, or Redis is unavailable, fn doesn't run and an error is returned so the event is retried.
+func withDeviceLock(udid string, fn func() error) error {
+	if deviceLocks == nil || udid == "" {
+		return fn()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(utils.DeviceLockTimeout())*time.Second)
+	unlock, err := deviceLocks.lock(ctx, udid)
+	cancel()
+	if intErrors.Is(err, ErrDeviceLocked) {
+		return errors.Wrap(err, "withDeviceLock")
+	}
+	if err != nil {
+		return errors.Wrap(err, "withDeviceLock")
+	}
+	defer unlock()
+
+	return fn()
+}
+
+// nextDeviceEvent numbers a newly received event of the device. Zero is returned when it can't be numbered.
+func nextDeviceEvent(udid string) int64 {
+	if deviceSequences == nil || udid == "" {
+		return 0
+	}
+
+	sequence, err := deviceSequences.next(context.Background(), udid)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: udid, Message: errors.Wrap(err, "nextDeviceEvent").Error()})
+		return 0
+	}
+
+	return sequence
+}
+
+// inDeviceOrder runs fn for the event numbered sequence once the event received before it has been processed, the
+// device has to be locked. With skipGap set it runs even though earlier events are missing, those are then late.
+// Unnumbered events run without ordering.
+func inDeviceOrder(udid string, sequence int64, skipGap bool, fn func() error) error {
+	if deviceSequences == nil || udid == "" {
+		return fn()
+	}
+	// Events that couldn't be numbered when they were received can never be ordered, they run as soon as they are
+	// dequeued rather than failing until they are dead-lettered
+	if sequence == 0 {
+		WarnLogger(LogHolder{DeviceUDID: udid, Message: "Event was not numbered when it was received, processing it without ordering"})
+		return fn()
+	}
+
+	processed, err := deviceSequences.processed(context.Background(), udid)
+	if err != nil {
+		return errors.Wrap(err, "inDeviceOrder")
+	}
+	if sequence <= processed {
+		return errors.Wrap(errDeviceEventLate, "inDeviceOrder")
+	}
+	if sequence > processed+1 && !skipGap {
+		return errors.Wrap(errDeviceEventNotNext, "inDeviceOrder")
+	}
+
+	err = fn()
+	if err != nil {
+		return err
+	}
+
+	err = deviceSequences.advance(context.Background(), udid, processed, sequence)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: udid, Message: errors.Wrap(err, "inDeviceOrder").Error()})
+	}
+
+	return nil
+}
+
+// skipDeviceEvent lets the events received after an event that was given up on be processed
+func skipDeviceEvent(udid string, sequence int64) {
+	if deviceSequences == nil || udid == "" || sequence == 0 {
+		return
+	}
+
+	err := deviceSequences.advance(context.Background(), udid, sequence-1, sequence)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: udid, Message: errors.Wrap(err, "skipDeviceEvent").Error()})
+	}
+}
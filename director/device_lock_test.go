@@ -0,0 +1,253 @@
+package director
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryDeviceLocker struct {
+	mu    sync.Mutex
+	held  map[string]chan struct{}
+	err   error
+	locks int
+}
+
+func (locker *memoryDeviceLocker) lock(ctx context.Context, udid string) (func(), error) {
+	if locker.err != nil {
+		return nil, locker.err
+	}
+
+	for {
+		locker.mu.Lock()
+		released, held := locker.held[udid]
+		if !held {
+			released = make(chan struct{})
+			locker.held[udid] = released
+			locker.locks++
+			locker.mu.Unlock()
+			return func() {
+				locker.mu.Lock()
+				delete(locker.held, udid)
+				locker.mu.Unlock()
+				close(released)
+			}, nil
+		}
+		locker.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ErrDeviceLocked
+		case <-released:
+		}
+	}
+}
+
+type memoryDeviceSequencer struct {
+	mu         sync.Mutex
+	sequences  map[string]int64
+	processeds map[string]int64
+}
+
+func newMemoryDeviceSequencer() *memoryDeviceSequencer {
+	return &memoryDeviceSequencer{sequences: make(map[string]int64), processeds: make(map[string]int64)}
+}
+
+func (sequencer *memoryDeviceSequencer) next(_ context.Context, udid string) (int64, error) {
+	sequencer.mu.Lock()
+	defer sequencer.mu.Unlock()
+	sequencer.sequences[udid]++
+	return sequencer.sequences[udid], nil
+}
+
+func (sequencer *memoryDeviceSequencer) processed(_ context.Context, udid string) (int64, error) {
+	sequencer.mu.Lock()
+	defer sequencer.mu.Unlock()
+	return sequencer.processeds[udid], nil
+}
+
+func (sequencer *memoryDeviceSequencer) advance(_ context.Context, udid string, previous int64, sequence int64) error {
+	sequencer.mu.Lock()
+	defer sequencer.mu.Unlock()
+	if sequencer.processeds[udid] == previous {
+		sequencer.processeds[udid] = sequence
+	}
+	return nil
+}
+
+func useDeviceSequencer(t *testing.T, sequencer deviceSequencer) {
+	previous := deviceSequences
+	deviceSequences = sequencer
+	t.Cleanup(func() {
+		deviceSequences = previous
+	})
+}
+
+func useDeviceLocker(t *testing.T, locker deviceLocker, timeout string) {
+	if flag.Lookup("device-lock-timeout") == nil {
+		flag.Int("device-lock-timeout", 120, "")
+	}
+	previousTimeout := flag.Lookup("device-lock-timeout").Value.String()
+	require.NoError(t, flag.Set("device-lock-timeout", timeout))
+	previous := deviceLocks
+	deviceLocks = locker
+	t.Cleanup(func() {
+		deviceLocks = previous
+		_ = flag.Set("device-lock-timeout", previousTimeout)
+	})
+}
+
+func TestWithDeviceLock_SerializesDevice(t *testing.T) {
+	locker := &memoryDeviceLocker{held: make(map[string]chan struct{})}
+	useDeviceLocker(t, locker, "120")
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	active := make(map[string]int)
+	maxActive := make(map[string]int)
+	bothDevices := make(chan struct{})
+	var once sync.Once
+	errs := make(chan error, 4)
+
+	for _, udid := range []string{"device-1", "device-1", "device-1", "device-2"} {
+		wg.Add(1)
+		go func(udid string) {
+			defer wg.Done()
+			err := withDeviceLock(udid, func() error {
+				mu.Lock()
+				active[udid]++
+				maxActive[udid] = max(maxActive[udid], active[udid])
+				if active["device-1"] > 0 && active["device-2"] > 0 {
+					once.Do(func() { close(bothDevices) })
+				}
+				mu.Unlock()
+
+				select {
+				case <-bothDevices:
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				mu.Lock()
+				active[udid]--
+				mu.Unlock()
+				return nil
+			})
+			errs <- err
+		}(udid)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 1, maxActive["device-1"])
+	require.Equal(t, 1, maxActive["device-2"])
+	require.Equal(t, 4, locker.locks)
+	select {
+	case <-bothDevices:
+	default:
+		t.Fatal("different devices were not processed at the same time")
+	}
+}
+
+func TestWithDeviceLock_Timeout(t *testing.T) {
+	locker := &memoryDeviceLocker{held: make(map[string]chan struct{})}
+	useDeviceLocker(t, locker, "0")
+
+	unlock, err := locker.lock(context.Background(), "device-1")
+	require.NoError(t, err)
+	defer unlock()
+
+	ran := false
+	err = withDeviceLock("device-1", func() error {
+		ran = true
+		return nil
+	})
+	require.ErrorIs(t, err, ErrDeviceLocked)
+	require.False(t, ran)
+}
+
+func TestWithDeviceLock_LockerUnavailable(t *testing.T) {
+	useDeviceLocker(t, &memoryDeviceLocker{err: errors.New("connection refused")}, "120")
+
+	ran := false
+	err := withDeviceLock("device-1", func() error {
+		ran = true
+		return nil
+	})
+	require.EqualError(t, err, "withDeviceLock: connection refused")
+	require.False(t, ran)
+}
+
+func TestInDeviceOrder(t *testing.T) {
+	sequencer := newMemoryDeviceSequencer()
+	useDeviceSequencer(t, sequencer)
+
+	first := nextDeviceEvent("device-1")
+	second := nextDeviceEvent("device-1")
+	third := nextDeviceEvent("device-1")
+	require.Equal(t, []int64{1, 2, 3}, []int64{first, second, third})
+
+	var ran []int64
+	process := func(sequence int64) func() error {
+		return func() error {
+			ran = append(ran, sequence)
+			return nil
+		}
+	}
+
+	err := inDeviceOrder("device-1", second, false, process(second))
+	require.ErrorIs(t, err, errDeviceEventNotNext)
+
+	err = inDeviceOrder("device-1", first, false, func() error {
+		return errors.New("processing failed")
+	})
+	require.EqualError(t, err, "processing failed")
+
+	require.NoError(t, inDeviceOrder("device-1", first, false, process(first)))
+	require.NoError(t, inDeviceOrder("device-1", second, false, process(second)))
+	require.Equal(t, []int64{1, 2}, ran)
+
+	err = inDeviceOrder("device-1", first, false, process(first))
+	require.ErrorIs(t, err, errDeviceEventLate)
+
+	// Events that couldn't be numbered run without holding up the others
+	require.NoError(t, inDeviceOrder("device-1", 0, false, process(0)))
+	require.Equal(t, []int64{1, 2, 0}, ran)
+
+	require.Equal(t, int64(2), sequencer.processeds["device-1"])
+	require.Equal(t, third, sequencer.sequences["device-1"])
+}
+
+func TestInDeviceOrder_SkipsGap(t *testing.T) {
+	sequencer := newMemoryDeviceSequencer()
+	useDeviceSequencer(t, sequencer)
+
+	ran := false
+	err := inDeviceOrder("device-1", 3, true, func() error {
+		ran = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Equal(t, int64(3), sequencer.processeds["device-1"])
+}
+
+func TestSkipDeviceEvent(t *testing.T) {
+	sequencer := newMemoryDeviceSequencer()
+	useDeviceSequencer(t, sequencer)
+
+	skipDeviceEvent("device-1", 1)
+	require.Equal(t, int64(1), sequencer.processeds["device-1"])
+
+	// An event given up on while earlier ones are still waiting doesn't let them be skipped
+	skipDeviceEvent("device-1", 3)
+	require.Equal(t, int64(1), sequencer.processeds["device-1"])
+}
@@ -87,7 +87,7 @@ func reinstallEnrollmentProfile(device types.Device) error {
 func ensureCertOnEnrollmentProfile(
 	device types.Device,
 	profileLists []types.ProfileList,
-	signingCert *x509.Certificate,
+	signingCerts []*x509.Certificate,
 ) error {
 	// Return early if we don't want to sign
 	if !utils.Sign() {
@@ -108,7 +108,7 @@ func ensureCertOnEnrollmentProfile(
 				_, needsReinstall, err := validateProfileInProfileList(
 					profileForVerification,
 					profileLists,
-					signingCert,
+					signingCerts...,
 				)
 				if err != nil {
 					return errors.Wrap(err, "validateProfileInProfileList")
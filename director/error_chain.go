@@ -0,0 +1,49 @@
+package director
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/types"
+)
+
+const unknownErrorDomain = "unknown"
+
+// parseErrorChain decodes the ErrorChain of a command response. Responses without one return nil.
+func parseErrorChain(rawPayload []byte) types.ErrorChain {
+	var response struct {
+		ErrorChain types.ErrorChain `plist:"ErrorChain"`
+	}
+
+	err := plist.Unmarshal(rawPayload, &response)
+	if err != nil || len(response.ErrorChain) == 0 {
+		return nil
+	}
+
+	return response.ErrorChain
+}
+
+// errorChainTop is the domain and code of the first error in the chain, the error the command failed with. Responses
+// without an ErrorChain are reported as the unknown domain.
+func errorChainTop(errorChain types.ErrorChain) (string, int) {
+	if len(errorChain) == 0 || errorChain[0].ErrorDomain == "" {
+		return unknownErrorDomain, 0
+	}
+
+	return errorChain[0].ErrorDomain, errorChain[0].ErrorCode
+}
+
+// errorChainDescription joins the errors of the chain into a single line for the logs
+func errorChainDescription(errorChain types.ErrorChain) string {
+	descriptions := make([]string, 0, len(errorChain))
+	for _, chained := range errorChain {
+		description := chained.USEnglishDescription
+		if description == "" {
+			description = chained.LocalizedDescription
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%v %v: %v", chained.ErrorDomain, chained.ErrorCode, description))
+	}
+
+	return strings.Join(descriptions, " <- ")
+}
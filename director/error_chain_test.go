@@ -0,0 +1,101 @@
+package director
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestParseErrorChain(t *testing.T) {
+	rawPayload := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>ErrorChain</key>
+	<array>
+		<dict>
+			<key>ErrorCode</key>
+			<integer>4001</integer>
+			<key>ErrorDomain</key>
+			<string>MCProfileErrorDomain</string>
+			<key>LocalizedDescription</key>
+			<string>The profile is invalid.</string>
+			<key>USEnglishDescription</key>
+			<string>The profile is invalid.</string>
+		</dict>
+	</array>
+	<key>Status</key>
+	<string>Error</string>
+</dict>
+</plist>`)
+
+	require.Equal(t, types.ErrorChain{{
+		ErrorCode:            4001,
+		ErrorDomain:          "MCProfileErrorDomain",
+		LocalizedDescription: "The profile is invalid.",
+		USEnglishDescription: "The profile is invalid.",
+	}}, parseErrorChain(rawPayload))
+
+	require.Nil(t, parseErrorChain([]byte(`<plist version="1.0"><dict><key>Status</key><string>Acknowledged</string></dict></plist>`)))
+}
+
+func TestErrorChainTop(t *testing.T) {
+	tests := []struct {
+		name   string
+		chain  types.ErrorChain
+		domain string
+		code   int
+	}{
+		{"no chain", nil, unknownErrorDomain, 0},
+		{"no domain", types.ErrorChain{{ErrorCode: 12}}, unknownErrorDomain, 0},
+		{"first error", types.ErrorChain{{ErrorCode: 1009, ErrorDomain: "MCInstallationErrorDomain"}, {ErrorCode: 4001, ErrorDomain: "MCProfileErrorDomain"}}, "MCInstallationErrorDomain", 1009},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, code := errorChainTop(tt.chain)
+			require.Equal(t, tt.domain, domain)
+			require.Equal(t, tt.code, code)
+		})
+	}
+}
+
+func TestErrorChainDescription(t *testing.T) {
+	description := errorChainDescription(types.ErrorChain{
+		{ErrorCode: 1009, ErrorDomain: "MCInstallationErrorDomain", LocalizedDescription: "Profile Installation Failed"},
+		{ErrorCode: 4001, ErrorDomain: "MCProfileErrorDomain", USEnglishDescription: "The profile is invalid."},
+	})
+
+	require.Equal(t, "MCInstallationErrorDomain 1009: Profile Installation Failed <- MCProfileErrorDomain 4001: The profile is invalid.", description)
+}
+
+func TestGetErrorCommands_Grouped(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT error_domain, error_code, count\(\*\) as count FROM "commands" WHERE status = \$1 AND error_domain = \$2 GROUP BY error_domain, error_code ORDER BY count desc`).
+		WithArgs("Error", "MCProfileErrorDomain").
+		WillReturnRows(sqlmock.NewRows([]string{"error_domain", "error_code", "count"}).
+			AddRow("MCProfileErrorDomain", 4001, 3))
+
+	rr := httptest.NewRecorder()
+	GetErrorCommands(rr, httptest.NewRequest(http.MethodGet, "/command/error?group=true&domain=MCProfileErrorDomain", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `[{"error_domain": "MCProfileErrorDomain", "error_code": 4001, "count": 3}]`, rr.Body.String())
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+
+	rr = httptest.NewRecorder()
+	GetErrorCommands(rr, httptest.NewRequest(http.MethodGet, "/command/error?code=abc", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,220 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	paramString  = "string"
+	paramBool    = "bool"
+	paramInteger = "integer"
+	paramArray   = "array"
+	paramObject  = "object"
+)
+
+// genericCommands are the request types that can be sent with POST /commands, with the parameters MicroMDM accepts
+// for each. DeviceLock and EraseDevice are left out, they go through /device/command so the PIN is escrowed.
+var genericCommands = map[string]map[string]types.CommandParam{
+	"AvailableOSUpdates":        {},
+	"CertificateList":           {},
+	"ClearPasscode":             {"unlock_token": {Type: paramString, Required: true}},
+	"ClearRestrictionsPassword": {},
+	"DeviceInformation":         {"queries": {Type: paramArray, Required: true}},
+	"DeviceLocation":            {},
+	"DisableLostMode":           {},
+	"DisableRemoteDesktop":      {},
+	"EnableLostMode": {
+		"message":      {Type: paramString},
+		"phone_number": {Type: paramString},
+		"footnote":     {Type: paramString},
+	},
+	"EnableRemoteDesktop": {},
+	"InstalledApplicationList": {
+		"identifiers":       {Type: paramArray},
+		"managed_apps_only": {Type: paramBool},
+	},
+	"OSUpdateStatus":          {},
+	"PlayLostModeSound":       {},
+	"ProfileList":             {},
+	"ProvisioningProfileList": {},
+	"RemoveApplication":       {"identifier": {Type: paramString, Required: true}},
+	"RestartDevice":           {"notify_user": {Type: paramBool}},
+	"ScheduleOSUpdate":        {"updates": {Type: paramArray, Required: true}},
+	"ScheduleOSUpdateScan":    {"force": {Type: paramBool}},
+	"SecurityInfo":            {},
+	"SetFirmwarePassword": {
+		"current_password": {Type: paramString},
+		"new_password":     {Type: paramString, Required: true},
+		"allow_oroms":      {Type: paramBool},
+	},
+	"SetRecoveryLock": {
+		"current_password": {Type: paramString},
+		"new_password":     {Type: paramString, Required: true},
+	},
+	"Settings":               {"settings": {Type: paramArray, Required: true}},
+	"ShutDownDevice":         {},
+	"VerifyFirmwarePassword": {"password": {Type: paramString, Required: true}},
+}
+
+func paramHasType(value interface{}, paramType string) bool {
+	switch paramType {
+	case paramString:
+		_, ok := value.(string)
+		return ok
+	case paramBool:
+		_, ok := value.(bool)
+		return ok
+	case paramInteger:
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case paramArray:
+		_, ok := value.([]interface{})
+		return ok
+	case paramObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+
+	return false
+}
+
+// validateGenericCommand checks the request type is supported and the params match its parameters
+func validateGenericCommand(requestType string, params map[string]interface{}) error {
+	spec, ok := genericCommands[requestType]
+	if !ok {
+		return fmt.Errorf("unsupported request_type %q", requestType)
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		param, ok := spec[name]
+		if !ok {
+			return fmt.Errorf("%v does not take parameter %q", requestType, name)
+		}
+		if !paramHasType(params[name], param.Type) {
+			return fmt.Errorf("parameter %q of %v must be of type %v", name, requestType, param.Type)
+		}
+	}
+
+	for name, param := range spec {
+		if _, ok := params[name]; param.Required && !ok {
+			return fmt.Errorf("%v requires parameter %q", requestType, name)
+		}
+	}
+
+	// Lost mode needs something to show on the lock screen
+	if requestType == "EnableLostMode" && params["message"] == nil && params["phone_number"] == nil {
+		return errors.New("EnableLostMode requires message or phone_number")
+	}
+
+	return nil
+}
+
+// SendGenericCommand sends a validated command to each device. A device that can't be found or sent the command
+// is reported in its result, the other devices still receive the command.
+func SendGenericCommand(payload types.GenericCommandPayload) []types.GenericCommandResult {
+	var results []types.GenericCommandResult
+
+	devices := make([]types.Device, 0, len(payload.DeviceUDIDs)+len(payload.SerialNumbers))
+	for _, udid := range payload.DeviceUDIDs {
+		device, err := GetDevice(udid)
+		if err != nil {
+			results = append(results, types.GenericCommandResult{DeviceUDID: udid, Error: err.Error()})
+			continue
+		}
+		devices = append(devices, device)
+	}
+	for _, serial := range payload.SerialNumbers {
+		device, err := GetDeviceSerial(serial)
+		if err != nil {
+			results = append(results, types.GenericCommandResult{SerialNumber: serial, Error: err.Error()})
+			continue
+		}
+		devices = append(devices, device)
+	}
+
+	for _, device := range devices {
+		result := types.GenericCommandResult{DeviceUDID: device.UDID, SerialNumber: device.SerialNumber}
+
+		command, err := SendCommand(types.CommandPayload{
+			UDID:        device.UDID,
+			RequestType: payload.RequestType,
+			Params:      payload.Params,
+		})
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandRequestType: payload.RequestType, Message: err.Error()})
+			result.Error = err.Error()
+		} else {
+			result.CommandUUID = command.CommandUUID
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// PostCommandHandler sends any supported MDM command to the devices in the request
+func PostCommandHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.GenericCommandPayload
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	err = validateGenericCommand(out.RequestType, out.Params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(out.DeviceUDIDs) == 0 && len(out.SerialNumbers) == 0 {
+		http.Error(w, "udids or serial_numbers are required", http.StatusBadRequest)
+		return
+	}
+
+	InfoLogger(LogHolder{Message: "Sending command to devices", CommandRequestType: out.RequestType, Metric: fmt.Sprintf("%v devices", len(out.DeviceUDIDs)+len(out.SerialNumbers))})
+	results := SendGenericCommand(out)
+
+	output, err := json.MarshalIndent(&results, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// GetCommandTypesHandler lists the request types POST /commands accepts and their parameters
+func GetCommandTypesHandler(w http.ResponseWriter, r *http.Request) {
+	output, err := json.MarshalIndent(&genericCommands, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
@@ -0,0 +1,61 @@
+package director
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateGenericCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestType string
+		params      string
+		valid       bool
+	}{
+		{"no params", "RestartDevice", `{}`, true},
+		{"optional param", "RestartDevice", `{"notify_user": true}`, true},
+		{"unsupported request type", "EraseDevice", `{}`, false},
+		{"unknown param", "ShutDownDevice", `{"force": true}`, false},
+		{"wrong type", "RestartDevice", `{"notify_user": "yes"}`, false},
+		{"missing required param", "Settings", `{}`, false},
+		{"required param", "Settings", `{"settings": [{"item": "DeviceName", "device_name": "kiosk"}]}`, true},
+		{"lost mode without message", "EnableLostMode", `{"footnote": "reward"}`, false},
+		{"lost mode", "EnableLostMode", `{"phone_number": "555-0100"}`, true},
+		{"os update", "ScheduleOSUpdate", `{"updates": [{"product_key": "MSU_UPDATE_22A380_patch_13.0", "install_action": "InstallASAP"}]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tt.params), &params))
+
+			err := validateGenericCommand(tt.requestType, params)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCommandRequestBody(t *testing.T) {
+	body, err := commandRequestBody(types.CommandPayload{
+		UDID:        "1234-5678-123456",
+		RequestType: "RestartDevice",
+		Params: map[string]interface{}{
+			"notify_user":  true,
+			"request_type": "ShutDownDevice",
+		},
+	})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"udid": "1234-5678-123456", "request_type": "RestartDevice", "notify_user": true}`, string(body))
+
+	// without params the payload is sent as it always was
+	body, err = commandRequestBody(types.CommandPayload{UDID: "1234-5678-123456", RequestType: "ProfileList"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"udid": "1234-5678-123456", "request_type": "ProfileList"}`, string(body))
+}
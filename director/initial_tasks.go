@@ -37,18 +37,20 @@ func RunInitialTasks(udid string) error {
 	// 	return nil
 	// }
 
-	_, err = InstallAllProfiles(device)
+	profileCommands, err := InstallAllProfiles(device)
 	if err != nil {
 		return errors.Wrap(err, "RunInitialTasks:InstallAllProfiles")
 	}
 
-	_, err = InstallBootstrapPackages(device)
+	bootstrapCommands, err := InstallBootstrapPackages(device)
 	if err != nil {
 		return errors.Wrap(err, "RunInitialTasks:InstallBootstrapPackages")
 	}
-	err = processDeviceConfigured(device)
+
+	// DeviceConfigured releases the device from Setup Assistant, so it waits for the profiles and packages
+	err = holdCommandUntil(workflowInitialTasks, device, types.CommandPayload{UDID: device.UDID, RequestType: "DeviceConfigured"}, append(profileCommands, bootstrapCommands...))
 	if err != nil {
-		return errors.Wrap(err, "RunInitialTasks:processDeviceConfigured")
+		return errors.Wrap(err, "RunInitialTasks:holdCommandUntil")
 	}
 
 	return nil
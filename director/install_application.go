@@ -20,6 +20,33 @@ func PostInstallApplicationHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 
+	for _, groupName := range out.Groups {
+		group, err := GetDeviceGroup(groupName)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		err = SaveGroupInstallApplications(group, out)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+		}
+		members, err := GetDeviceGroupMembers(group)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+		}
+		for _, ManifestURL := range out.ManifestURLs {
+			var installApplication types.DeviceInstallApplication
+			installApplication.ManifestURL = ManifestURL.URL
+			if !ManifestURL.BootstrapOnly {
+				_, err = PushInstallApplication(members, installApplication)
+				if err != nil {
+					ErrorLogger(LogHolder{Message: err.Error()})
+				}
+			}
+		}
+	}
+
 	if out.DeviceUDIDs != nil {
 		// Not empty list
 		if len(out.DeviceUDIDs) > 0 {
@@ -257,6 +284,21 @@ func InstallBootstrapPackages(device types.Device) ([]types.Command, error) {
 		sentCommands = append(sentCommands, commands...)
 	}
 
+	groupInstallApplications, err := groupInstallApplicationsForDevice(device.UDID)
+	if err != nil {
+		return sentCommands, errors.Wrap(err, "InstallBootstrapPackages:dbcall3")
+	}
+
+	// Push all the apps
+	for _, savedApp := range groupInstallApplications {
+		log.Debugf("InstallApplication: %v", savedApp)
+		commands, err := PushInstallApplication(devices, types.DeviceInstallApplication{ManifestURL: savedApp.ManifestURL})
+		if err != nil {
+			return sentCommands, errors.Wrap(err, "InstallBootstrapPackages:PushInstallApplication")
+		}
+		sentCommands = append(sentCommands, commands...)
+	}
+
 	return sentCommands, nil
 }
 
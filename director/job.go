@@ -0,0 +1,489 @@
+package director
+
+import (
+	"context"
+	"encoding/json"
+	intErrors "errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobComplete = "complete"
+	jobFailed   = "failed"
+
+	jobItemPending  = "pending"
+	jobItemSending  = "sending"
+	jobItemComplete = "complete"
+	jobItemFailed   = "failed"
+
+	jobTypeSharedProfilePush = "shared_profile_push"
+	jobTypeDeviceCommand     = "device_command"
+
+	jobItemBatchSize = 500
+
+	// jobLease is how long a running job is left to the instance running it before it is queued again
+	jobLease = 5 * time.Minute
+)
+
+var ErrJobQueueNotStarted = errors.New("job queue has not been started")
+
+var errJobItemInterrupted = errors.New("interrupted while being applied, not applied again")
+
+var jobQueue taskq.Queue
+
+var jobTask = taskq.RegisterTask(&taskq.TaskOptions{
+	Name: "job",
+	Handler: func(id string) error {
+		err := runJob(id)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error(), Metric: id})
+		}
+		return nil
+	},
+})
+
+// StartJobQueue consumes jobs from the queue. The queue is shared by every mdmdirector instance, so it is never
+// purged. Queued jobs are queued again at start up, and every minute the running jobs whose lease has expired, because
+// the instance running them stopped, are queued again to carry on from the devices that are still pending.
+func StartJobQueue(queue taskq.Queue) {
+	jobQueue = queue
+	err := queue.Consumer().Start(context.Background())
+	if err != nil {
+		ErrorLogger(LogHolder{Message: fmt.Errorf("starting job consumer: %v", err.Error()).Error()})
+		return
+	}
+
+	reclaimJobs(true)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		reclaimJobs(false)
+	}
+}
+
+// reclaimJobs queues the running jobs whose lease has expired, and the queued jobs when queued is set
+func reclaimJobs(queued bool) {
+	var jobs []types.Job
+
+	tx := db.DB.Where("status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?)", jobRunning, time.Now())
+	if queued {
+		tx = tx.Or("status = ?", jobQueued)
+	}
+	err := tx.Find(&jobs).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "reclaimJobs").Error()})
+		return
+	}
+
+	for _, job := range jobs {
+		err = enqueueJob(job)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error(), Metric: job.ID.String()})
+		}
+	}
+}
+
+func enqueueJob(job types.Job) error {
+	if jobQueue == nil {
+		return ErrJobQueueNotStarted
+	}
+
+	err := jobQueue.Add(jobTask.WithArgs(context.Background(), job.ID.String()))
+	if err != nil {
+		return errors.Wrap(err, "enqueueJob")
+	}
+
+	return nil
+}
+
+// jobItemsForTargets makes an item for each requested UDID and serial number, leaving out repeats
+func jobItemsForTargets(udids []string, serials []string) []types.JobItem {
+	items := make([]types.JobItem, 0, len(udids)+len(serials))
+	seen := make(map[string]bool)
+	for _, udid := range udids {
+		if udid == "" || seen[udid] {
+			continue
+		}
+		seen[udid] = true
+		items = append(items, types.JobItem{Target: udid, DeviceUDID: udid, Status: jobItemPending})
+	}
+	for _, serial := range serials {
+		if serial == "" || seen[serial] {
+			continue
+		}
+		seen[serial] = true
+		items = append(items, types.JobItem{Target: serial, SerialNumber: serial, Status: jobItemPending})
+	}
+
+	return items
+}
+
+// createJob saves a job with its items and queues it
+func createJob(jobType string, params interface{}, items []types.JobItem) (types.Job, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return types.Job{}, errors.Wrap(err, "createJob: marshal params")
+	}
+
+	job := types.Job{Type: jobType, Status: jobQueued, Params: string(encoded)}
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&job).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range items {
+			items[i].JobID = job.ID
+			items[i].Status = jobItemPending
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		return tx.CreateInBatches(&items, jobItemBatchSize).Error
+	})
+	if err != nil {
+		return job, errors.Wrap(err, "createJob")
+	}
+
+	err = enqueueJob(job)
+	if err != nil {
+		finishJob(&job, err)
+		return job, errors.Wrap(err, "createJob")
+	}
+
+	InfoLogger(LogHolder{Message: "Queued job", Metric: fmt.Sprintf("%v %v for %v devices", jobType, job.ID, len(items))})
+
+	return job, nil
+}
+
+// runJob works through the pending items of a job. The job is claimed first, so a job queued more than once only
+// runs on one instance at a time.
+func runJob(id string) error {
+	var job types.Job
+
+	err := db.DB.Where("id = ?", id).First(&job).Error
+	if err != nil {
+		return errors.Wrap(err, "runJob")
+	}
+	if job.Status == jobComplete || job.Status == jobFailed {
+		return nil
+	}
+
+	claimed, err := claimJob(job)
+	if err != nil {
+		return errors.Wrap(err, "runJob")
+	}
+	if !claimed {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go renewJobLease(ctx, job)
+
+	process, err := jobProcessor(job)
+	if err != nil {
+		finishJob(&job, err)
+		return errors.Wrap(err, "runJob")
+	}
+
+	// Items left sending were interrupted part way through and may have reached the device already
+	err = db.DB.Model(&types.JobItem{}).
+		Where("job_id = ? AND status = ?", job.ID, jobItemSending).
+		Updates(map[string]interface{}{"status": jobItemFailed, "error": errJobItemInterrupted.Error()}).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "runJob: fail interrupted items")
+	}
+
+	for {
+		var items []types.JobItem
+		err = db.DB.Where("job_id = ? AND status = ?", job.ID, jobItemPending).
+			Order("target").
+			Limit(jobItemBatchSize).
+			Find(&items).
+			Error
+		if err != nil {
+			return errors.Wrap(err, "runJob: load items")
+		}
+		if len(items) == 0 {
+			break
+		}
+
+		for _, item := range items {
+			claimed, err := claimJobItem(item)
+			if err != nil {
+				return errors.Wrap(err, "runJob")
+			}
+			if !claimed {
+				continue
+			}
+
+			device, err := jobItemDevice(item)
+			if err == nil {
+				err = process(device)
+			}
+			err = updateJobItem(item, device, err)
+			if err != nil {
+				return errors.Wrap(err, "runJob")
+			}
+		}
+	}
+
+	finishJob(&job, nil)
+	InfoLogger(LogHolder{Message: "Job complete", Metric: fmt.Sprintf("%v %v", job.Type, job.ID)})
+
+	return nil
+}
+
+// claimJob marks the job running with a new lease, unless another instance holds a lease on it that hasn't expired
+func claimJob(job types.Job) (bool, error) {
+	now := time.Now()
+	result := db.DB.Model(&types.Job{}).
+		Where("id = ?", job.ID).
+		Where("status = ? OR (status = ? AND (lease_expires_at IS NULL OR lease_expires_at < ?))", jobQueued, jobRunning, now).
+		Updates(map[string]interface{}{
+			"status":           jobRunning,
+			"lease_expires_at": now.Add(jobLease),
+		})
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "claimJob")
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// renewJobLease extends the lease of a running job until ctx is done
+func renewJobLease(ctx context.Context, job types.Job) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := db.DB.Model(&types.Job{}).
+				Where("id = ? AND status = ?", job.ID, jobRunning).
+				Update("lease_expires_at", time.Now().Add(jobLease)).
+				Error
+			if err != nil {
+				ErrorLogger(LogHolder{Message: errors.Wrap(err, "renewJobLease").Error(), Metric: job.ID.String()})
+			}
+		}
+	}
+}
+
+// claimJobItem moves a pending item to sending, so it is applied to the device at most once
+func claimJobItem(item types.JobItem) (bool, error) {
+	result := db.DB.Model(&types.JobItem{}).
+		Where("job_id = ? AND target = ? AND status = ?", item.JobID, item.Target, jobItemPending).
+		Update("status", jobItemSending)
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "claimJobItem")
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// jobProcessor returns the function that applies the job to each device
+func jobProcessor(job types.Job) (func(types.Device) error, error) {
+	switch job.Type {
+	case jobTypeSharedProfilePush:
+		var params types.SharedProfilePushJobParams
+		var sharedProfiles []types.SharedProfile
+		err := json.Unmarshal([]byte(job.Params), &params)
+		if err != nil {
+			return nil, errors.Wrap(err, "jobProcessor: unmarshal params")
+		}
+
+		err = db.DB.Where("payload_identifier IN ? AND installed = ?", params.PayloadIdentifiers, true).
+			Find(&sharedProfiles).
+			Error
+		if err != nil {
+			return nil, errors.Wrap(err, "jobProcessor: load shared profiles")
+		}
+
+		return func(device types.Device) error {
+			_, err := PushSharedProfiles([]types.Device{device}, sharedProfiles)
+			return err
+		}, nil
+
+	case jobTypeDeviceCommand:
+		var params types.DeviceCommandJobParams
+		err := json.Unmarshal([]byte(job.Params), &params)
+		if err != nil {
+			return nil, errors.Wrap(err, "jobProcessor: unmarshal params")
+		}
+
+		return func(device types.Device) error {
+			return applyDeviceCommand(device, params)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown job type %v", job.Type)
+}
+
+func jobItemDevice(item types.JobItem) (types.Device, error) {
+	if item.DeviceUDID != "" {
+		return GetDevice(item.DeviceUDID)
+	}
+
+	return GetDeviceSerial(item.SerialNumber)
+}
+
+func updateJobItem(item types.JobItem, device types.Device, itemErr error) error {
+	updates := map[string]interface{}{
+		"status":        jobItemComplete,
+		"error":         "",
+		"device_ud_id":  device.UDID,
+		"serial_number": device.SerialNumber,
+	}
+	if itemErr != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: itemErr.Error(), Metric: item.Target})
+		updates["status"] = jobItemFailed
+		updates["error"] = itemErr.Error()
+		if device.UDID == "" {
+			delete(updates, "device_ud_id")
+			delete(updates, "serial_number")
+		}
+	}
+
+	err := db.DB.Model(&types.JobItem{}).
+		Where("job_id = ? AND target = ?", item.JobID, item.Target).
+		Updates(updates).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "updateJobItem")
+	}
+
+	return nil
+}
+
+// finishJob marks the job complete, or failed with the error, and clears its params
+func finishJob(job *types.Job, jobErr error) {
+	now := time.Now()
+	job.Status = jobComplete
+	job.Error = ""
+	if jobErr != nil {
+		job.Status = jobFailed
+		job.Error = jobErr.Error()
+	}
+	job.Params = ""
+	job.LeaseExpiresAt = nil
+	job.CompletedAt = &now
+
+	err := db.DB.Model(&types.Job{}).
+		Where("id = ?", job.ID).
+		Updates(map[string]interface{}{
+			"status":           job.Status,
+			"error":            job.Error,
+			"params":           "",
+			"lease_expires_at": nil,
+			"completed_at":     now,
+		}).
+		Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error(), Metric: job.ID.String()})
+	}
+}
+
+func jobStatus(job types.Job, details bool, status string) (types.JobStatus, error) {
+	var counts []struct {
+		Status string
+		Count  int
+	}
+
+	jobStatus := types.JobStatus{Job: job, Devices: make(map[string]int)}
+
+	err := db.DB.Model(&types.JobItem{}).
+		Select("status, count(*) as count").
+		Where("job_id = ?", job.ID).
+		Group("status").
+		Scan(&counts).
+		Error
+	if err != nil {
+		return jobStatus, errors.Wrap(err, "jobStatus: count items")
+	}
+	for _, count := range counts {
+		jobStatus.Devices[count.Status] = count.Count
+	}
+
+	if details {
+		tx := db.DB.Where("job_id = ?", job.ID)
+		if status != "" {
+			tx = tx.Where("status = ?", status)
+		}
+		err = tx.Order("target").Find(&jobStatus.Items).Error
+		if err != nil {
+			return jobStatus, errors.Wrap(err, "jobStatus: load items")
+		}
+	}
+
+	return jobStatus, nil
+}
+
+func writeJob(w http.ResponseWriter, v interface{}, status int) {
+	output, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// writeQueuedJob responds with the job a bulk operation was queued as
+func writeQueuedJob(w http.ResponseWriter, job types.Job) {
+	queued, err := jobStatus(job, false, "")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJob(w, &queued, http.StatusAccepted)
+}
+
+// GetJobHandler returns a job with the progress of each device. The status query parameter limits the devices to
+// those in that state.
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	var job types.Job
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("id = ?", vars["id"]).First(&job).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	jobDetails, err := jobStatus(job, true, r.URL.Query().Get("status"))
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJob(w, &jobDetails, http.StatusOK)
+}
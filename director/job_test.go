@@ -0,0 +1,142 @@
+package director
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestJobItemsForTargets(t *testing.T) {
+	items := jobItemsForTargets([]string{"1234-5678-123456", "", "1234-5678-123456"}, []string{"C02ABC123", "C02ABC123"})
+
+	require.Equal(t, []types.JobItem{
+		{Target: "1234-5678-123456", DeviceUDID: "1234-5678-123456", Status: jobItemPending},
+		{Target: "C02ABC123", SerialNumber: "C02ABC123", Status: jobItemPending},
+	}, items)
+}
+
+func TestRunJob_SkipsFinishedJob(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "jobs" WHERE id = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "status"}).
+			AddRow("5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f", jobTypeDeviceCommand, jobComplete))
+
+	require.NoError(t, runJob("5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestRunJob_SkipsJobClaimedElsewhere(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "jobs" WHERE id = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "type", "status"}).
+			AddRow("5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f", jobTypeDeviceCommand, jobRunning))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "jobs" SET .* WHERE id = \$4 AND \(status = \$5 OR \(status = \$6 AND \(lease_expires_at IS NULL OR lease_expires_at < \$7\)\)\)`).
+		WithArgs(sqlmock.AnyArg(), jobRunning, sqlmock.AnyArg(), sqlmock.AnyArg(), jobQueued, jobRunning, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSpy.ExpectCommit()
+
+	require.NoError(t, runJob("5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestClaimJobItem(t *testing.T) {
+	tests := []struct {
+		name         string
+		rowsAffected int64
+		claimed      bool
+	}{
+		{name: "pending", rowsAffected: 1, claimed: true},
+		{name: "already claimed", rowsAffected: 0, claimed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectBegin()
+			mockSpy.ExpectExec(`^UPDATE "job_items" SET "status"=\$1,"updated_at"=\$2 WHERE job_id = \$3 AND target = \$4 AND status = \$5`).
+				WithArgs(jobItemSending, sqlmock.AnyArg(), sqlmock.AnyArg(), "1234-5678-123456", jobItemPending).
+				WillReturnResult(sqlmock.NewResult(0, tt.rowsAffected))
+			mockSpy.ExpectCommit()
+
+			claimed, err := claimJobItem(types.JobItem{Target: "1234-5678-123456"})
+			require.NoError(t, err)
+			require.Equal(t, tt.claimed, claimed)
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSetDeviceCommandState(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "devices" SET "erase"=\$1,"unlock_pin"=\$2,"updated_at"=\$3 WHERE ud_id IN \(\$4\) OR serial_number IN \(\$5\)`).
+		WithArgs(true, "123456", sqlmock.AnyArg(), "1234-5678-123456", "C02ABC123").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mockSpy.ExpectCommit()
+
+	require.NoError(t, setDeviceCommandState("erase_device", types.DeviceCommandPayload{
+		DeviceUDIDs:   []string{"1234-5678-123456"},
+		SerialNumbers: []string{"C02ABC123"},
+		Value:         true,
+		Pin:           "123456",
+	}))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestGetJobHandler_NotFound(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "jobs" WHERE id = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/jobs/5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f", nil),
+		map[string]string{"id": "5f5e3d1b-4a4c-4d5e-9d2f-3b6a2d1c0e9f"})
+	rr := httptest.NewRecorder()
+	GetJobHandler(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestPostDeviceCommandHandler_UnknownCommand(t *testing.T) {
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/device/command/restart", strings.NewReader(`{"udids": ["1234-5678-123456"]}`)),
+		map[string]string{"command": "restart"})
+	rr := httptest.NewRecorder()
+	PostDeviceCommandHandler(rr, req)
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -12,6 +12,8 @@ type LogHolder struct {
 	CommandStatus      string
 	ProfileUUID        string
 	ProfileIdentifier  string
+	ErrorDomain        string
+	ErrorCode          int
 	Message            string
 	Metric             string
 }
@@ -75,6 +77,14 @@ func processFields(logholder LogHolder) *log.Entry {
 			})
 	}
 
+	if logholder.ErrorDomain != "" {
+		logger = logger.WithFields(
+			log.Fields{
+				"error_domain": logholder.ErrorDomain,
+				"error_code":   logholder.ErrorCode,
+			})
+	}
+
 	if logholder.Metric != "" {
 		logger = logger.WithFields(
 			log.Fields{
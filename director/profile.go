@@ -1,22 +1,15 @@
 package director
 
 import (
-	"crypto"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	intErrors "errors"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
-	"golang.org/x/crypto/pkcs12"
-
-	"github.com/fullsailor/pkcs7"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/groob/plist"
@@ -39,15 +32,50 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&out)
 	if err != nil {
 		ErrorLogger(LogHolder{Message: err.Error()})
-		http.Error(
-			w,
-			http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError,
-		)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	issues, err := validateMobileconfigs(out.Mobileconfigs)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(issues) > 0 {
+		InfoLogger(LogHolder{Message: "Rejecting invalid profile upload", Metric: fmt.Sprintf("%v issues", len(issues))})
+		writeProfileValidation(w, issues, http.StatusBadRequest)
+		return
 	}
 
 	useMetadata := out.Metadata
 
+	// Rollouts and device scopes only apply to shared profiles
+	targetsAll := (len(out.DeviceUDIDs) > 0 && out.DeviceUDIDs[0] == "*") ||
+		(out.DeviceUDIDs == nil && len(out.SerialNumbers) > 0 && out.SerialNumbers[0] == "*")
+	if out.DeviceScope != nil {
+		if !targetsAll {
+			http.Error(w, "device_scope requires udids or serial_numbers to be [\"*\"]", http.StatusBadRequest)
+			return
+		}
+		err = validateProfileScope(*out.DeviceScope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if out.Rollout != nil {
+		if !targetsAll {
+			http.Error(w, "rollout requires udids or serial_numbers to be [\"*\"]", http.StatusBadRequest)
+			return
+		}
+		err = validateProfileRolloutPayload(*out.Rollout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	for payloadi := range out.Mobileconfigs {
 		var profile types.DeviceProfile
 		var sharedProfile types.SharedProfile
@@ -104,6 +132,7 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 		mobileconfigData := mobileconfig
 		hash := sha256.Sum256(mobileconfigData)
 		profile.MobileconfigHash = hash[:]
+		profile.Encrypted = out.Encrypt
 
 		profiles = append(profiles, profile)
 
@@ -146,9 +175,48 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 		sharedProfile.MobileconfigData = mobileconfig
 		sharedProfile.MobileconfigHash = hash[:]
+		sharedProfile.Encrypted = out.Encrypt
+		if out.DeviceScope != nil {
+			sharedProfile.DeviceScope = *out.DeviceScope
+		}
 		sharedProfiles = append(sharedProfiles, sharedProfile)
 	}
 
+	if out.DryRun {
+		plans, err := PlanProfilePost(out, profiles, sharedProfiles)
+		writeProfilePlans(w, plans, err)
+		return
+	}
+
+	groups, err := getDeviceGroups(out.Groups)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	for _, group := range groups {
+		InfoLogger(LogHolder{Message: "Processing POST to /profiles for group", Metric: group.Name})
+		groupProfiles, err := SaveGroupProfiles(group, profiles)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		recordGroupProfileRevisions(group, groupProfiles, requestedBy(r))
+
+		if out.PushNow {
+			members, err := GetDeviceGroupMembers(group)
+			if err != nil {
+				ErrorLogger(LogHolder{Message: err.Error()})
+			}
+			_, err = PushGroupProfiles(members, groupProfiles)
+			if err != nil {
+				ErrorLogger(LogHolder{Message: err.Error()})
+			}
+		}
+	}
+
 	if out.DeviceUDIDs != nil {
 		// Not empty list
 		if len(out.DeviceUDIDs) > 0 {
@@ -162,17 +230,17 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 						http.StatusText(http.StatusInternalServerError),
 						http.StatusInternalServerError,
 					)
+					return
 				}
-				err = SaveSharedProfiles(sharedProfiles)
+				job, err := postSharedProfiles(devices, sharedProfiles, out, requestedBy(r))
 				if err != nil {
 					ErrorLogger(LogHolder{Message: err.Error()})
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
 				}
-
-				if out.PushNow {
-					_, err = PushSharedProfiles(devices, sharedProfiles)
-					if err != nil {
-						ErrorLogger(LogHolder{Message: err.Error()})
-					}
+				if job != nil {
+					writeQueuedJob(w, *job)
+					return
 				}
 			} else {
 				// Individual devices
@@ -188,6 +256,8 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 					if err != nil {
 						ErrorLogger(LogHolder{Message: err.Error()})
 						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					} else {
+						recordDeviceProfileRevisions(device, profiles, requestedBy(r))
 					}
 					metadata = append(metadata, metadataItem)
 				}
@@ -203,16 +273,15 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 					return
 				}
-				err = SaveSharedProfiles(sharedProfiles)
+				job, err := postSharedProfiles(devices, sharedProfiles, out, requestedBy(r))
 				if err != nil {
 					ErrorLogger(LogHolder{Message: err.Error()})
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
 				}
-
-				if out.PushNow {
-					_, err = PushSharedProfiles(devices, sharedProfiles)
-					if err != nil {
-						ErrorLogger(LogHolder{Message: err.Error()})
-					}
+				if job != nil {
+					writeQueuedJob(w, *job)
+					return
 				}
 			} else {
 				for _, item := range out.SerialNumbers {
@@ -225,6 +294,8 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 					if err != nil {
 						ErrorLogger(LogHolder{Message: err.Error()})
 						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					} else {
+						recordDeviceProfileRevisions(device, profiles, requestedBy(r))
 					}
 					metadata = append(metadata, metadataItem)
 				}
@@ -247,6 +318,95 @@ func PostProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func writeProfilePlans(w http.ResponseWriter, plans []types.ProfilePlan, err error) {
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&plans, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// postSharedProfiles saves the shared profiles, or starts a rollout of them, and records their revisions once that
+// succeeded. Revisions of rollout candidates are marked, as they aren't the shared profile until the rollout completes.
+func postSharedProfiles(devices []types.Device, sharedProfiles []types.SharedProfile, out types.ProfilePayload, createdBy string) (*types.Job, error) {
+	if out.Rollout != nil {
+		_, err := StartProfileRollouts(sharedProfiles, *out.Rollout)
+		if err != nil {
+			return nil, errors.Wrap(err, "postSharedProfiles")
+		}
+		recordSharedProfileRevisions(sharedProfiles, createdBy, true)
+		return nil, nil
+	}
+
+	err := replaceSharedProfiles(sharedProfiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "postSharedProfiles")
+	}
+	recordSharedProfileRevisions(sharedProfiles, createdBy, false)
+
+	return queueSharedProfilePush(devices, sharedProfiles, out.PushNow)
+}
+
+// saveAndPushSharedProfiles replaces the shared profiles, cancelling any rollout of a previous version. With pushNow
+// the profiles are pushed to the devices by a shared_profile_push job.
+func saveAndPushSharedProfiles(devices []types.Device, sharedProfiles []types.SharedProfile, pushNow bool) (*types.Job, error) {
+	err := replaceSharedProfiles(sharedProfiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "saveAndPushSharedProfiles")
+	}
+
+	return queueSharedProfilePush(devices, sharedProfiles, pushNow)
+}
+
+// replaceSharedProfiles cancels any rollout of the shared profiles and saves them
+func replaceSharedProfiles(sharedProfiles []types.SharedProfile) error {
+	identifiers := make([]string, 0, len(sharedProfiles))
+	for _, sharedProfile := range sharedProfiles {
+		identifiers = append(identifiers, sharedProfile.PayloadIdentifier)
+	}
+	err := cancelProfileRollouts(identifiers)
+	if err != nil {
+		return errors.Wrap(err, "replaceSharedProfiles")
+	}
+
+	err = SaveSharedProfiles(sharedProfiles)
+	return errors.Wrap(err, "replaceSharedProfiles")
+}
+
+// queueSharedProfilePush creates the shared_profile_push job for the devices when pushNow is set
+func queueSharedProfilePush(devices []types.Device, sharedProfiles []types.SharedProfile, pushNow bool) (*types.Job, error) {
+	if !pushNow {
+		return nil, nil
+	}
+
+	identifiers := make([]string, 0, len(sharedProfiles))
+	for _, sharedProfile := range sharedProfiles {
+		identifiers = append(identifiers, sharedProfile.PayloadIdentifier)
+	}
+	udids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		udids = append(udids, device.UDID)
+	}
+	job, err := createJob(jobTypeSharedProfilePush, types.SharedProfilePushJobParams{PayloadIdentifiers: identifiers}, jobItemsForTargets(udids, nil))
+	if err != nil {
+		return nil, errors.Wrap(err, "queueSharedProfilePush")
+	}
+
+	return &job, nil
+}
+
 func ProcessDeviceProfiles(
 	device types.Device,
 	profiles []types.DeviceProfile,
@@ -397,6 +557,19 @@ func SavedDeviceProfileDiffers(device types.Device, profile types.DeviceProfile)
 		return true, nil
 	}
 
+	if savedProfile.Encrypted != profile.Encrypted {
+		InfoLogger(
+			LogHolder{
+				DeviceUDID:        device.UDID,
+				DeviceSerial:      device.SerialNumber,
+				ProfileIdentifier: profile.PayloadIdentifier,
+				ProfileUUID:       profile.HashedPayloadUUID,
+				Message:           "Profile encryption setting doesn't match what's saved",
+			},
+		)
+		return true, nil
+	}
+
 	// Profile isn't what we have saved in the profilelist
 	err := db.DB.Model(&profileList).
 		Where("device_ud_id = ? AND payload_identifier = ?", device.UDID, profile.PayloadIdentifier).
@@ -434,7 +607,12 @@ func DisableSharedProfiles(payload types.DeleteProfilePayload) error {
 	}
 
 	for _, profile := range payload.Mobileconfigs {
-		err := db.DB.Model(&sharedProfileModel).
+		err := cancelProfileRollouts([]string{profile.PayloadIdentifier})
+		if err != nil {
+			return errors.Wrap(err, "Profiles::DisableSharedProfiles")
+		}
+
+		err = db.DB.Model(&sharedProfileModel).
 			Select("installed").
 			Where("payload_identifier = ?", profile.PayloadIdentifier).
 			Updates(map[string]interface{}{
@@ -465,6 +643,41 @@ func DeleteProfileHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		ErrorLogger(LogHolder{Message: err.Error()})
 	}
+
+	if out.DryRun {
+		plans, err := PlanProfileDelete(out)
+		writeProfilePlans(w, plans, err)
+		return
+	}
+
+	groups, err := getDeviceGroups(out.Groups)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	for _, group := range groups {
+		InfoLogger(LogHolder{Message: "Processing DELETE to /profiles for group", Metric: group.Name})
+		groupProfiles, err := DisableGroupProfiles(group, out)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if out.PushNow {
+			members, err := GetDeviceGroupMembers(group)
+			if err != nil {
+				ErrorLogger(LogHolder{Message: err.Error()})
+			}
+			_, err = DeleteGroupProfiles(members, groupProfiles)
+			if err != nil {
+				ErrorLogger(LogHolder{Message: err.Error()})
+			}
+		}
+	}
+
 	if out.DeviceUDIDs != nil {
 		// Not empty list
 		if len(out.DeviceUDIDs) > 0 {
@@ -609,6 +822,8 @@ func SaveProfiles(devices []types.Device, profiles []types.DeviceProfile) error
 
 func PushProfiles(devices []types.Device, profiles []types.DeviceProfile) ([]types.Command, error) {
 	var pushedCommands []types.Command
+	templates := make(templateValueCache)
+	signers := newProfileSigners()
 	for i := range devices {
 		device := devices[i]
 		for i := range profiles {
@@ -616,41 +831,48 @@ func PushProfiles(devices []types.Device, profiles []types.DeviceProfile) ([]typ
 			var commandPayload types.CommandPayload
 			commandPayload.RequestType = "InstallProfile"
 
+			mobileconfigData, hashedPayloadUUID, err := templates.renderProfile(device, profileData.MobileconfigData, profileData.HashedPayloadUUID)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: err.Error()})
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+				continue
+			}
+			if profileData.Encrypted {
+				mobileconfigData, err = encryptProfileForDevice(device, mobileconfigData)
+				if err != nil {
+					ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: err.Error()})
+					recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+					continue
+				}
+			}
+			commandPayload.ProfileIdentifier = profileData.PayloadIdentifier
+			commandPayload.ProfileUUID = hashedPayloadUUID
+
 			InfoLogger(
 				LogHolder{
 					DeviceUDID:         device.UDID,
 					DeviceSerial:       device.SerialNumber,
 					Message:            "Pushing Device Profile",
 					ProfileIdentifier:  profileData.PayloadIdentifier,
-					ProfileUUID:        profileData.HashedPayloadUUID,
+					ProfileUUID:        hashedPayloadUUID,
 					CommandRequestType: commandPayload.RequestType,
 				},
 			)
 
-			if utils.Sign() {
-				priv, pub, err := loadSigningKey(
-					utils.KeyPassword(),
-					utils.KeyPath(),
-					utils.CertPath(),
-				)
-				if err != nil {
-					log.Errorf("loading signing certificate and private key: %v", err)
-				}
-				signed, err := SignProfile(priv, pub, profileData.MobileconfigData)
-				if err != nil {
-					log.Errorf("signing profile with the specified key: %v", err)
-				}
-
-				commandPayload.Payload = base64.StdEncoding.EncodeToString(signed)
-			} else {
-				commandPayload.Payload = base64.StdEncoding.EncodeToString(profileData.MobileconfigData)
+			signed, err := signers.signMobileconfig(device.UDID, mobileconfigData, !profileData.Encrypted)
+			if err != nil {
+				log.Errorf("signing profile: %v", err)
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+				continue
 			}
+			commandPayload.Payload = base64.StdEncoding.EncodeToString(signed)
 
 			commandPayload.UDID = device.UDID
 
 			command, err := SendCommand(commandPayload)
 			if err != nil {
 				ErrorLogger(LogHolder{Message: err.Error()})
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
 			}
 			pushedCommands = append(pushedCommands, command)
 
@@ -715,9 +937,18 @@ func DeleteSharedProfiles(
 			skipUDIDs[deviceProfile.DeviceUDID] = struct{}{}
 		}
 
+		// get devices that receive a version of this profile through a group
+		groupUDIDs, err := devicesWithGroupProfile(profileData.PayloadIdentifier)
+		if err != nil {
+			return nil, errors.Wrap(err, "DeleteSharedProfiles: could not query group profiles")
+		}
+		for udid := range groupUDIDs {
+			skipUDIDs[udid] = struct{}{}
+		}
+
 		for i := range devices {
 			device := devices[i]
-			// skip deleting shared profile if device has a device-specific version of this profile
+			// skip deleting shared profile if device has a device-specific or group version of this profile
 			if _, ok := skipUDIDs[device.UDID]; ok {
 				continue
 			}
@@ -725,6 +956,7 @@ func DeleteSharedProfiles(
 			commandPayload.UDID = device.UDID
 			commandPayload.RequestType = "RemoveProfile"
 			commandPayload.Identifier = profileData.PayloadIdentifier
+			commandPayload.ProfileIdentifier = profileData.PayloadIdentifier
 			InfoLogger(
 				LogHolder{
 					DeviceUDID:         device.UDID,
@@ -759,6 +991,7 @@ func DeleteDeviceProfiles(
 			commandPayload.UDID = device.UDID
 			commandPayload.RequestType = "RemoveProfile"
 			commandPayload.Identifier = profileData.PayloadIdentifier
+			commandPayload.ProfileIdentifier = profileData.PayloadIdentifier
 			InfoLogger(
 				LogHolder{
 					DeviceUDID:         device.UDID,
@@ -785,6 +1018,8 @@ func PushSharedProfiles(
 	profiles []types.SharedProfile,
 ) ([]types.Command, error) {
 	var pushedCommands []types.Command
+	templates := make(templateValueCache)
+	signers := newProfileSigners()
 	for i := range profiles {
 		profileData := profiles[i]
 
@@ -799,49 +1034,75 @@ func PushSharedProfiles(
 			skipUDIDs[deviceProfile.DeviceUDID] = struct{}{}
 		}
 
+		// get devices that receive a version of this profile through a group
+		groupUDIDs, err := devicesWithGroupProfile(profileData.PayloadIdentifier)
+		if err != nil {
+			return nil, errors.Wrap(err, "PushSharedProfiles: could not query group profiles")
+		}
+		for udid := range groupUDIDs {
+			skipUDIDs[udid] = struct{}{}
+		}
+
 		for i := range devices {
 			device := devices[i]
-			// skip pushing shared profile if device has a device-specific version of this profile
+			// skip pushing shared profile if device has a device-specific or group version of this profile
 			if _, ok := skipUDIDs[device.UDID]; ok {
 				continue
 			}
+			scoped, err := scopedDevice(profileData.DeviceScope, device)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: err.Error()})
+				continue
+			}
+			if !deviceInProfileScope(profileData.DeviceScope, scoped) {
+				InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: "Shared profile is not applicable to device"})
+				recordProfileNotApplicable(device, profileData.PayloadIdentifier)
+				continue
+			}
 			var commandPayload types.CommandPayload
 
 			commandPayload.UDID = device.UDID
 			commandPayload.RequestType = "InstallProfile"
 
+			mobileconfigData, hashedPayloadUUID, err := templates.renderProfile(device, profileData.MobileconfigData, profileData.HashedPayloadUUID)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: err.Error()})
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+				continue
+			}
+			// Without an identity certificate the device is skipped rather than sent the profile in plain text
+			if profileData.Encrypted {
+				mobileconfigData, err = encryptProfileForDevice(device, mobileconfigData)
+				if err != nil {
+					ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profileData.PayloadIdentifier, Message: err.Error()})
+					recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+					continue
+				}
+			}
+			commandPayload.ProfileIdentifier = profileData.PayloadIdentifier
+			commandPayload.ProfileUUID = hashedPayloadUUID
+
 			InfoLogger(
 				LogHolder{
 					DeviceUDID:         device.UDID,
 					DeviceSerial:       device.SerialNumber,
 					Message:            "Pushing Shared Profile",
 					ProfileIdentifier:  profileData.PayloadIdentifier,
-					ProfileUUID:        profileData.HashedPayloadUUID,
+					ProfileUUID:        hashedPayloadUUID,
 					CommandRequestType: commandPayload.RequestType,
 				},
 			)
 
-			if utils.Sign() {
-				priv, pub, err := loadSigningKey(
-					utils.KeyPassword(),
-					utils.KeyPath(),
-					utils.CertPath(),
-				)
-				if err != nil {
-					return pushedCommands, errors.Wrap(err, "PushSharedProfiles")
-				}
-				signed, err := SignProfile(priv, pub, profileData.MobileconfigData)
-				if err != nil {
-					return pushedCommands, errors.Wrap(err, "PushSharedProfiles")
-				}
-
-				commandPayload.Payload = base64.StdEncoding.EncodeToString(signed)
-			} else {
-				commandPayload.Payload = base64.StdEncoding.EncodeToString(profileData.MobileconfigData)
+			signed, err := signers.signMobileconfig(device.UDID, mobileconfigData, !profileData.Encrypted)
+			if err != nil {
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
+				return pushedCommands, errors.Wrap(err, "PushSharedProfiles")
 			}
+			commandPayload.Payload = base64.StdEncoding.EncodeToString(signed)
 
 			command, err := SendCommand(commandPayload)
 			if err != nil {
+				recordProfileCommandFailed(device.UDID, profileData.PayloadIdentifier, commandPayload.RequestType, err)
 				return pushedCommands, errors.Wrap(err, "PushSharedProfiles")
 			}
 
@@ -860,7 +1121,11 @@ type ProfileForVerification struct {
 	MobileconfigHash  []byte
 	DeviceUDID        string
 	Installed         bool
-	Type              string // device or shared
+	Encrypted         bool
+	Type              string // device, group or shared
+	DeviceScope       types.ProfileScope
+	// NotApplicable is set for shared profiles outside of their DeviceScope, which are removed if installed
+	NotApplicable bool
 }
 
 func VerifyMDMProfiles(profileListData types.ProfileListData, device types.Device) error {
@@ -924,54 +1189,150 @@ func VerifyMDMProfiles(profileListData types.ProfileListData, device types.Devic
 		profileForVerification.MobileconfigHash = deviceprofile.MobileconfigHash
 		profileForVerification.DeviceUDID = deviceprofile.DeviceUDID
 		profileForVerification.Installed = deviceprofile.Installed
+		profileForVerification.Encrypted = deviceprofile.Encrypted
 		profileForVerification.Type = "device"
 		profilesForVerification = append(profilesForVerification, profileForVerification)
 		deviceProfileIDs[profileForVerification.PayloadIdentifier] = struct{}{}
 	}
 
+	// Get the group profiles for the groups the device is a member of
+	groupProfiles, err := groupProfilesForDevice(device.UDID)
+	if err != nil {
+		return errors.Wrap(err, "VerifyMDMProfiles: Cannot load group profiles to install")
+	}
+
+	var removedGroupProfiles []types.GroupProfile
+	groupProfileIDs := make(map[string]struct{}, len(groupProfiles))
+	for i := range groupProfiles {
+		groupProfile := groupProfiles[i]
+		// don't consider group profiles that have a device-specific version
+		if _, ok := deviceProfileIDs[groupProfile.PayloadIdentifier]; ok {
+			continue
+		}
+		// removed group profiles don't replace the shared version, they are removed like those of groups the device left
+		if !groupProfileOverridesShared(groupProfile) {
+			removedGroupProfiles = append(removedGroupProfiles, groupProfile)
+			continue
+		}
+		profileForVerification := groupProfileForVerification(groupProfile, device.UDID)
+		profilesForVerification = append(profilesForVerification, profileForVerification)
+		groupProfileIDs[profileForVerification.PayloadIdentifier] = struct{}{}
+	}
+
 	err = db.DB.Model(&sharedProfile).Find(&sharedProfiles).Scan(&sharedProfiles).Error
 	if err != nil {
 		return errors.Wrap(err, "VerifyMDMProfiles: Cannot load shared profiles to install")
 	}
 
+	// Devices that are part of a rollout verify against the new version of the profile
+	sharedProfiles, err = applyProfileRollouts(device.UDID, sharedProfiles)
+	if err != nil {
+		return errors.Wrap(err, "VerifyMDMProfiles: Cannot load profile rollouts")
+	}
+
+	sharedProfileIDs := make(map[string]struct{}, len(sharedProfiles))
 	for i := range sharedProfiles {
 		var profileForVerification ProfileForVerification
 		sharedProfile := sharedProfiles[i]
-		// don't consider shared profiles that have a device-specific version
+		sharedProfileIDs[sharedProfile.PayloadIdentifier] = struct{}{}
+		// don't consider shared profiles that have a device-specific or group version
 		if _, ok := deviceProfileIDs[sharedProfile.PayloadIdentifier]; ok {
 			continue
 		}
+		if _, ok := groupProfileIDs[sharedProfile.PayloadIdentifier]; ok {
+			continue
+		}
 		profileForVerification.PayloadUUID = sharedProfile.PayloadUUID
 		profileForVerification.PayloadIdentifier = sharedProfile.PayloadIdentifier
 		profileForVerification.HashedPayloadUUID = sharedProfile.HashedPayloadUUID
 		profileForVerification.MobileconfigData = sharedProfile.MobileconfigData
 		profileForVerification.MobileconfigHash = sharedProfile.MobileconfigHash
 		profileForVerification.Installed = sharedProfile.Installed
+		profileForVerification.Encrypted = sharedProfile.Encrypted
 		profileForVerification.Type = "shared"
+		profileForVerification.DeviceScope = sharedProfile.DeviceScope
+		if profileScopeSet(sharedProfile.DeviceScope) {
+			scoped, err := scopedDevice(sharedProfile.DeviceScope, device)
+			if err != nil {
+				return errors.Wrap(err, "VerifyMDMProfiles: Cannot load device for profile scope")
+			}
+			if !deviceInProfileScope(sharedProfile.DeviceScope, scoped) {
+				profileForVerification.Installed = false
+				profileForVerification.NotApplicable = true
+			}
+		}
 		profilesForVerification = append(profilesForVerification, profileForVerification)
 	}
 
-	_, cert, err := loadSigningKey(utils.KeyPassword(), utils.KeyPath(), utils.CertPath())
+	// Profiles from groups the device has left, or that were removed from its groups, should be removed, unless
+	// something else still manages the identifier
+	orphanedProfiles, err := orphanedGroupProfiles(device.UDID)
 	if err != nil {
-		log.Errorf("loading signing certificate and private key: %v", err)
+		return errors.Wrap(err, "VerifyMDMProfiles: Cannot load group profiles to remove")
+	}
+	orphanedProfiles = append(orphanedProfiles, removedGroupProfiles...)
+
+	installedIDs := make(map[string]struct{}, len(profileLists))
+	for i := range profileLists {
+		installedIDs[profileLists[i].PayloadIdentifier] = struct{}{}
 	}
+	pendingGroups := make(map[uuid.UUID]struct{})
+
+	for i := range orphanedProfiles {
+		orphanedProfile := orphanedProfiles[i]
+		if _, ok := deviceProfileIDs[orphanedProfile.PayloadIdentifier]; ok {
+			continue
+		}
+		if _, ok := groupProfileIDs[orphanedProfile.PayloadIdentifier]; ok {
+			continue
+		}
+		if _, ok := sharedProfileIDs[orphanedProfile.PayloadIdentifier]; ok {
+			continue
+		}
+		if _, ok := installedIDs[orphanedProfile.PayloadIdentifier]; ok {
+			pendingGroups[orphanedProfile.GroupID] = struct{}{}
+		}
+		profileForVerification := groupProfileForVerification(orphanedProfile, device.UDID)
+		profileForVerification.Installed = false
+		profilesForVerification = append(profilesForVerification, profileForVerification)
+		groupProfileIDs[profileForVerification.PayloadIdentifier] = struct{}{}
+	}
+
+	// Once the profiles of a group the device left are gone it no longer needs to be checked for them
+	err = settleDeviceGroupDepartures(device.UDID, pendingGroups)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+	}
+
+	certs := acceptedSigningCertificates()
 
 	// ensure certificate matches on enrollment profile
-	err = ensureCertOnEnrollmentProfile(device, profileLists, cert)
+	err = ensureCertOnEnrollmentProfile(device, profileLists, certs)
 	if err != nil {
 		return errors.Wrap(err, "checkCertOnEnrollmentProfile")
 	}
 
+	verifiedProfiles := make(map[string]ProfileForVerification)
+	assignmentStates := make(map[string]string)
+	templates := make(templateValueCache)
 	for i := range profilesForVerification {
-		profileForVerification := profilesForVerification[i]
+		// Templated profiles are compared by their content as rendered for this device
+		profileForVerification, err := templates.renderProfileForVerification(device, profilesForVerification[i])
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profilesForVerification[i].PayloadIdentifier, Message: err.Error()})
+			continue
+		}
 		isInstalled, needsReinstall, err := validateProfileInProfileList(
 			profileForVerification,
 			profileLists,
-			cert,
+			certs...,
 		)
 		if err != nil {
 			return errors.Wrap(err, "validateProfileInProfileList")
 		}
+		verifiedProfiles[profileForVerification.PayloadIdentifier] = profileForVerification
+		assignmentStates[profileForVerification.PayloadIdentifier] = profileAssignmentVerifiedStatus(profileForVerification, isInstalled, needsReinstall)
+
 		// Profile is present in the ProfileList output
 		if isInstalled {
 			// Profile is present, but should not be installed
@@ -1036,6 +1397,36 @@ func VerifyMDMProfiles(profileListData types.ProfileListData, device types.Devic
 		}
 	}
 
+	err = reconcileProfileAssignments(device, verifiedProfiles, assignmentStates)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+	}
+
+	knownProfileIDs := make(map[string]struct{}, len(profilesForVerification)+len(sharedProfileIDs))
+	for i := range profilesForVerification {
+		knownProfileIDs[profilesForVerification[i].PayloadIdentifier] = struct{}{}
+	}
+	for identifier := range sharedProfileIDs {
+		knownProfileIDs[identifier] = struct{}{}
+	}
+	err = removeUnmanagedProfiles(device, profileLists, knownProfileIDs)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+	}
+
+	if utils.Sign() {
+		managedIdentifiers := make(map[string]struct{})
+		for i := range profilesForVerification {
+			if profilesForVerification[i].Installed {
+				managedIdentifiers[profilesForVerification[i].PayloadIdentifier] = struct{}{}
+			}
+		}
+		err = updateSigningRotationProgress(device, profileLists, managedIdentifiers)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+		}
+	}
+
 	devices = append(devices, device)
 	_, err = PushProfiles(devices, profilesToInstall)
 	if err != nil {
@@ -1067,8 +1458,16 @@ func VerifyMDMProfiles(profileListData types.ProfileListData, device types.Devic
 func validateProfileInProfileList(
 	profileForVerification ProfileForVerification,
 	profileLists []types.ProfileList,
-	signingCert *x509.Certificate,
+	signingCerts ...*x509.Certificate,
 ) (bool, bool, error) {
+	// During a signing rotation profiles signed with either certificate are accepted
+	var acceptedCerts []*x509.Certificate
+	for _, signingCert := range signingCerts {
+		if signingCert != nil {
+			acceptedCerts = append(acceptedCerts, signingCert)
+		}
+	}
+
 	for i := range profileLists {
 		profileList := profileLists[i]
 
@@ -1078,7 +1477,7 @@ func validateProfileInProfileList(
 		}
 
 		// Verify the certifacte
-		if utils.Sign() &&
+		if utils.Sign() && len(acceptedCerts) > 0 &&
 			profileForVerification.PayloadIdentifier == profileList.PayloadIdentifier {
 			InfoLogger(
 				LogHolder{
@@ -1092,22 +1491,27 @@ func validateProfileInProfileList(
 				if err != nil {
 					return true, false, errors.Wrap(err, "parse PEM certificate data")
 				}
-				if parsed.Subject.String() == signingCert.Subject.String() &&
-					parsed.NotAfter.Equal(signingCert.NotAfter) &&
-					parsed.Issuer.CommonName == signingCert.Issuer.CommonName {
-					msg := fmt.Sprintf(
-						"%v Parsed certificate matches local signing certificate",
-						signingCert.Subject.String(),
-					)
-					InfoLogger(LogHolder{Message: msg, DeviceUDID: profileList.DeviceUDID})
-					certMatched = true
+				for _, signingCert := range acceptedCerts {
+					if parsed.Subject.String() == signingCert.Subject.String() &&
+						parsed.NotAfter.Equal(signingCert.NotAfter) &&
+						parsed.Issuer.CommonName == signingCert.Issuer.CommonName {
+						msg := fmt.Sprintf(
+							"%v Parsed certificate matches local signing certificate",
+							signingCert.Subject.String(),
+						)
+						InfoLogger(LogHolder{Message: msg, DeviceUDID: profileList.DeviceUDID})
+						certMatched = true
+						break
+					}
+				}
+				if certMatched {
 					break
 				}
 			}
 			if !certMatched {
 				msg := fmt.Sprintf(
 					"%v No certificates found matching local certificates",
-					signingCert.Subject.String(),
+					acceptedCerts[0].Subject.String(),
 				)
 				InfoLogger(LogHolder{Message: msg, DeviceUDID: profileList.DeviceUDID})
 				return true, true, nil
@@ -1116,6 +1520,10 @@ func validateProfileInProfileList(
 		// Profile is present in profile list, payloaduuid matches what we expect, should be installed
 		if profileForVerification.HashedPayloadUUID == profileList.PayloadUUID &&
 			profileForVerification.PayloadIdentifier == profileList.PayloadIdentifier {
+			// Encryption was turned on for a profile the device installed in plain text
+			if profileForVerification.Encrypted && !profileList.IsEncrypted {
+				return true, true, nil
+			}
 			return true, false, nil
 		}
 	}
@@ -1138,10 +1546,12 @@ func addProfileToLists(
 		sharedProfile.Installed = profileForVerification.Installed
 		sharedProfile.MobileconfigData = profileForVerification.MobileconfigData
 		sharedProfile.MobileconfigHash = profileForVerification.MobileconfigHash
+		sharedProfile.Encrypted = profileForVerification.Encrypted
 		sharedProfilesToRemove = append(sharedProfilesToRemove, sharedProfile)
 	}
 
-	if profileForVerification.Type == "device" {
+	// Group profiles are pushed and removed the same way as device profiles
+	if profileForVerification.Type == "device" || profileForVerification.Type == "group" {
 		var deviceProfile types.DeviceProfile
 		deviceProfile.HashedPayloadUUID = profileForVerification.HashedPayloadUUID
 		deviceProfile.PayloadUUID = profileForVerification.PayloadUUID
@@ -1149,6 +1559,7 @@ func addProfileToLists(
 		deviceProfile.Installed = profileForVerification.Installed
 		deviceProfile.MobileconfigData = profileForVerification.MobileconfigData
 		deviceProfile.MobileconfigHash = profileForVerification.MobileconfigHash
+		deviceProfile.Encrypted = profileForVerification.Encrypted
 		deviceProfile.DeviceUDID = profileForVerification.DeviceUDID
 		profilesToRemove = append(profilesToRemove, deviceProfile)
 	}
@@ -1195,78 +1606,6 @@ func GetSharedProfiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Sign takes an unsigned payload and signs it with the provided private key and certificate.
-func SignProfile(
-	key crypto.PrivateKey,
-	cert *x509.Certificate,
-	mobileconfig []byte,
-) ([]byte, error) {
-	var err error
-	sd, err := pkcs7.NewSignedData(mobileconfig)
-	if err != nil {
-		return nil, errors.Wrap(err, "create signed data for mobileconfig")
-	}
-
-	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
-		return nil, errors.Wrap(err, "add crypto signer to mobileconfig signed data")
-	}
-
-	signedMobileconfig, err := sd.Finish()
-	return signedMobileconfig, errors.Wrap(err, "complete mobileconfig signing")
-}
-
-func loadSigningKey(
-	keyPass, keyPath, certPath string,
-) (crypto.PrivateKey, *x509.Certificate, error) {
-	var err error
-	certData, err := os.ReadFile(certPath)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	isP12 := filepath.Ext(certPath) == ".p12"
-	if isP12 {
-		pkey, cert, err := pkcs12.Decode(certData, keyPass)
-		return pkey, cert, errors.Wrap(err, "decode p12 contents")
-	}
-
-	keyData, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "read key from file")
-	}
-
-	keyDataBlock, _ := pem.Decode(keyData)
-	if keyDataBlock == nil {
-		return nil, nil, errors.Errorf("invalid PEM data for private key %s", keyPath)
-	}
-	var pemKeyData []byte
-	if x509.IsEncryptedPEMBlock(keyDataBlock) { //nolint:staticcheck
-		pemKeyData, err = x509.DecryptPEMBlock(keyDataBlock, []byte(keyPass)) //nolint:staticcheck
-		if err != nil {
-			return nil, nil, fmt.Errorf("decrypting DES private key %s", err)
-		}
-	} else {
-		pemKeyData = keyDataBlock.Bytes
-	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(pemKeyData)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "parse private key")
-	}
-
-	pub, _ := pem.Decode(certData)
-	if pub == nil {
-		return nil, nil, errors.Errorf("invalid PEM data for certificate %q", certPath)
-	}
-
-	cert, err := x509.ParseCertificate(pub.Bytes)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "parse PEM certificate data")
-	}
-
-	return priv, cert, nil
-}
-
 func RequestProfileList(device types.Device) error {
 	requestType := "ProfileList"
 	log.Debugf("Requesting Profile List for %v", device.UDID)
@@ -1309,6 +1648,36 @@ func InstallAllProfiles(device types.Device) ([]types.Command, error) {
 		pushedCommands = append(pushedCommands, commands...)
 	}
 
+	// skip group and shared profiles that have a device-specific version
+	skipProfiles := make(map[string]struct{})
+	for _, p := range profiles {
+		skipProfiles[p.PayloadIdentifier] = struct{}{}
+	}
+
+	groupProfiles, err := groupProfilesForDevice(device.UDID)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+	var groupProfilesToInstall []types.DeviceProfile
+	for _, p := range groupProfiles {
+		if _, ok := skipProfiles[p.PayloadIdentifier]; ok {
+			continue
+		}
+		// shared profiles are also skipped if there is an installed group version
+		if groupProfileOverridesShared(p) {
+			skipProfiles[p.PayloadIdentifier] = struct{}{}
+			groupProfilesToInstall = append(groupProfilesToInstall, groupProfileToDeviceProfile(p))
+		}
+	}
+
+	log.Debugf("Pushing Group Profiles %v", device.UDID)
+	commands, err = PushProfiles(devices, groupProfilesToInstall)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	} else {
+		pushedCommands = append(pushedCommands, commands...)
+	}
+
 	err = db.DB.Model(&sharedProfile).
 		Find(&sharedProfiles).
 		Where("installed = true").
@@ -1317,11 +1686,9 @@ func InstallAllProfiles(device types.Device) ([]types.Command, error) {
 	if err != nil {
 		ErrorLogger(LogHolder{Message: err.Error()})
 	}
-
-	// skip shared profiles that have a device-specific version
-	skipProfiles := make(map[string]struct{})
-	for _, p := range profiles {
-		skipProfiles[p.PayloadIdentifier] = struct{}{}
+	sharedProfiles, err = applyProfileRollouts(device.UDID, sharedProfiles)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
 	}
 	var unskippedSharedProfiles []types.SharedProfile
 	for _, p := range sharedProfiles {
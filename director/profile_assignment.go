@@ -0,0 +1,245 @@
+package director
+
+import (
+	"encoding/json"
+	intErrors "errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	assignmentPending   = "pending"
+	assignmentSent      = "sent"
+	assignmentInstalled = "installed"
+	assignmentFailed    = "failed"
+	assignmentRemoved   = "removed"
+	// Shared profiles outside of their DeviceScope don't apply to the device
+	assignmentNotApplicable = "not_applicable"
+)
+
+func setProfileAssignment(udid string, identifier string, updates map[string]interface{}) error {
+	var assignment types.ProfileAssignment
+
+	err := db.DB.Where("device_ud_id = ? AND payload_identifier = ?", udid, identifier).
+		Assign(updates).
+		FirstOrCreate(&assignment, types.ProfileAssignment{DeviceUDID: udid, PayloadIdentifier: identifier}).
+		Error
+	return errors.Wrap(err, "setProfileAssignment")
+}
+
+// recordProfileCommandSent marks the profile an InstallProfile or RemoveProfile command carries as sent
+func recordProfileCommandSent(command types.Command) error {
+	if command.ProfileIdentifier == "" || command.CommandUUID == "" {
+		return nil
+	}
+	if command.RequestType != "InstallProfile" && command.RequestType != "RemoveProfile" {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"status":       assignmentSent,
+		"request_type": command.RequestType,
+		"command_uuid": command.CommandUUID,
+		"error":        "",
+	}
+	if command.RequestType == "InstallProfile" {
+		updates["hashed_payload_uuid"] = command.ProfileUUID
+	}
+
+	return setProfileAssignment(command.DeviceUDID, command.ProfileIdentifier, updates)
+}
+
+// recordProfileCommandFailed marks a profile as failed when its command couldn't be built or sent
+func recordProfileCommandFailed(udid string, identifier string, requestType string, err error) {
+	updateErr := setProfileAssignment(udid, identifier, map[string]interface{}{
+		"status":       assignmentFailed,
+		"request_type": requestType,
+		"command_uuid": "",
+		"error":        err.Error(),
+	})
+	if updateErr != nil {
+		ErrorLogger(LogHolder{DeviceUDID: udid, ProfileIdentifier: identifier, Message: updateErr.Error()})
+	}
+}
+
+// updateProfileAssignmentFromAck attributes the response to a profile command back to the profile. Responses to
+// commands that have since been replaced by a newer one for the same profile are ignored.
+func updateProfileAssignmentFromAck(commandUUID string, status string, errorString string) error {
+	var assignment types.ProfileAssignment
+
+	err := db.DB.Where("command_uuid = ?", commandUUID).First(&assignment).Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "updateProfileAssignmentFromAck: load assignment")
+	}
+
+	newStatus := profileAssignmentAckStatus(assignment.RequestType, status)
+	if newStatus == "" {
+		return nil
+	}
+
+	err = db.DB.Model(&types.ProfileAssignment{}).
+		Where("device_ud_id = ? AND payload_identifier = ? AND command_uuid = ?", assignment.DeviceUDID, assignment.PayloadIdentifier, commandUUID).
+		Updates(map[string]interface{}{"status": newStatus, "error": errorString}).
+		Error
+	return errors.Wrap(err, "updateProfileAssignmentFromAck: update assignment")
+}
+
+// profileAssignmentAckStatus maps a command response to the state of the profile. NotNow and Idle leave the
+// profile as sent, the command is still queued on the device.
+func profileAssignmentAckStatus(requestType string, status string) string {
+	switch status {
+	case "Acknowledged":
+		if requestType == "RemoveProfile" {
+			return assignmentRemoved
+		}
+		return assignmentInstalled
+	case "Error", "CommandFormatError":
+		return assignmentFailed
+	}
+
+	return ""
+}
+
+// profileAssignmentVerifiedStatus is the state of a profile according to the device's ProfileList. An empty
+// string means there is nothing to record.
+func profileAssignmentVerifiedStatus(profileForVerification ProfileForVerification, isInstalled bool, needsReinstall bool) string {
+	if profileForVerification.NotApplicable && !isInstalled {
+		return assignmentNotApplicable
+	}
+
+	if profileForVerification.Installed {
+		if isInstalled && !needsReinstall {
+			return assignmentInstalled
+		}
+		return assignmentPending
+	}
+
+	if isInstalled {
+		return assignmentPending
+	}
+	return assignmentRemoved
+}
+
+// reconcileProfileAssignments records the state of each profile as seen in the ProfileList. Only changes are
+// written, and removed profiles are only recorded for devices that were tracking them.
+func reconcileProfileAssignments(device types.Device, verified map[string]ProfileForVerification, states map[string]string) error {
+	var assignments []types.ProfileAssignment
+
+	err := db.DB.Where("device_ud_id = ?", device.UDID).Find(&assignments).Error
+	if err != nil {
+		return errors.Wrap(err, "reconcileProfileAssignments: load assignments")
+	}
+
+	existing := make(map[string]types.ProfileAssignment, len(assignments))
+	for _, assignment := range assignments {
+		existing[assignment.PayloadIdentifier] = assignment
+	}
+
+	for identifier, status := range states {
+		assignment, ok := existing[identifier]
+		if !ok && status == assignmentRemoved {
+			continue
+		}
+		if ok && assignment.Status == status {
+			continue
+		}
+		// A command that hasn't been answered yet says more than the ProfileList it was sent after
+		if ok && assignment.Status == assignmentSent && status == assignmentPending {
+			continue
+		}
+
+		updates := map[string]interface{}{"status": status}
+		if status == assignmentInstalled || status == assignmentRemoved {
+			updates["error"] = ""
+		}
+		if status == assignmentInstalled {
+			updates["hashed_payload_uuid"] = verified[identifier].HashedPayloadUUID
+		}
+
+		err = setProfileAssignment(device.UDID, identifier, updates)
+		if err != nil {
+			return errors.Wrap(err, "reconcileProfileAssignments")
+		}
+	}
+
+	return nil
+}
+
+func writeProfileAssignments(w http.ResponseWriter, v interface{}) {
+	output, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// GetProfileStatusHandler returns the state of a profile on every device it has been assigned to. The status query
+// parameter limits the devices to those in that state.
+func GetProfileStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var assignments []types.ProfileAssignment
+	vars := mux.Vars(r)
+
+	tx := db.DB.Where("payload_identifier = ?", vars["identifier"])
+	if status := r.URL.Query().Get("status"); status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	err := tx.Order("device_ud_id").Find(&assignments).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(assignments) == 0 && r.URL.Query().Get("status") == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	profileStatus := types.ProfileAssignmentStatus{
+		PayloadIdentifier: vars["identifier"],
+		Devices:           make(map[string]int),
+		Assignments:       assignments,
+	}
+	for _, assignment := range assignments {
+		profileStatus.Devices[assignment.Status]++
+	}
+
+	writeProfileAssignments(w, &profileStatus)
+}
+
+// GetDeviceProfilesStatusHandler returns the state of every profile assigned to a device
+func GetDeviceProfilesStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var assignments []types.ProfileAssignment
+	vars := mux.Vars(r)
+
+	device, err := GetDevice(vars["udid"])
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = db.DB.Where("device_ud_id = ?", device.UDID).Order("payload_identifier").Find(&assignments).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeProfileAssignments(w, &assignments)
+}
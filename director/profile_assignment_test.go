@@ -0,0 +1,91 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/stretchr/testify/require"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestProfileAssignmentAckStatus(t *testing.T) {
+	tests := []struct {
+		requestType string
+		status      string
+		expected    string
+	}{
+		{"InstallProfile", "Acknowledged", assignmentInstalled},
+		{"RemoveProfile", "Acknowledged", assignmentRemoved},
+		{"InstallProfile", "Error", assignmentFailed},
+		{"RemoveProfile", "CommandFormatError", assignmentFailed},
+		{"InstallProfile", "NotNow", ""},
+		{"InstallProfile", "Idle", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.requestType+"/"+tt.status, func(t *testing.T) {
+			require.Equal(t, tt.expected, profileAssignmentAckStatus(tt.requestType, tt.status))
+		})
+	}
+}
+
+func TestProfileAssignmentVerifiedStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		installed      bool
+		isInstalled    bool
+		needsReinstall bool
+		expected       string
+	}{
+		{"installed", true, true, false, assignmentInstalled},
+		{"outdated", true, true, true, assignmentPending},
+		{"missing", true, false, true, assignmentPending},
+		{"waiting for removal", false, true, false, assignmentPending},
+		{"removed", false, false, true, assignmentRemoved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := ProfileForVerification{PayloadIdentifier: "com.example.wifi", Installed: tt.installed}
+			require.Equal(t, tt.expected, profileAssignmentVerifiedStatus(profile, tt.isInstalled, tt.needsReinstall))
+		})
+	}
+}
+
+func TestUpdateProfileAssignmentFromAck(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "profile_assignments" WHERE command_uuid = \$1`).
+		WithArgs("command-1").
+		WillReturnRows(sqlmock.NewRows([]string{"device_ud_id", "payload_identifier", "status", "request_type", "command_uuid"}).
+			AddRow("1234-5678-123456", "com.example.wifi", assignmentSent, "InstallProfile", "command-1"))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "profile_assignments" SET "error"=\$1,"status"=\$2,"updated_at"=\$3 WHERE device_ud_id = \$4 AND payload_identifier = \$5 AND command_uuid = \$6`).
+		WithArgs("bad payload", assignmentFailed, sqlmock.AnyArg(), "1234-5678-123456", "com.example.wifi", "command-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+
+	require.NoError(t, updateProfileAssignmentFromAck("command-1", "Error", "bad payload"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestUpdateProfileAssignmentFromAck_UnknownCommand(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "profile_assignments" WHERE command_uuid = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"device_ud_id"}))
+
+	require.NoError(t, updateProfileAssignmentFromAck("command-2", "Acknowledged", ""))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
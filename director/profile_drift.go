@@ -0,0 +1,279 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+// enrollmentProfileIdentifier returns the PayloadIdentifier of the configured enrollment profile. The stored
+// ProfileList rows don't carry the payload types, so this is how the enrollment profile is recognised in them.
+func enrollmentProfileIdentifier() string {
+	var profile types.DeviceProfile
+
+	if utils.EnrollmentProfile() == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(utils.EnrollmentProfile())
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return ""
+	}
+
+	if utils.SignedEnrollmentProfile() {
+		p7, err := pkcs7.Parse(data)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			return ""
+		}
+		data = p7.Content
+	}
+
+	err = plist.Unmarshal(data, &profile)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return ""
+	}
+
+	return profile.PayloadIdentifier
+}
+
+func isEnrollmentProfile(profileList types.ProfileList, enrollmentIdentifier string) bool {
+	if enrollmentIdentifier != "" && profileList.PayloadIdentifier == enrollmentIdentifier {
+		return true
+	}
+
+	for _, payload := range profileList.PayloadContent {
+		if payload.PayloadType == "com.apple.mdm" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// profileAllowlisted reports whether the identifier is in the allowlist. An entry ending in * matches every
+// identifier with that prefix.
+func profileAllowlisted(identifier string, allowlist []string) bool {
+	for _, entry := range allowlist {
+		if strings.HasSuffix(entry, "*") {
+			if strings.HasPrefix(identifier, strings.TrimSuffix(entry, "*")) {
+				return true
+			}
+			continue
+		}
+		if identifier == entry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// driftedProfiles returns the profiles in the ProfileList that aren't one of the known identifiers
+func driftedProfiles(
+	device types.Device,
+	profileLists []types.ProfileList,
+	known map[string]struct{},
+	enrollmentIdentifier string,
+	allowlist []string,
+) []types.ProfileDrift {
+	var drift []types.ProfileDrift
+
+	for _, profileList := range profileLists {
+		if _, ok := known[profileList.PayloadIdentifier]; ok {
+			continue
+		}
+		if isEnrollmentProfile(profileList, enrollmentIdentifier) {
+			continue
+		}
+
+		drift = append(drift, types.ProfileDrift{
+			DeviceUDID:          device.UDID,
+			SerialNumber:        device.SerialNumber,
+			PayloadIdentifier:   profileList.PayloadIdentifier,
+			PayloadUUID:         profileList.PayloadUUID,
+			PayloadDisplayName:  profileList.PayloadDisplayName,
+			PayloadOrganization: profileList.PayloadOrganization,
+			IsManaged:           profileList.IsManaged,
+			Allowlisted:         profileAllowlisted(profileList.PayloadIdentifier, allowlist),
+		})
+	}
+
+	return drift
+}
+
+// removeUnmanagedProfiles sends RemoveProfile for managed profiles mdmdirector doesn't know about, if
+// -remove-unmanaged-profiles is set. Profiles installed outside of MDM can't be removed and are only reported.
+func removeUnmanagedProfiles(device types.Device, profileLists []types.ProfileList, known map[string]struct{}) error {
+	var profilesToRemove []types.DeviceProfile
+
+	if !utils.RemoveUnmanagedProfiles() {
+		return nil
+	}
+
+	drift := driftedProfiles(device, profileLists, known, enrollmentProfileIdentifier(), utils.UnmanagedProfileAllowlist())
+	for _, profile := range drift {
+		if !profile.IsManaged || profile.Allowlisted {
+			continue
+		}
+
+		sent, err := unmanagedProfileRemovalSent(device.UDID, profile.PayloadIdentifier)
+		if err != nil {
+			return errors.Wrap(err, "removeUnmanagedProfiles")
+		}
+		if sent {
+			continue
+		}
+
+		InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profile.PayloadIdentifier, ProfileUUID: profile.PayloadUUID, Message: "Removing unmanaged profile"})
+		profilesToRemove = append(profilesToRemove, types.DeviceProfile{PayloadIdentifier: profile.PayloadIdentifier, PayloadUUID: profile.PayloadUUID})
+	}
+
+	if len(profilesToRemove) == 0 {
+		return nil
+	}
+
+	_, err := DeleteDeviceProfiles([]types.Device{device}, profilesToRemove)
+	return errors.Wrap(err, "removeUnmanagedProfiles")
+}
+
+// unmanagedProfileRemovalSent reports whether a RemoveProfile was already sent for the profile. While it is
+// unanswered another one isn't sent, and once the device returned an error the RemoveProfile retry policy decides
+// whether it is sent again. Only a RemoveProfile that couldn't be sent at all is tried again on the next ProfileList.
+func unmanagedProfileRemovalSent(udid string, identifier string) (bool, error) {
+	var count int64
+	err := db.DB.Model(&types.ProfileAssignment{}).
+		Where("device_ud_id = ? AND payload_identifier = ? AND request_type = ?", udid, identifier, "RemoveProfile").
+		Where("status = ? OR (status = ? AND command_uuid <> ?)", assignmentSent, assignmentFailed, "").
+		Count(&count).
+		Error
+	if err != nil {
+		return false, errors.Wrap(err, "unmanagedProfileRemovalSent")
+	}
+
+	return count > 0, nil
+}
+
+// knownProfileIdentifiers returns the device, group and shared profile identifiers of every device
+func knownProfileIdentifiers() (map[string]map[string]struct{}, map[string]struct{}, error) {
+	var shared []string
+	var assigned []struct {
+		DeviceUDID        string
+		PayloadIdentifier string
+	}
+	var groupAssigned []struct {
+		DeviceUDID        string
+		PayloadIdentifier string
+	}
+
+	err := db.DB.Model(&types.SharedProfile{}).Distinct().Pluck("payload_identifier", &shared).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "knownProfileIdentifiers: shared profiles")
+	}
+
+	err = db.DB.Model(&types.DeviceProfile{}).Select("device_ud_id, payload_identifier").Scan(&assigned).Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "knownProfileIdentifiers: device profiles")
+	}
+
+	err = db.DB.Model(&types.GroupProfile{}).
+		Select("device_group_members.device_ud_id, group_profiles.payload_identifier").
+		Joins("JOIN device_group_members ON device_group_members.group_id = group_profiles.group_id").
+		Scan(&groupAssigned).
+		Error
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "knownProfileIdentifiers: group profiles")
+	}
+
+	sharedIdentifiers := make(map[string]struct{}, len(shared))
+	for _, identifier := range shared {
+		sharedIdentifiers[identifier] = struct{}{}
+	}
+
+	deviceIdentifiers := make(map[string]map[string]struct{})
+	for _, row := range append(assigned, groupAssigned...) {
+		if deviceIdentifiers[row.DeviceUDID] == nil {
+			deviceIdentifiers[row.DeviceUDID] = make(map[string]struct{})
+		}
+		deviceIdentifiers[row.DeviceUDID][row.PayloadIdentifier] = struct{}{}
+	}
+
+	return deviceIdentifiers, sharedIdentifiers, nil
+}
+
+// GetProfileDriftHandler reports the profiles installed on devices that aren't device, group or shared profiles,
+// from the last ProfileList of each device. The udid query parameter limits the report to one device.
+func GetProfileDriftHandler(w http.ResponseWriter, r *http.Request) {
+	var devices []types.Device
+	var profileLists []types.ProfileList
+
+	deviceQuery := db.DB.Select("ud_id", "serial_number")
+	profileListQuery := db.DB.Order("payload_identifier")
+	if udid := r.URL.Query().Get("udid"); udid != "" {
+		deviceQuery = deviceQuery.Where("ud_id = ?", udid)
+		profileListQuery = profileListQuery.Where("device_ud_id = ?", udid)
+	}
+
+	err := deviceQuery.Order("serial_number").Find(&devices).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = profileListQuery.Find(&profileLists).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	deviceIdentifiers, sharedIdentifiers, err := knownProfileIdentifiers()
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	profileListsByDevice := make(map[string][]types.ProfileList)
+	for _, profileList := range profileLists {
+		profileListsByDevice[profileList.DeviceUDID] = append(profileListsByDevice[profileList.DeviceUDID], profileList)
+	}
+
+	enrollmentIdentifier := enrollmentProfileIdentifier()
+	allowlist := utils.UnmanagedProfileAllowlist()
+	drift := []types.ProfileDrift{}
+	for _, device := range devices {
+		known := make(map[string]struct{}, len(sharedIdentifiers)+len(deviceIdentifiers[device.UDID]))
+		for identifier := range sharedIdentifiers {
+			known[identifier] = struct{}{}
+		}
+		for identifier := range deviceIdentifiers[device.UDID] {
+			known[identifier] = struct{}{}
+		}
+
+		drift = append(drift, driftedProfiles(device, profileListsByDevice[device.UDID], known, enrollmentIdentifier, allowlist)...)
+	}
+
+	output, err := json.MarshalIndent(&drift, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
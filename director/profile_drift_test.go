@@ -0,0 +1,89 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestProfileAllowlisted(t *testing.T) {
+	allowlist := []string{"com.example.vpn", "com.vendor.*"}
+
+	tests := []struct {
+		identifier string
+		expected   bool
+	}{
+		{"com.example.vpn", true},
+		{"com.example.vpn.extra", false},
+		{"com.vendor.agent", true},
+		{"com.vendor", false},
+		{"com.other.profile", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			require.Equal(t, tt.expected, profileAllowlisted(tt.identifier, allowlist))
+		})
+	}
+}
+
+func TestDriftedProfiles(t *testing.T) {
+	device := types.Device{UDID: "1234-5678-123456", SerialNumber: "C02ABCDEFGH"}
+	profileLists := []types.ProfileList{
+		{PayloadIdentifier: "com.example.known", PayloadUUID: "known-uuid", IsManaged: true},
+		{PayloadIdentifier: "com.example.enrollment", PayloadUUID: "enrollment-uuid", IsManaged: true},
+		{
+			PayloadIdentifier: "com.example.mdm",
+			PayloadUUID:       "mdm-uuid",
+			IsManaged:         true,
+			PayloadContent:    []types.PayloadContentItem{{PayloadType: "com.apple.mdm"}},
+		},
+		{PayloadIdentifier: "com.previous.mdm.wifi", PayloadUUID: "wifi-uuid", IsManaged: true},
+		{PayloadIdentifier: "com.vendor.agent", PayloadUUID: "agent-uuid", IsManaged: true},
+		{PayloadIdentifier: "com.user.approved", PayloadUUID: "user-uuid", IsManaged: false},
+	}
+	known := map[string]struct{}{"com.example.known": {}}
+
+	drift := driftedProfiles(device, profileLists, known, "com.example.enrollment", []string{"com.vendor.*"})
+
+	require.Equal(t, []types.ProfileDrift{
+		{DeviceUDID: device.UDID, SerialNumber: device.SerialNumber, PayloadIdentifier: "com.previous.mdm.wifi", PayloadUUID: "wifi-uuid", IsManaged: true},
+		{DeviceUDID: device.UDID, SerialNumber: device.SerialNumber, PayloadIdentifier: "com.vendor.agent", PayloadUUID: "agent-uuid", IsManaged: true, Allowlisted: true},
+		{DeviceUDID: device.UDID, SerialNumber: device.SerialNumber, PayloadIdentifier: "com.user.approved", PayloadUUID: "user-uuid"},
+	}, drift)
+}
+
+func TestUnmanagedProfileRemovalSent(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		want  bool
+	}{
+		{name: "RemoveProfile unanswered or failed on the device", count: 1, want: true},
+		{name: "no RemoveProfile sent", count: 0, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectQuery(`^SELECT count\(\*\) FROM "profile_assignments" WHERE \(device_ud_id = \$1 AND payload_identifier = \$2 AND request_type = \$3\) AND \(status = \$4 OR \(status = \$5 AND command_uuid <> \$6\)\)`).
+				WithArgs("1234-5678-123456", "com.example.unmanaged", "RemoveProfile", assignmentSent, assignmentFailed, "").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+
+			sent, err := unmanagedProfileRemovalSent("1234-5678-123456", "com.example.unmanaged")
+			require.NoError(t, err)
+			require.Equal(t, tt.want, sent)
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package director
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+// ErrNoIdentityCertificate is returned when a profile should be encrypted but we don't hold a usable identity
+// certificate for the device
+var ErrNoIdentityCertificate = errors.New("no valid identity certificate for device")
+
+// certificateListRequestWindow is how long a CertificateList requested for a missing identity certificate is waited
+// on before it is requested again
+const certificateListRequestWindow = 24 * time.Hour
+
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAEncryption     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAES256CBC         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	asn1NullParameters   = asn1.RawValue{Tag: asn1.TagNull}
+	cmsEnvelopedDataVers = 0
+)
+
+// CMS EnvelopedData (RFC 5652), only as much of it as is needed to encrypt to a single RSA recipient
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     cmsEnvelopedData `asn1:"explicit,tag:0"`
+}
+
+type cmsEnvelopedData struct {
+	Version              int
+	RecipientInfos       []cmsRecipientInfo `asn1:"set"`
+	EncryptedContentInfo cmsEncryptedContentInfo
+}
+
+type cmsRecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  cmsIssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type cmsIssuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsEncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue
+}
+
+// envelopeContent encrypts content with AES-256-CBC, wrapping the key for the recipient's RSA public key
+func envelopeContent(content []byte, recipient *x509.Certificate) ([]byte, error) {
+	publicKey, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("envelopeContent: identity certificate does not have an RSA public key")
+	}
+
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "envelopeContent: generate key")
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.Wrap(err, "envelopeContent: generate iv")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelopeContent")
+	}
+
+	// PKCS#7 padding
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	padded := make([]byte, len(content), len(content)+padding)
+	copy(padded, content)
+	for i := 0; i < padding; i++ {
+		padded = append(padded, byte(padding))
+	}
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelopeContent: encrypt key")
+	}
+
+	ivParameters, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelopeContent")
+	}
+
+	contentInfo := cmsContentInfo{
+		ContentType: oidEnvelopedData,
+		Content: cmsEnvelopedData{
+			Version: cmsEnvelopedDataVers,
+			RecipientInfos: []cmsRecipientInfo{
+				{
+					Version: 0,
+					IssuerAndSerialNumber: cmsIssuerAndSerial{
+						IssuerName:   asn1.RawValue{FullBytes: recipient.RawIssuer},
+						SerialNumber: recipient.SerialNumber,
+					},
+					KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+						Algorithm:  oidRSAEncryption,
+						Parameters: asn1NullParameters,
+					},
+					EncryptedKey: encryptedKey,
+				},
+			},
+			EncryptedContentInfo: cmsEncryptedContentInfo{
+				ContentType: oidData,
+				ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+					Algorithm:  oidAES256CBC,
+					Parameters: asn1.RawValue{FullBytes: ivParameters},
+				},
+				// [0] IMPLICIT OCTET STRING
+				EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+			},
+		},
+	}
+
+	enveloped, err := asn1.Marshal(contentInfo)
+	return enveloped, errors.Wrap(err, "envelopeContent")
+}
+
+// deviceIdentityCertificate returns the newest valid identity certificate reported in the device's CertificateList.
+// Certificates from the SCEP issuer are preferred, as they are the ones the device holds the key for.
+func deviceIdentityCertificate(device types.Device) (*x509.Certificate, error) {
+	var certificates []types.Certificate
+
+	err := db.DB.Where("device_ud_id = ? AND is_identity = ?", device.UDID, true).Find(&certificates).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "deviceIdentityCertificate")
+	}
+
+	var identity *x509.Certificate
+	identityFromIssuer := false
+	now := time.Now()
+	for _, certificate := range certificates {
+		cert, err := x509.ParseCertificate(certificate.Data)
+		if err != nil {
+			continue
+		}
+		if now.After(cert.NotAfter) || now.Before(cert.NotBefore) {
+			continue
+		}
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			continue
+		}
+
+		fromIssuer := utils.ScepCertIssuer() != "" && cert.Issuer.String() == utils.ScepCertIssuer()
+		switch {
+		case identity == nil,
+			fromIssuer && !identityFromIssuer,
+			fromIssuer == identityFromIssuer && cert.NotAfter.After(identity.NotAfter):
+			identity = cert
+			identityFromIssuer = fromIssuer
+		}
+	}
+
+	if identity == nil {
+		return nil, ErrNoIdentityCertificate
+	}
+
+	return identity, nil
+}
+
+// encryptProfile moves the PayloadContent of a profile into EncryptedPayloadContent, encrypted to the certificate.
+// The rest of the profile, including PayloadUUID and PayloadIdentifier, stays readable so it can be verified
+// against the ProfileList.
+func encryptProfile(mobileconfig []byte, recipient *x509.Certificate) ([]byte, error) {
+	var profileDict map[string]interface{}
+
+	err := plist.Unmarshal(mobileconfig, &profileDict)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryptProfile: unmarshal profile")
+	}
+
+	payloadContent, ok := profileDict["PayloadContent"]
+	if !ok {
+		return nil, errors.New("encryptProfile: profile has no PayloadContent")
+	}
+
+	content, err := plist.Marshal(payloadContent)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryptProfile: marshal PayloadContent")
+	}
+
+	encrypted, err := envelopeContent(content, recipient)
+	if err != nil {
+		return nil, errors.Wrap(err, "encryptProfile")
+	}
+
+	delete(profileDict, "PayloadContent")
+	profileDict["EncryptedPayloadContent"] = encrypted
+
+	encryptedProfile, err := plist.MarshalIndent(&profileDict, "\t")
+	return encryptedProfile, errors.Wrap(err, "encryptProfile")
+}
+
+// encryptProfileForDevice encrypts the profile to the device's identity certificate. If we don't have one, a
+// CertificateList is requested so the profile can be sent once it has been processed.
+func encryptProfileForDevice(device types.Device, mobileconfig []byte) ([]byte, error) {
+	identity, err := deviceIdentityCertificate(device)
+	if err != nil {
+		// Every verify or push would otherwise queue another CertificateList while the device is offline
+		if errors.Is(err, ErrNoIdentityCertificate) && !CommandInQueue(device, "CertificateList", time.Now().Add(-certificateListRequestWindow)) {
+			requestErr := RequestCertificateList(device)
+			if requestErr != nil {
+				ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: requestErr.Error()})
+			}
+		}
+		return nil, errors.Wrap(err, "encryptProfileForDevice")
+	}
+
+	return encryptProfile(mobileconfig, identity)
+}
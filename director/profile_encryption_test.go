@@ -0,0 +1,101 @@
+package director
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fullsailor/pkcs7"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func testIdentityCertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "device identity"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func TestEncryptProfile(t *testing.T) {
+	cert, key := testIdentityCertificate(t)
+
+	encrypted, err := encryptProfile([]byte(testTemplateProfile), cert)
+	require.NoError(t, err)
+
+	var profile map[string]interface{}
+	require.NoError(t, plist.Unmarshal(encrypted, &profile))
+
+	// the outer profile stays readable so it can be matched against the ProfileList
+	require.NotContains(t, profile, "PayloadContent")
+	require.Equal(t, "com.example.template", profile["PayloadIdentifier"])
+	require.Equal(t, "template-uuid", profile["PayloadUUID"])
+
+	envelope, ok := profile["EncryptedPayloadContent"].([]byte)
+	require.True(t, ok)
+
+	p7, err := pkcs7.Parse(envelope)
+	require.NoError(t, err)
+	decrypted, err := p7.Decrypt(cert, key)
+	require.NoError(t, err)
+
+	var payloadContent []map[string]string
+	require.NoError(t, plist.Unmarshal(decrypted, &payloadContent))
+	require.Len(t, payloadContent, 1)
+	require.Equal(t, "${SERIAL_NUMBER}.example.com", payloadContent[0]["HostName"])
+}
+
+func TestEncryptProfileWithoutPayloadContent(t *testing.T) {
+	cert, _ := testIdentityCertificate(t)
+
+	profile := map[string]interface{}{"PayloadIdentifier": "com.example.empty"}
+	data, err := plist.Marshal(profile)
+	require.NoError(t, err)
+
+	_, err = encryptProfile(data, cert)
+	require.Error(t, err)
+}
+
+func TestEncryptProfileForDevice_CertificateListAlreadyQueued(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	device := types.Device{UDID: "1234-5678-123456"}
+	mockSpy.ExpectQuery(`^SELECT \* FROM "certificates" WHERE device_ud_id = \$1 AND is_identity = \$2`).
+		WithArgs(device.UDID, true).
+		WillReturnRows(sqlmock.NewRows([]string{"device_ud_id"}))
+	// no second CertificateList is sent while one is waiting for the device
+	mockSpy.ExpectQuery(`^SELECT \* FROM "commands" WHERE \(device_ud_id = \$1 AND request_type = \$2\) AND \(status = \$3 OR status = \$4\) AND updated_at > \$5`).
+		WithArgs(device.UDID, "CertificateList", "", "NotNow", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"command_uuid", "request_type"}).AddRow("command-1", "CertificateList"))
+
+	_, err := encryptProfileForDevice(device, []byte(testTemplateProfile))
+	require.True(t, errors.Is(err, ErrNoIdentityCertificate))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
@@ -0,0 +1,322 @@
+package director
+
+import (
+	"crypto/x509"
+
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	planInstall       = "install"
+	planRemove        = "remove"
+	planUnchanged     = "unchanged"
+	planNotApplicable = "not_applicable"
+)
+
+// profilePlanner works out what a profile change would do to each device by running the same comparison as
+// VerifyMDMProfiles against the stored ProfileList rows. It never sends commands or writes to the database.
+type profilePlanner struct {
+	signingCerts []*x509.Certificate
+	plans        map[string]*types.ProfilePlan
+	order        []string
+	profileLists map[string][]types.ProfileList
+	templates    templateValueCache
+}
+
+func newProfilePlanner() *profilePlanner {
+	return &profilePlanner{
+		signingCerts: acceptedSigningCertificates(),
+		plans:        make(map[string]*types.ProfilePlan),
+		profileLists: make(map[string][]types.ProfileList),
+		templates:    make(templateValueCache),
+	}
+}
+
+func (planner *profilePlanner) deviceProfileList(udid string) ([]types.ProfileList, error) {
+	if profileLists, ok := planner.profileLists[udid]; ok {
+		return profileLists, nil
+	}
+
+	var profileLists []types.ProfileList
+	err := db.DB.Where("device_ud_id = ?", udid).Find(&profileLists).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "load ProfileList")
+	}
+	planner.profileLists[udid] = profileLists
+
+	return profileLists, nil
+}
+
+func (planner *profilePlanner) add(device types.Device, profileForVerification ProfileForVerification, action string) {
+	plan, ok := planner.plans[device.UDID]
+	if !ok {
+		plan = &types.ProfilePlan{DeviceUDID: device.UDID, SerialNumber: device.SerialNumber}
+		planner.plans[device.UDID] = plan
+		planner.order = append(planner.order, device.UDID)
+	}
+
+	plan.Profiles = append(plan.Profiles, types.ProfilePlanItem{
+		PayloadIdentifier: profileForVerification.PayloadIdentifier,
+		HashedPayloadUUID: profileForVerification.HashedPayloadUUID,
+		Scope:             profileForVerification.Type,
+		Action:            action,
+	})
+}
+
+// plan records whether the profile would be installed, removed or left alone on the device
+func (planner *profilePlanner) plan(device types.Device, profileForVerification ProfileForVerification) error {
+	profileLists, err := planner.deviceProfileList(device.UDID)
+	if err != nil {
+		return errors.Wrap(err, "profilePlanner")
+	}
+
+	profileForVerification, err = planner.templates.renderProfileForVerification(device, profileForVerification)
+	if err != nil {
+		return errors.Wrap(err, "profilePlanner")
+	}
+
+	isInstalled, needsReinstall, err := validateProfileInProfileList(profileForVerification, profileLists, planner.signingCerts...)
+	if err != nil {
+		return errors.Wrap(err, "profilePlanner")
+	}
+
+	action := planUnchanged
+	switch {
+	case profileForVerification.Installed && (!isInstalled || needsReinstall):
+		action = planInstall
+	case !profileForVerification.Installed && isInstalled:
+		action = planRemove
+	}
+	planner.add(device, profileForVerification, action)
+
+	return nil
+}
+
+func (planner *profilePlanner) result() []types.ProfilePlan {
+	plans := make([]types.ProfilePlan, 0, len(planner.order))
+	for _, udid := range planner.order {
+		plans = append(plans, *planner.plans[udid])
+	}
+
+	return plans
+}
+
+// planSharedProfile plans a shared profile across the fleet. Devices with a device-specific or group version of the
+// profile keep that version, so the shared profile does not apply to them.
+func (planner *profilePlanner) planSharedProfile(devices []types.Device, profileForVerification ProfileForVerification) error {
+	deviceUDIDs, err := devicesWithDeviceProfile(profileForVerification.PayloadIdentifier)
+	if err != nil {
+		return errors.Wrap(err, "planSharedProfile")
+	}
+
+	groupUDIDs, err := devicesWithGroupProfile(profileForVerification.PayloadIdentifier)
+	if err != nil {
+		return errors.Wrap(err, "planSharedProfile")
+	}
+
+	for _, device := range devices {
+		_, hasDeviceProfile := deviceUDIDs[device.UDID]
+		_, hasGroupProfile := groupUDIDs[device.UDID]
+		if hasDeviceProfile || hasGroupProfile || !deviceInProfileScope(profileForVerification.DeviceScope, device) {
+			planner.add(device, profileForVerification, planNotApplicable)
+			continue
+		}
+
+		err = planner.plan(device, profileForVerification)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planGroupProfile plans a group profile for the members of the group, skipping those with a device-specific version
+func (planner *profilePlanner) planGroupProfile(devices []types.Device, profileForVerification ProfileForVerification) error {
+	deviceUDIDs, err := devicesWithDeviceProfile(profileForVerification.PayloadIdentifier)
+	if err != nil {
+		return errors.Wrap(err, "planGroupProfile")
+	}
+
+	for _, device := range devices {
+		if _, ok := deviceUDIDs[device.UDID]; ok {
+			planner.add(device, profileForVerification, planNotApplicable)
+			continue
+		}
+
+		err = planner.plan(device, profileForVerification)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planTargets resolves the devices a request targets. all is true when the request targets every device with "*".
+func planTargets(udids []string, serials []string) (bool, []types.Device, error) {
+	var devices []types.Device
+
+	if (len(udids) > 0 && udids[0] == "*") || (len(udids) == 0 && len(serials) > 0 && serials[0] == "*") {
+		// The fields a shared profile's DeviceScope is matched against are loaded as well
+		err := db.DB.Select("ud_id", "serial_number", "product_name", "model", "os_version", "is_supervised").
+			Find(&devices).
+			Error
+		if err != nil {
+			return true, nil, errors.Wrap(err, "planTargets")
+		}
+		return true, devices, nil
+	}
+
+	if len(udids) > 0 {
+		return false, devicesFromIdentifiers(udids, nil), nil
+	}
+
+	return false, devicesFromIdentifiers(nil, serials), nil
+}
+
+// PlanProfilePost returns what posting the profiles would do to each targeted device
+func PlanProfilePost(
+	out types.ProfilePayload,
+	profiles []types.DeviceProfile,
+	sharedProfiles []types.SharedProfile,
+) ([]types.ProfilePlan, error) {
+	planner := newProfilePlanner()
+
+	for _, groupName := range out.Groups {
+		group, err := GetDeviceGroup(groupName)
+		if err != nil {
+			return nil, errors.Wrap(err, "PlanProfilePost")
+		}
+
+		members, err := GetDeviceGroupMembers(group)
+		if err != nil {
+			return nil, errors.Wrap(err, "PlanProfilePost")
+		}
+
+		for _, profile := range profiles {
+			profileForVerification := groupProfileForVerification(types.GroupProfile{
+				GroupID:           group.ID,
+				PayloadUUID:       profile.PayloadUUID,
+				HashedPayloadUUID: profile.HashedPayloadUUID,
+				PayloadIdentifier: profile.PayloadIdentifier,
+				MobileconfigData:  profile.MobileconfigData,
+				MobileconfigHash:  profile.MobileconfigHash,
+				Encrypted:         profile.Encrypted,
+				Installed:         true,
+			}, "")
+			err = planner.planGroupProfile(members, profileForVerification)
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfilePost")
+			}
+		}
+	}
+
+	all, devices, err := planTargets(out.DeviceUDIDs, out.SerialNumbers)
+	if err != nil {
+		return nil, errors.Wrap(err, "PlanProfilePost")
+	}
+
+	if all {
+		for _, sharedProfile := range sharedProfiles {
+			err = planner.planSharedProfile(devices, ProfileForVerification{
+				PayloadUUID:       sharedProfile.PayloadUUID,
+				PayloadIdentifier: sharedProfile.PayloadIdentifier,
+				HashedPayloadUUID: sharedProfile.HashedPayloadUUID,
+				MobileconfigData:  sharedProfile.MobileconfigData,
+				MobileconfigHash:  sharedProfile.MobileconfigHash,
+				Encrypted:         sharedProfile.Encrypted,
+				Installed:         true,
+				Type:              "shared",
+				DeviceScope:       sharedProfile.DeviceScope,
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfilePost")
+			}
+		}
+		return planner.result(), nil
+	}
+
+	for _, device := range devices {
+		for _, profile := range profiles {
+			err = planner.plan(device, ProfileForVerification{
+				PayloadUUID:       profile.PayloadUUID,
+				PayloadIdentifier: profile.PayloadIdentifier,
+				HashedPayloadUUID: profile.HashedPayloadUUID,
+				MobileconfigData:  profile.MobileconfigData,
+				MobileconfigHash:  profile.MobileconfigHash,
+				Encrypted:         profile.Encrypted,
+				DeviceUDID:        device.UDID,
+				Installed:         true,
+				Type:              "device",
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfilePost")
+			}
+		}
+	}
+
+	return planner.result(), nil
+}
+
+// PlanProfileDelete returns what deleting the profiles would do to each targeted device
+func PlanProfileDelete(out types.DeleteProfilePayload) ([]types.ProfilePlan, error) {
+	planner := newProfilePlanner()
+
+	for _, groupName := range out.Groups {
+		group, err := GetDeviceGroup(groupName)
+		if err != nil {
+			return nil, errors.Wrap(err, "PlanProfileDelete")
+		}
+
+		members, err := GetDeviceGroupMembers(group)
+		if err != nil {
+			return nil, errors.Wrap(err, "PlanProfileDelete")
+		}
+
+		for _, mobileconfig := range out.Mobileconfigs {
+			err = planner.planGroupProfile(members, ProfileForVerification{
+				PayloadIdentifier: mobileconfig.PayloadIdentifier,
+				Installed:         false,
+				Type:              "group",
+			})
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfileDelete")
+			}
+		}
+	}
+
+	all, devices, err := planTargets(out.DeviceUDIDs, out.SerialNumbers)
+	if err != nil {
+		return nil, errors.Wrap(err, "PlanProfileDelete")
+	}
+
+	for _, mobileconfig := range out.Mobileconfigs {
+		profileForVerification := ProfileForVerification{
+			PayloadIdentifier: mobileconfig.PayloadIdentifier,
+			Installed:         false,
+			Type:              "device",
+		}
+
+		if all {
+			profileForVerification.Type = "shared"
+			err = planner.planSharedProfile(devices, profileForVerification)
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfileDelete")
+			}
+			continue
+		}
+
+		for _, device := range devices {
+			profileForVerification.DeviceUDID = device.UDID
+			err = planner.plan(device, profileForVerification)
+			if err != nil {
+				return nil, errors.Wrap(err, "PlanProfileDelete")
+			}
+		}
+	}
+
+	return planner.result(), nil
+}
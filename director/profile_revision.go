@@ -0,0 +1,334 @@
+package director
+
+import (
+	"bytes"
+	"encoding/json"
+	intErrors "errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	revisionScopeShared = "shared"
+	revisionScopeDevice = "device"
+	revisionScopeGroup  = "group"
+)
+
+// requestedBy identifies who made an API request, for the history of the changes it made. The Basic Auth user has
+// been checked by the time a handler runs. X-Requested-By is set by the client, so it is only kept as an unverified
+// note next to the user.
+func requestedBy(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	requester := fmt.Sprintf("%v (%v)", user, r.RemoteAddr)
+
+	if onBehalfOf := r.Header.Get("X-Requested-By"); onBehalfOf != "" {
+		requester += fmt.Sprintf(", unverified X-Requested-By %q", onBehalfOf)
+	}
+
+	return requester
+}
+
+// recordProfileRevision stores a revision unless the latest revision for the same profile has identical content
+func recordProfileRevision(revision types.ProfileRevision) error {
+	var latest types.ProfileRevision
+
+	if revision.PayloadIdentifier == "" {
+		return nil
+	}
+
+	err := db.DB.Select(
+		"mobileconfig_hash",
+		"encrypted",
+		"device_scope_product_names",
+		"device_scope_models",
+		"device_scope_min_os_version",
+		"device_scope_max_os_version",
+		"device_scope_supervised_only",
+		"rollout_candidate",
+	).
+		Where(
+			"scope = ? AND device_ud_id = ? AND group_name = ? AND payload_identifier = ?",
+			revision.Scope,
+			revision.DeviceUDID,
+			revision.GroupName,
+			revision.PayloadIdentifier,
+		).
+		Order("created_at desc").
+		First(&latest).
+		Error
+	if err != nil && !intErrors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.Wrap(err, "recordProfileRevision: load latest revision")
+	}
+
+	if err == nil && bytes.Equal(latest.MobileconfigHash, revision.MobileconfigHash) &&
+		latest.Encrypted == revision.Encrypted && profileScopeEqual(latest.DeviceScope, revision.DeviceScope) &&
+		latest.RolloutCandidate == revision.RolloutCandidate && revision.RolledBackFrom == nil {
+		return nil
+	}
+
+	err = db.DB.Create(&revision).Error
+	if err != nil {
+		return errors.Wrap(err, "recordProfileRevision")
+	}
+
+	return nil
+}
+
+func recordSharedProfileRevisions(profiles []types.SharedProfile, createdBy string, rolloutCandidate bool) {
+	for _, profile := range profiles {
+		err := recordProfileRevision(types.ProfileRevision{
+			CreatedBy:         createdBy,
+			Scope:             revisionScopeShared,
+			PayloadIdentifier: profile.PayloadIdentifier,
+			PayloadUUID:       profile.PayloadUUID,
+			HashedPayloadUUID: profile.HashedPayloadUUID,
+			MobileconfigData:  profile.MobileconfigData,
+			MobileconfigHash:  profile.MobileconfigHash,
+			Encrypted:         profile.Encrypted,
+			DeviceScope:       profile.DeviceScope,
+			RolloutCandidate:  rolloutCandidate,
+		})
+		if err != nil {
+			ErrorLogger(LogHolder{ProfileIdentifier: profile.PayloadIdentifier, Message: err.Error()})
+		}
+	}
+}
+
+func recordDeviceProfileRevisions(device types.Device, profiles []types.DeviceProfile, createdBy string) {
+	for _, profile := range profiles {
+		err := recordProfileRevision(types.ProfileRevision{
+			CreatedBy:         createdBy,
+			Scope:             revisionScopeDevice,
+			DeviceUDID:        device.UDID,
+			PayloadIdentifier: profile.PayloadIdentifier,
+			PayloadUUID:       profile.PayloadUUID,
+			HashedPayloadUUID: profile.HashedPayloadUUID,
+			MobileconfigData:  profile.MobileconfigData,
+			MobileconfigHash:  profile.MobileconfigHash,
+			Encrypted:         profile.Encrypted,
+		})
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: profile.PayloadIdentifier, Message: err.Error()})
+		}
+	}
+}
+
+func recordGroupProfileRevisions(group types.DeviceGroup, profiles []types.GroupProfile, createdBy string) {
+	for _, profile := range profiles {
+		err := recordProfileRevision(types.ProfileRevision{
+			CreatedBy:         createdBy,
+			Scope:             revisionScopeGroup,
+			GroupName:         group.Name,
+			PayloadIdentifier: profile.PayloadIdentifier,
+			PayloadUUID:       profile.PayloadUUID,
+			HashedPayloadUUID: profile.HashedPayloadUUID,
+			MobileconfigData:  profile.MobileconfigData,
+			MobileconfigHash:  profile.MobileconfigHash,
+			Encrypted:         profile.Encrypted,
+		})
+		if err != nil {
+			ErrorLogger(LogHolder{ProfileIdentifier: profile.PayloadIdentifier, Message: err.Error(), Metric: group.Name})
+		}
+	}
+}
+
+// GetProfileRevisionsHandler lists the revisions of a profile, newest first. The scope, udid and group query
+// parameters narrow the list down and data=true includes the mobileconfig of each revision.
+func GetProfileRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	var revisions []types.ProfileRevision
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	tx := db.DB.Where("payload_identifier = ?", vars["identifier"])
+	if scope := query.Get("scope"); scope != "" {
+		tx = tx.Where("scope = ?", scope)
+	}
+	if udid := query.Get("udid"); udid != "" {
+		tx = tx.Where("device_ud_id = ?", udid)
+	}
+	if group := query.Get("group"); group != "" {
+		tx = tx.Where("group_name = ?", group)
+	}
+	if query.Get("data") != "true" {
+		tx = tx.Omit("mobileconfig_data")
+	}
+
+	err := tx.Order("created_at desc").Find(&revisions).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&revisions, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// PostProfileRollbackHandler makes a previous revision the current version of the profile. The revision goes
+// through the same save and push path as a newly posted profile, so a shared profile rolled back with push_now
+// responds with the job pushing it.
+func PostProfileRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var revision types.ProfileRevision
+	var out types.ProfileRollbackPayload
+	vars := mux.Vars(r)
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&out)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := db.DB.Where("id = ?", vars["id"]).First(&revision).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: revision.DeviceUDID, ProfileIdentifier: revision.PayloadIdentifier, ProfileUUID: revision.HashedPayloadUUID, Message: "Rolling back profile", Metric: revision.Scope})
+
+	job, err := rollbackProfileRevision(revision, out.PushNow)
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: revision.DeviceUDID, ProfileIdentifier: revision.PayloadIdentifier, Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rollback := rollbackRevision(revision, requestedBy(r))
+	err = recordProfileRevision(rollback)
+	if err != nil {
+		ErrorLogger(LogHolder{ProfileIdentifier: revision.PayloadIdentifier, Message: err.Error()})
+	}
+
+	// A shared profile pushed with push_now is pushed by a job, like a newly posted one
+	if job != nil {
+		writeQueuedJob(w, *job)
+		return
+	}
+
+	rollback.MobileconfigData = nil
+	output, err := json.MarshalIndent(&rollback, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// rollbackRevision is the revision recorded when a profile is rolled back, a copy of the revision rolled back to
+func rollbackRevision(revision types.ProfileRevision, createdBy string) types.ProfileRevision {
+	rolledBackFrom := revision.ID
+	return types.ProfileRevision{
+		CreatedBy:         createdBy,
+		Scope:             revision.Scope,
+		DeviceUDID:        revision.DeviceUDID,
+		GroupName:         revision.GroupName,
+		PayloadIdentifier: revision.PayloadIdentifier,
+		PayloadUUID:       revision.PayloadUUID,
+		HashedPayloadUUID: revision.HashedPayloadUUID,
+		MobileconfigData:  revision.MobileconfigData,
+		MobileconfigHash:  revision.MobileconfigHash,
+		Encrypted:         revision.Encrypted,
+		DeviceScope:       revision.DeviceScope,
+		RolledBackFrom:    &rolledBackFrom,
+	}
+}
+
+func rollbackProfileRevision(revision types.ProfileRevision, pushNow bool) (*types.Job, error) {
+	switch revision.Scope {
+	case revisionScopeShared:
+		var devices []types.Device
+		err := db.DB.Select("ud_id", "serial_number").Find(&devices).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "rollbackProfileRevision: load devices")
+		}
+
+		sharedProfile := types.SharedProfile{
+			PayloadUUID:       revision.PayloadUUID,
+			HashedPayloadUUID: revision.HashedPayloadUUID,
+			PayloadIdentifier: revision.PayloadIdentifier,
+			MobileconfigData:  revision.MobileconfigData,
+			MobileconfigHash:  revision.MobileconfigHash,
+			Encrypted:         revision.Encrypted,
+			DeviceScope:       revision.DeviceScope,
+			Installed:         true,
+		}
+		job, err := saveAndPushSharedProfiles(devices, []types.SharedProfile{sharedProfile}, pushNow)
+		return job, errors.Wrap(err, "rollbackProfileRevision")
+
+	case revisionScopeDevice:
+		device, err := GetDevice(revision.DeviceUDID)
+		if err != nil {
+			return nil, errors.Wrap(err, "rollbackProfileRevision")
+		}
+
+		_, err = ProcessDeviceProfiles(device, []types.DeviceProfile{revisionToDeviceProfile(revision)}, pushNow, "post")
+		return nil, errors.Wrap(err, "rollbackProfileRevision")
+
+	case revisionScopeGroup:
+		group, err := GetDeviceGroup(revision.GroupName)
+		if err != nil {
+			return nil, errors.Wrap(err, "rollbackProfileRevision")
+		}
+
+		groupProfiles, err := SaveGroupProfiles(group, []types.DeviceProfile{revisionToDeviceProfile(revision)})
+		if err != nil {
+			return nil, errors.Wrap(err, "rollbackProfileRevision")
+		}
+
+		if pushNow {
+			members, err := GetDeviceGroupMembers(group)
+			if err != nil {
+				return nil, errors.Wrap(err, "rollbackProfileRevision")
+			}
+			_, err = PushGroupProfiles(members, groupProfiles)
+			if err != nil {
+				return nil, errors.Wrap(err, "rollbackProfileRevision")
+			}
+		}
+		return nil, nil
+	}
+
+	return nil, errors.Errorf("rollbackProfileRevision: unknown scope %q", revision.Scope)
+}
+
+func revisionToDeviceProfile(revision types.ProfileRevision) types.DeviceProfile {
+	return types.DeviceProfile{
+		PayloadUUID:       revision.PayloadUUID,
+		HashedPayloadUUID: revision.HashedPayloadUUID,
+		PayloadIdentifier: revision.PayloadIdentifier,
+		MobileconfigData:  revision.MobileconfigData,
+		MobileconfigHash:  revision.MobileconfigHash,
+		Encrypted:         revision.Encrypted,
+		DeviceUDID:        revision.DeviceUDID,
+		Installed:         true,
+	}
+}
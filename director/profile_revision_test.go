@@ -0,0 +1,100 @@
+package director
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestRecordProfileRevision_SkipsUnchanged(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT "mobileconfig_hash","encrypted","device_scope_product_names",.* FROM "profile_revisions" WHERE scope = \$1 AND device_ud_id = \$2 AND group_name = \$3 AND payload_identifier = \$4`).
+		WithArgs("shared", "", "", "com.example.wifi").
+		WillReturnRows(sqlmock.NewRows([]string{"mobileconfig_hash", "encrypted"}).AddRow([]byte("hash"), false))
+
+	err := recordProfileRevision(types.ProfileRevision{
+		Scope:             revisionScopeShared,
+		PayloadIdentifier: "com.example.wifi",
+		MobileconfigHash:  []byte("hash"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestRecordProfileRevision_RecordsChange(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT "mobileconfig_hash","encrypted",.* FROM "profile_revisions"`).
+		WillReturnRows(sqlmock.NewRows([]string{"mobileconfig_hash", "encrypted"}).AddRow([]byte("old"), false))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectQuery(`^INSERT INTO "profile_revisions"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+	mockSpy.ExpectCommit()
+
+	err := recordProfileRevision(types.ProfileRevision{
+		Scope:             revisionScopeShared,
+		PayloadIdentifier: "com.example.wifi",
+		MobileconfigHash:  []byte("new"),
+	})
+	require.NoError(t, err)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestRecordProfileRevision_NoIdentifier(t *testing.T) {
+	require.NoError(t, recordProfileRevision(types.ProfileRevision{Scope: revisionScopeShared}))
+}
+
+func TestRollbackRevision_KeepsDeviceScope(t *testing.T) {
+	revision := types.ProfileRevision{
+		ID:                uuid.New(),
+		CreatedBy:         "alice",
+		Scope:             revisionScopeShared,
+		PayloadIdentifier: "com.example.wifi",
+		HashedPayloadUUID: "hashed",
+		MobileconfigData:  []byte("data"),
+		MobileconfigHash:  []byte("hash"),
+		Encrypted:         true,
+		DeviceScope: types.ProfileScope{
+			ProductNames:   []string{"Mac*"},
+			MinOSVersion:   "14.0",
+			SupervisedOnly: true,
+		},
+	}
+
+	rollback := rollbackRevision(revision, "bob")
+
+	require.Equal(t, "bob", rollback.CreatedBy)
+	require.Equal(t, revision.ID, *rollback.RolledBackFrom)
+	require.Equal(t, revision.DeviceScope, rollback.DeviceScope)
+	require.Equal(t, revision.MobileconfigHash, rollback.MobileconfigHash)
+	require.True(t, rollback.Encrypted)
+}
+
+func TestRequestedBy(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/profile", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.SetBasicAuth("mdmdirector", "secret")
+	require.Equal(t, "mdmdirector (192.0.2.1:1234)", requestedBy(r))
+
+	// the header can't replace the authenticated user
+	r.Header.Set("X-Requested-By", "admin")
+	require.Equal(t, `mdmdirector (192.0.2.1:1234), unverified X-Requested-By "admin"`, requestedBy(r))
+}
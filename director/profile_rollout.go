@@ -0,0 +1,413 @@
+package director
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	intErrors "errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	rolloutActive    = "active"
+	rolloutPaused    = "paused"
+	rolloutComplete  = "complete"
+	rolloutCancelled = "cancelled"
+
+	defaultRolloutIntervalMinutes = 60
+)
+
+// rolloutBucket places a device in one of 100 buckets for a profile. The same device always lands in the same
+// bucket for a given profile, so increasing the percentage only ever adds devices to the rollout.
+func rolloutBucket(payloadIdentifier, udid string) int {
+	sum := sha256.Sum256([]byte(payloadIdentifier + udid))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+func deviceInRollout(rollout types.ProfileRollout, udid string) bool {
+	for _, rolloutUDID := range rollout.DeviceUDIDs {
+		if rolloutUDID == udid {
+			return true
+		}
+	}
+
+	return rolloutBucket(rollout.PayloadIdentifier, udid) < rollout.Percentage
+}
+
+func rolloutToSharedProfile(rollout types.ProfileRollout) types.SharedProfile {
+	return types.SharedProfile{
+		PayloadUUID:       rollout.PayloadUUID,
+		HashedPayloadUUID: rollout.HashedPayloadUUID,
+		PayloadIdentifier: rollout.PayloadIdentifier,
+		MobileconfigData:  rollout.MobileconfigData,
+		MobileconfigHash:  rollout.MobileconfigHash,
+		Encrypted:         rollout.Encrypted,
+		DeviceScope:       rollout.DeviceScope,
+		Installed:         true,
+	}
+}
+
+func validateProfileRolloutPayload(payload types.ProfileRolloutPayload) error {
+	if payload.Percentage < 0 || payload.Percentage > 100 {
+		return errors.New("rollout percentage must be between 0 and 100")
+	}
+
+	if payload.Step < 0 || (payload.Step == 0 && payload.Percentage == 0) {
+		return errors.New("rollout step or percentage must be greater than 0")
+	}
+
+	if payload.MaxErrors < 0 {
+		return errors.New("rollout max_errors cannot be negative")
+	}
+
+	return nil
+}
+
+// StartProfileRollouts creates a rollout for each shared profile and pushes it to the devices in the first wave.
+// Any rollout already running for the same identifier is replaced.
+func StartProfileRollouts(
+	profiles []types.SharedProfile,
+	payload types.ProfileRolloutPayload,
+) ([]types.ProfileRollout, error) {
+	var rollouts []types.ProfileRollout
+
+	err := validateProfileRolloutPayload(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "StartProfileRollouts")
+	}
+
+	step := payload.Step
+	if step <= 0 {
+		step = payload.Percentage
+	}
+
+	intervalMinutes := payload.IntervalMinutes
+	if intervalMinutes <= 0 {
+		intervalMinutes = defaultRolloutIntervalMinutes
+	}
+
+	namedDevices := devicesFromIdentifiers(payload.DeviceUDIDs, payload.SerialNumbers)
+	var namedUDIDs []string
+	for _, device := range namedDevices {
+		namedUDIDs = append(namedUDIDs, device.UDID)
+	}
+
+	identifiers := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		identifiers = append(identifiers, profile.PayloadIdentifier)
+	}
+	err = cancelProfileRollouts(identifiers)
+	if err != nil {
+		return nil, errors.Wrap(err, "StartProfileRollouts")
+	}
+
+	for _, profile := range profiles {
+		rollout := types.ProfileRollout{
+			PayloadIdentifier: profile.PayloadIdentifier,
+			PayloadUUID:       profile.PayloadUUID,
+			HashedPayloadUUID: profile.HashedPayloadUUID,
+			MobileconfigData:  profile.MobileconfigData,
+			MobileconfigHash:  profile.MobileconfigHash,
+			Encrypted:         profile.Encrypted,
+			DeviceScope:       profile.DeviceScope,
+			Status:            rolloutActive,
+			Step:              step,
+			IntervalMinutes:   intervalMinutes,
+			MaxErrors:         payload.MaxErrors,
+			DeviceUDIDs:       namedUDIDs,
+		}
+
+		err := db.DB.Create(&rollout).Error
+		if err != nil {
+			return rollouts, errors.Wrap(err, "StartProfileRollouts: create rollout")
+		}
+
+		InfoLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, ProfileUUID: rollout.HashedPayloadUUID, Message: "Starting profile rollout"})
+		rollout, err = advanceProfileRollout(rollout, payload.Percentage)
+		if err != nil {
+			return rollouts, errors.Wrap(err, "StartProfileRollouts")
+		}
+		rollouts = append(rollouts, rollout)
+	}
+
+	return rollouts, nil
+}
+
+// advanceProfileRollout widens the rollout to the given percentage and pushes the profile to the devices that joined
+func advanceProfileRollout(rollout types.ProfileRollout, percentage int) (types.ProfileRollout, error) {
+	var devices []types.Device
+	var newDevices []types.Device
+
+	if percentage > 100 {
+		percentage = 100
+	}
+
+	err := db.DB.Select("ud_id", "serial_number").Find(&devices).Error
+	if err != nil {
+		return rollout, errors.Wrap(err, "advanceProfileRollout: load devices")
+	}
+
+	// Nothing has been pushed before the first wave, including the named devices
+	firstWave := rollout.NextWaveAt.IsZero()
+	widened := rollout
+	widened.Percentage = percentage
+	for _, device := range devices {
+		if !firstWave && deviceInRollout(rollout, device.UDID) {
+			continue
+		}
+		if deviceInRollout(widened, device.UDID) {
+			newDevices = append(newDevices, device)
+		}
+	}
+
+	InfoLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, ProfileUUID: rollout.HashedPayloadUUID, Message: "Advancing profile rollout", Metric: fmt.Sprintf("%v%%", percentage)})
+
+	widened.NextWaveAt = time.Now().Add(time.Duration(rollout.IntervalMinutes) * time.Minute)
+	if percentage >= 100 {
+		widened.Status = rolloutComplete
+	}
+	err = db.DB.Model(&widened).Select("percentage", "next_wave_at", "status").Updates(&widened).Error
+	if err != nil {
+		return rollout, errors.Wrap(err, "advanceProfileRollout: save rollout")
+	}
+
+	// The candidate becomes the shared profile once every device is in the rollout
+	if widened.Status == rolloutComplete {
+		InfoLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, ProfileUUID: rollout.HashedPayloadUUID, Message: "Profile rollout complete"})
+		err = SaveSharedProfiles([]types.SharedProfile{rolloutToSharedProfile(widened)})
+		if err != nil {
+			return widened, errors.Wrap(err, "advanceProfileRollout")
+		}
+		recordSharedProfileRevisions([]types.SharedProfile{rolloutToSharedProfile(widened)}, "profile rollout "+widened.ID.String(), false)
+	}
+
+	_, err = PushSharedProfiles(newDevices, []types.SharedProfile{rolloutToSharedProfile(widened)})
+	if err != nil {
+		return widened, errors.Wrap(err, "advanceProfileRollout")
+	}
+
+	return widened, nil
+}
+
+// cancelProfileRollouts stops the running rollouts for the identifiers. Devices that already received the
+// candidate are brought back to the shared profile the next time their ProfileList is verified.
+func cancelProfileRollouts(identifiers []string) error {
+	if len(identifiers) == 0 {
+		return nil
+	}
+
+	err := db.DB.Model(&types.ProfileRollout{}).
+		Where("payload_identifier IN ? AND status IN ?", identifiers, []string{rolloutActive, rolloutPaused}).
+		Update("status", rolloutCancelled).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "cancelProfileRollouts")
+	}
+
+	return nil
+}
+
+// activeProfileRollouts returns the rollouts that are still in progress, keyed by payload identifier. Paused
+// rollouts are included so the devices that already have the candidate keep it.
+func activeProfileRollouts() (map[string]types.ProfileRollout, error) {
+	var rollouts []types.ProfileRollout
+
+	err := db.DB.Where("status IN ?", []string{rolloutActive, rolloutPaused}).Find(&rollouts).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "activeProfileRollouts")
+	}
+
+	rolloutsByIdentifier := make(map[string]types.ProfileRollout, len(rollouts))
+	for _, rollout := range rollouts {
+		rolloutsByIdentifier[rollout.PayloadIdentifier] = rollout
+	}
+
+	return rolloutsByIdentifier, nil
+}
+
+// applyProfileRollouts swaps in the rollout candidate for the shared profiles of a device that is part of a rollout
+func applyProfileRollouts(udid string, sharedProfiles []types.SharedProfile) ([]types.SharedProfile, error) {
+	rollouts, err := activeProfileRollouts()
+	if err != nil {
+		return sharedProfiles, err
+	}
+
+	if len(rollouts) == 0 {
+		return sharedProfiles, nil
+	}
+
+	applied := make([]types.SharedProfile, 0, len(sharedProfiles))
+	seen := make(map[string]struct{}, len(sharedProfiles))
+	for _, sharedProfile := range sharedProfiles {
+		seen[sharedProfile.PayloadIdentifier] = struct{}{}
+		rollout, ok := rollouts[sharedProfile.PayloadIdentifier]
+		if ok && deviceInRollout(rollout, udid) {
+			applied = append(applied, rolloutToSharedProfile(rollout))
+			continue
+		}
+		applied = append(applied, sharedProfile)
+	}
+
+	// A profile that is new to the fleet only exists as a rollout candidate
+	for identifier, rollout := range rollouts {
+		if _, ok := seen[identifier]; ok {
+			continue
+		}
+		if deviceInRollout(rollout, udid) {
+			applied = append(applied, rolloutToSharedProfile(rollout))
+		}
+	}
+
+	return applied, nil
+}
+
+// recordProfileRolloutError counts a failed InstallProfile command against the rollout of the profile it carried,
+// pausing the rollout once it reaches the maximum number of errors
+func recordProfileRolloutError(commandUUID string) error {
+	var command types.Command
+	var rollout types.ProfileRollout
+
+	err := db.DB.Select("request_type", "device_ud_id", "profile_identifier").Where("command_uuid = ?", commandUUID).First(&command).Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "recordProfileRolloutError: load command")
+	}
+
+	if command.RequestType != "InstallProfile" || command.ProfileIdentifier == "" {
+		return nil
+	}
+
+	// Templated profiles are sent with a PayloadUUID rendered for each device, so the rollout is found by identifier
+	err = db.DB.Where("payload_identifier = ? AND status = ?", command.ProfileIdentifier, rolloutActive).First(&rollout).Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "recordProfileRolloutError: load rollout")
+	}
+
+	// Devices outside of the rollout were sent the shared profile
+	if !deviceInRollout(rollout, command.DeviceUDID) {
+		return nil
+	}
+
+	err = db.DB.Model(&rollout).Update("error_count", gorm.Expr("error_count + 1")).Error
+	if err != nil {
+		return errors.Wrap(err, "recordProfileRolloutError: increment error count")
+	}
+
+	if rollout.MaxErrors > 0 && rollout.ErrorCount+1 >= rollout.MaxErrors {
+		InfoLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, ProfileUUID: rollout.HashedPayloadUUID, CommandUUID: commandUUID, Message: "Pausing profile rollout, too many errors"})
+		err = db.DB.Model(&rollout).Update("status", rolloutPaused).Error
+		if err != nil {
+			return errors.Wrap(err, "recordProfileRolloutError: pause rollout")
+		}
+	}
+
+	return nil
+}
+
+// ScheduledProfileRollouts advances every active rollout whose next wave is due
+func ScheduledProfileRollouts() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		var rollouts []types.ProfileRollout
+		err := db.DB.Where("status = ? AND next_wave_at <= ?", rolloutActive, time.Now()).Find(&rollouts).Error
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			continue
+		}
+
+		for _, rollout := range rollouts {
+			_, err = advanceProfileRollout(rollout, rollout.Percentage+rollout.Step)
+			if err != nil {
+				ErrorLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, Message: err.Error()})
+			}
+		}
+	}
+}
+
+func GetProfileRolloutsHandler(w http.ResponseWriter, r *http.Request) {
+	var rollouts []types.ProfileRollout
+
+	err := db.DB.Order("created_at desc").Find(&rollouts).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&rollouts, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// PostProfileRolloutActionHandler resumes a paused rollout or cancels a rollout that is in progress
+func PostProfileRolloutActionHandler(w http.ResponseWriter, r *http.Request) {
+	var rollout types.ProfileRollout
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("id = ? AND status IN ?", vars["id"], []string{rolloutActive, rolloutPaused}).First(&rollout).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch vars["action"] {
+	case "resume":
+		// The error count starts again so the rollout is not paused by the errors that paused it before
+		rollout.Status = rolloutActive
+		rollout.ErrorCount = 0
+		err = db.DB.Model(&rollout).Select("status", "error_count").Updates(&rollout).Error
+	case "cancel":
+		rollout.Status = rolloutCancelled
+		err = db.DB.Model(&rollout).Update("status", rolloutCancelled).Error
+	default:
+		http.Error(w, "action must be resume or cancel", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	InfoLogger(LogHolder{ProfileIdentifier: rollout.PayloadIdentifier, ProfileUUID: rollout.HashedPayloadUUID, Message: "Profile rollout " + rollout.Status})
+
+	output, err := json.MarshalIndent(&rollout, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
@@ -0,0 +1,98 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestDeviceInRollout(t *testing.T) {
+	rollout := types.ProfileRollout{PayloadIdentifier: "com.example.wifi", Percentage: 30}
+	widened := rollout
+	widened.Percentage = 60
+
+	udids := []string{"1234-5678-123456", "2234-5678-123456", "3234-5678-123456", "4234-5678-123456", "5234-5678-123456"}
+	for _, udid := range udids {
+		// Devices never drop out of a rollout when it advances
+		if deviceInRollout(rollout, udid) {
+			assert.True(t, deviceInRollout(widened, udid))
+		}
+		assert.Equal(t, rolloutBucket(rollout.PayloadIdentifier, udid), rolloutBucket(rollout.PayloadIdentifier, udid))
+	}
+
+	none := types.ProfileRollout{PayloadIdentifier: "com.example.wifi", DeviceUDIDs: pq.StringArray{"1234-5678-123456"}}
+	assert.True(t, deviceInRollout(none, "1234-5678-123456"))
+	assert.False(t, deviceInRollout(none, "2234-5678-123456"))
+
+	all := types.ProfileRollout{PayloadIdentifier: "com.example.wifi", Percentage: 100}
+	for _, udid := range udids {
+		assert.True(t, deviceInRollout(all, udid))
+	}
+}
+
+func TestValidateProfileRolloutPayload(t *testing.T) {
+	assert.NoError(t, validateProfileRolloutPayload(types.ProfileRolloutPayload{Percentage: 10}))
+	assert.NoError(t, validateProfileRolloutPayload(types.ProfileRolloutPayload{Step: 25}))
+	assert.Error(t, validateProfileRolloutPayload(types.ProfileRolloutPayload{}))
+	assert.Error(t, validateProfileRolloutPayload(types.ProfileRolloutPayload{Percentage: 110}))
+	assert.Error(t, validateProfileRolloutPayload(types.ProfileRolloutPayload{Percentage: 10, MaxErrors: -1}))
+}
+
+func TestRecordProfileRolloutError_TemplatedProfile(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	rolloutID := uuid.New()
+	// The command carries the PayloadUUID rendered for the device, not the one of the rollout
+	mockSpy.ExpectQuery(`^SELECT "request_type","device_ud_id","profile_identifier" FROM "commands" WHERE command_uuid = \$1`).
+		WithArgs("command-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_type", "device_ud_id", "profile_identifier"}).
+			AddRow("InstallProfile", "1234-5678-123456", "com.example.wifi"))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "profile_rollouts" WHERE payload_identifier = \$1 AND status = \$2`).
+		WithArgs("com.example.wifi", rolloutActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload_identifier", "hashed_payload_uuid", "status", "percentage", "max_errors", "error_count"}).
+			AddRow(rolloutID, "com.example.wifi", "template-uuid", rolloutActive, 100, 2, 1))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "profile_rollouts" SET "error_count"=error_count \+ 1`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "profile_rollouts" SET "status"=\$1`).
+		WithArgs(rolloutPaused, sqlmock.AnyArg(), rolloutID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+
+	require.NoError(t, recordProfileRolloutError("command-1"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestRecordProfileRolloutError_DeviceOutsideRollout(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT "request_type","device_ud_id","profile_identifier" FROM "commands" WHERE command_uuid = \$1`).
+		WithArgs("command-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_type", "device_ud_id", "profile_identifier"}).
+			AddRow("InstallProfile", "1234-5678-123456", "com.example.wifi"))
+	mockSpy.ExpectQuery(`^SELECT \* FROM "profile_rollouts" WHERE payload_identifier = \$1 AND status = \$2`).
+		WithArgs("com.example.wifi", rolloutActive).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "payload_identifier", "status", "percentage", "max_errors"}).
+			AddRow(uuid.New(), "com.example.wifi", rolloutActive, 0, 1))
+
+	require.NoError(t, recordProfileRolloutError("command-1"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
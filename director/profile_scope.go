@@ -0,0 +1,135 @@
+package director
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+)
+
+func profileScopeSet(scope types.ProfileScope) bool {
+	return len(scope.ProductNames) > 0 || len(scope.Models) > 0 || scope.MinOSVersion != "" ||
+		scope.MaxOSVersion != "" || scope.SupervisedOnly
+}
+
+func profileScopeEqual(a, b types.ProfileScope) bool {
+	return strings.Join(a.ProductNames, "\n") == strings.Join(b.ProductNames, "\n") &&
+		strings.Join(a.Models, "\n") == strings.Join(b.Models, "\n") &&
+		a.MinOSVersion == b.MinOSVersion &&
+		a.MaxOSVersion == b.MaxOSVersion &&
+		a.SupervisedOnly == b.SupervisedOnly
+}
+
+func validateProfileScope(scope types.ProfileScope) error {
+	for _, pattern := range append(append([]string{}, scope.ProductNames...), scope.Models...) {
+		if strings.TrimSpace(pattern) == "" {
+			return errors.New("empty product name or model pattern")
+		}
+	}
+
+	var minVersion, maxVersion *version.Version
+	var err error
+	if scope.MinOSVersion != "" {
+		minVersion, err = version.NewVersion(scope.MinOSVersion)
+		if err != nil {
+			return errors.Wrap(err, "invalid min_os_version")
+		}
+	}
+	if scope.MaxOSVersion != "" {
+		maxVersion, err = version.NewVersion(scope.MaxOSVersion)
+		if err != nil {
+			return errors.Wrap(err, "invalid max_os_version")
+		}
+	}
+	if minVersion != nil && maxVersion != nil && minVersion.GreaterThan(maxVersion) {
+		return errors.New("min_os_version is greater than max_os_version")
+	}
+
+	return nil
+}
+
+// patternMatches matches a value against a pattern where * matches any characters, including the / in model
+// numbers, and ? matches a single character
+func patternMatches(pattern string, value string) bool {
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.ReplaceAll(expression, `\*`, ".*")
+	expression = strings.ReplaceAll(expression, `\?`, ".")
+
+	matched, err := regexp.MatchString("^"+expression+"$", value)
+	return err == nil && matched
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if patternMatches(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deviceInProfileScope reports whether a shared profile applies to the device. A device that hasn't reported the
+// information a constraint needs is out of scope until it has.
+func deviceInProfileScope(scope types.ProfileScope, device types.Device) bool {
+	if len(scope.ProductNames) > 0 && !matchesAnyPattern(scope.ProductNames, device.ProductName) {
+		return false
+	}
+
+	if len(scope.Models) > 0 && !matchesAnyPattern(scope.Models, device.Model) {
+		return false
+	}
+
+	if scope.SupervisedOnly && !device.IsSupervised {
+		return false
+	}
+
+	if scope.MinOSVersion != "" || scope.MaxOSVersion != "" {
+		osVersion, err := version.NewVersion(device.OSVersion)
+		if err != nil {
+			return false
+		}
+		if scope.MinOSVersion != "" {
+			minVersion, err := version.NewVersion(scope.MinOSVersion)
+			if err != nil || osVersion.LessThan(minVersion) {
+				return false
+			}
+		}
+		if scope.MaxOSVersion != "" {
+			maxVersion, err := version.NewVersion(scope.MaxOSVersion)
+			if err != nil || osVersion.GreaterThan(maxVersion) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// scopedDevice returns the device with the fields a scope is matched against. Devices are often loaded with only
+// their identifiers, those are loaded again.
+func scopedDevice(scope types.ProfileScope, device types.Device) (types.Device, error) {
+	if !profileScopeSet(scope) || device.ProductName != "" || device.OSVersion != "" {
+		return device, nil
+	}
+
+	loaded, err := GetDevice(device.UDID)
+	if err != nil {
+		return device, errors.Wrap(err, "scopedDevice")
+	}
+
+	return loaded, nil
+}
+
+// recordProfileNotApplicable marks a shared profile as not applicable to a device outside of its scope
+func recordProfileNotApplicable(device types.Device, identifier string) {
+	err := setProfileAssignment(device.UDID, identifier, map[string]interface{}{
+		"status": assignmentNotApplicable,
+		"error":  "",
+	})
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, ProfileIdentifier: identifier, Message: err.Error()})
+	}
+}
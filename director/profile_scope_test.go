@@ -0,0 +1,46 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceInProfileScope(t *testing.T) {
+	mac := types.Device{ProductName: "MacBookPro18,3", Model: "MK1E3LL/A", OSVersion: "14.2.1"}
+	iPhone := types.Device{ProductName: "iPhone14,2", Model: "MLTT3LL/A", OSVersion: "17.1", IsSupervised: true}
+
+	tests := []struct {
+		name     string
+		scope    types.ProfileScope
+		device   types.Device
+		expected bool
+	}{
+		{"no scope", types.ProfileScope{}, iPhone, true},
+		{"product name matches", types.ProfileScope{ProductNames: []string{"Mac*"}}, mac, true},
+		{"product name does not match", types.ProfileScope{ProductNames: []string{"Mac*"}}, iPhone, false},
+		{"any product name", types.ProfileScope{ProductNames: []string{"iPad*", "iPhone*"}}, iPhone, true},
+		{"model", types.ProfileScope{Models: []string{"MK1E3*"}}, mac, true},
+		{"minimum OS version", types.ProfileScope{MinOSVersion: "14"}, mac, true},
+		{"below minimum OS version", types.ProfileScope{MinOSVersion: "14.3"}, mac, false},
+		{"maximum OS version", types.ProfileScope{MaxOSVersion: "17.1"}, iPhone, true},
+		{"above maximum OS version", types.ProfileScope{MaxOSVersion: "16"}, iPhone, false},
+		{"unknown OS version", types.ProfileScope{MinOSVersion: "10"}, types.Device{}, false},
+		{"supervised", types.ProfileScope{SupervisedOnly: true}, iPhone, true},
+		{"unsupervised", types.ProfileScope{SupervisedOnly: true}, mac, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, deviceInProfileScope(tt.scope, tt.device))
+		})
+	}
+}
+
+func TestValidateProfileScope(t *testing.T) {
+	require.NoError(t, validateProfileScope(types.ProfileScope{ProductNames: []string{"Mac*"}, MinOSVersion: "13", MaxOSVersion: "14.5"}))
+	require.Error(t, validateProfileScope(types.ProfileScope{Models: []string{""}}))
+	require.Error(t, validateProfileScope(types.ProfileScope{MinOSVersion: "latest"}))
+	require.Error(t, validateProfileScope(types.ProfileScope{MinOSVersion: "14", MaxOSVersion: "13"}))
+}
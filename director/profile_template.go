@@ -0,0 +1,252 @@
+package director
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+
+	"gorm.io/gorm"
+)
+
+// templateVariable matches placeholders such as ${SERIAL_NUMBER} in a mobileconfig. The braces keep a placeholder
+// apart from the text around it and from literal $ in scripts.
+var templateVariable = regexp.MustCompile(`\$\{([A-Z][A-Z0-9_]*)\}`)
+
+var deviceAttributeName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// builtinTemplateVariables are filled in from the device inventory. Custom attributes cannot use these names.
+var builtinTemplateVariables = map[string]func(device types.Device) string{
+	"UDID":            func(device types.Device) string { return device.UDID },
+	"SERIAL_NUMBER":   func(device types.Device) string { return device.SerialNumber },
+	"DEVICE_NAME":     func(device types.Device) string { return device.DeviceName },
+	"HOST_NAME":       func(device types.Device) string { return device.HostName },
+	"LOCAL_HOST_NAME": func(device types.Device) string { return device.LocalHostName },
+	"MODEL_NAME":      func(device types.Device) string { return device.ModelName },
+	"PRODUCT_NAME":    func(device types.Device) string { return device.ProductName },
+	"OS_VERSION":      func(device types.Device) string { return device.OSVersion },
+}
+
+func isProfileTemplate(mobileconfig []byte) bool {
+	return templateVariable.Match(mobileconfig)
+}
+
+// templateValueCache holds the template values of each device, keyed by UDID. Values are loaded the first time one
+// of the device's profiles has placeholders, so pushing many profiles to a device queries them once.
+type templateValueCache map[string]map[string]string
+
+// renderProfile expands the placeholders in a profile for a device. The top level PayloadUUID of the rendered
+// profile is a hash of the rendered content, so validateProfileInProfileList compares against what the device
+// actually received. Profiles without any placeholders, or whose placeholders are all unknown, are returned
+// unchanged along with their original hashed PayloadUUID.
+func (templates templateValueCache) renderProfile(device types.Device, mobileconfig []byte, hashedPayloadUUID string) ([]byte, string, error) {
+	if !isProfileTemplate(mobileconfig) {
+		return mobileconfig, hashedPayloadUUID, nil
+	}
+
+	values, ok := templates[device.UDID]
+	if !ok {
+		var err error
+		values, err = templateValues(device)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "renderProfile")
+		}
+		templates[device.UDID] = values
+	}
+
+	return renderTemplate(mobileconfig, hashedPayloadUUID, values)
+}
+
+func renderTemplate(mobileconfig []byte, hashedPayloadUUID string, values map[string]string) ([]byte, string, error) {
+	substituted := false
+	rendered := templateVariable.ReplaceAllFunc(mobileconfig, func(match []byte) []byte {
+		value, ok := values[string(match[2:len(match)-1])]
+		if !ok {
+			return match
+		}
+		substituted = true
+		var escaped bytes.Buffer
+		_ = xml.EscapeText(&escaped, []byte(value))
+		return escaped.Bytes()
+	})
+
+	if !substituted {
+		return mobileconfig, hashedPayloadUUID, nil
+	}
+
+	var profileDict map[string]interface{}
+	err := plist.Unmarshal(rendered, &profileDict)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "renderTemplate: rendered profile is not a valid plist")
+	}
+
+	renderedPayloadUUID := uuid.NewSHA1(uuid.NameSpaceDNS, rendered).String()
+	profileDict["PayloadUUID"] = renderedPayloadUUID
+
+	rendered, err = plist.MarshalIndent(&profileDict, "\t")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "renderTemplate")
+	}
+
+	return rendered, renderedPayloadUUID, nil
+}
+
+// templateValues returns every value that can be substituted into a profile for the device
+func templateValues(device types.Device) (map[string]string, error) {
+	var attributes []types.DeviceAttribute
+
+	// Callers often only load the UDID and serial number
+	if device.UDID != "" {
+		fullDevice, err := GetDevice(device.UDID)
+		if err != nil {
+			return nil, errors.Wrap(err, "templateValues")
+		}
+		device = fullDevice
+	}
+
+	values := make(map[string]string, len(builtinTemplateVariables))
+	err := db.DB.Where("device_ud_id = ?", device.UDID).Find(&attributes).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "templateValues: load device attributes")
+	}
+	for _, attribute := range attributes {
+		values[attribute.Name] = attribute.Value
+	}
+
+	for name, value := range builtinTemplateVariables {
+		values[name] = value(device)
+	}
+
+	return values, nil
+}
+
+// renderProfileForVerification renders a profile that should be installed so it can be compared with the ProfileList
+func (templates templateValueCache) renderProfileForVerification(
+	device types.Device,
+	profileForVerification ProfileForVerification,
+) (ProfileForVerification, error) {
+	if !profileForVerification.Installed {
+		return profileForVerification, nil
+	}
+
+	rendered, renderedPayloadUUID, err := templates.renderProfile(
+		device,
+		profileForVerification.MobileconfigData,
+		profileForVerification.HashedPayloadUUID,
+	)
+	if err != nil {
+		return profileForVerification, err
+	}
+
+	profileForVerification.MobileconfigData = rendered
+	profileForVerification.HashedPayloadUUID = renderedPayloadUUID
+
+	return profileForVerification, nil
+}
+
+func validateDeviceAttributeName(name string) error {
+	if !deviceAttributeName.MatchString(name) {
+		return errors.Errorf("attribute name %q must be upper case letters, digits and underscores", name)
+	}
+
+	if _, ok := builtinTemplateVariables[name]; ok {
+		return errors.Errorf("attribute name %q is reserved", name)
+	}
+
+	return nil
+}
+
+func GetDeviceAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	var attributes []types.DeviceAttribute
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("device_ud_id = ?", vars["udid"]).Order("name").Find(&attributes).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&attributes, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// PostDeviceAttributesHandler sets custom attributes on a device. With push_now a ProfileList is requested, so
+// profiles using the attributes are reinstalled with the new values.
+func PostDeviceAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.DeviceAttributesPayload
+	vars := mux.Vars(r)
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	device, err := GetDevice(vars["udid"])
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	for name := range out.Attributes {
+		err = validateDeviceAttributeName(strings.TrimPrefix(name, "$"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	for name, value := range out.Attributes {
+		attribute := types.DeviceAttribute{DeviceUDID: device.UDID, Name: strings.TrimPrefix(name, "$"), Value: value}
+		err = db.DB.Save(&attribute).Error
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if out.PushNow {
+		err = RequestProfileList(device)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+		}
+	}
+}
+
+func DeleteDeviceAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	result := db.DB.Where("device_ud_id = ? AND name = ?", vars["udid"], vars["name"]).Delete(&types.DeviceAttribute{})
+	if result.Error != nil {
+		ErrorLogger(LogHolder{DeviceUDID: vars["udid"], Message: result.Error.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		ErrorLogger(LogHolder{DeviceUDID: vars["udid"], Message: gorm.ErrRecordNotFound.Error()})
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
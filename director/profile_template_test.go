@@ -0,0 +1,120 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const testTemplateProfile = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>HostName</key>
+			<string>${SERIAL_NUMBER}.example.com</string>
+			<key>Email</key>
+			<string>${EMAIL}</string>
+			<key>Script</key>
+			<string>echo $HOME $SERIAL_NUMBER ${UNKNOWN}</string>
+			<key>Suffix</key>
+			<string>${SERIAL_NUMBER}_SUFFIX</string>
+		</dict>
+	</array>
+	<key>PayloadIdentifier</key>
+	<string>com.example.template</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>template-uuid</string>
+</dict>
+</plist>`
+
+func TestRenderTemplate(t *testing.T) {
+	values := map[string]string{
+		"SERIAL_NUMBER": "C02ABCDEFGH",
+		"EMAIL":         "a&b@example.com",
+	}
+
+	rendered, renderedPayloadUUID, err := renderTemplate([]byte(testTemplateProfile), "template-uuid", values)
+	require.NoError(t, err)
+	require.NotEqual(t, "template-uuid", renderedPayloadUUID)
+
+	var profile struct {
+		PayloadUUID    string
+		PayloadContent []map[string]string
+	}
+	require.NoError(t, plist.Unmarshal(rendered, &profile))
+	require.Equal(t, renderedPayloadUUID, profile.PayloadUUID)
+	require.Equal(t, "C02ABCDEFGH.example.com", profile.PayloadContent[0]["HostName"])
+	require.Equal(t, "a&b@example.com", profile.PayloadContent[0]["Email"])
+	require.Equal(t, "C02ABCDEFGH_SUFFIX", profile.PayloadContent[0]["Suffix"])
+	// unknown placeholders and $ without braces are left alone
+	require.Equal(t, "echo $HOME $SERIAL_NUMBER ${UNKNOWN}", profile.PayloadContent[0]["Script"])
+
+	// the same values always render to the same PayloadUUID
+	_, again, err := renderTemplate([]byte(testTemplateProfile), "template-uuid", values)
+	require.NoError(t, err)
+	require.Equal(t, renderedPayloadUUID, again)
+
+	values["SERIAL_NUMBER"] = "C02ZYXWVUTS"
+	_, other, err := renderTemplate([]byte(testTemplateProfile), "template-uuid", values)
+	require.NoError(t, err)
+	require.NotEqual(t, renderedPayloadUUID, other)
+}
+
+func TestRenderTemplate_NoSubstitution(t *testing.T) {
+	rendered, renderedPayloadUUID, err := renderTemplate([]byte(testTemplateProfile), "template-uuid", map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, "template-uuid", renderedPayloadUUID)
+	require.Equal(t, testTemplateProfile, string(rendered))
+}
+
+func TestTemplateValueCache_LoadsValuesOnce(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	device := types.Device{UDID: "1234-5678-123456"}
+	deviceRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"ud_id", "serial_number"}).AddRow(device.UDID, "C02ABCDEFGH")
+	}
+	mockSpy.ExpectQuery(`^SELECT \* FROM "devices" WHERE ud_id = \$1`).WillReturnRows(deviceRows())
+	mockSpy.ExpectQuery(`^SELECT \* FROM "devices" WHERE ud_id = \$1`).WillReturnRows(deviceRows())
+	mockSpy.ExpectQuery(`^SELECT \* FROM "device_attributes" WHERE device_ud_id = \$1`).
+		WithArgs(device.UDID).
+		WillReturnRows(sqlmock.NewRows([]string{"device_ud_id", "name", "value"}).AddRow(device.UDID, "EMAIL", "a@example.com"))
+
+	templates := make(templateValueCache)
+
+	// profiles without placeholders never load the values
+	plain := []byte(`<plist version="1.0"><dict><key>PayloadUUID</key><string>plain-uuid</string></dict></plist>`)
+	_, plainPayloadUUID, err := templates.renderProfile(device, plain, "plain-uuid")
+	require.NoError(t, err)
+	require.Equal(t, "plain-uuid", plainPayloadUUID)
+
+	for i := 0; i < 2; i++ {
+		_, renderedPayloadUUID, err := templates.renderProfile(device, []byte(testTemplateProfile), "template-uuid")
+		require.NoError(t, err)
+		require.NotEqual(t, "template-uuid", renderedPayloadUUID)
+	}
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestValidateDeviceAttributeName(t *testing.T) {
+	require.NoError(t, validateDeviceAttributeName("EMAIL"))
+	require.NoError(t, validateDeviceAttributeName("ASSET_TAG_2"))
+	require.Error(t, validateDeviceAttributeName("email"))
+	require.Error(t, validateDeviceAttributeName("ASSET TAG"))
+	require.Error(t, validateDeviceAttributeName("SERIAL_NUMBER"))
+}
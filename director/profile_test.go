@@ -255,3 +255,53 @@ func TestValidateProfileInProfileList(t *testing.T) {
 		})
 	}
 }
+
+func TestProfilePlanner(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	if flag.Lookup("sign") == nil {
+		flag.Bool("sign", false, "")
+	}
+
+	device := types.Device{UDID: "1234-5678-123456", SerialNumber: "C02ABCDEFGH"}
+	planner := &profilePlanner{
+		plans: make(map[string]*types.ProfilePlan),
+		profileLists: map[string][]types.ProfileList{
+			device.UDID: {
+				{PayloadIdentifier: "com.example.current", PayloadUUID: "current-uuid"},
+				{PayloadIdentifier: "com.example.outdated", PayloadUUID: "old-uuid"},
+				{PayloadIdentifier: "com.example.removed", PayloadUUID: "removed-uuid"},
+			},
+		},
+	}
+
+	profiles := []ProfileForVerification{
+		{PayloadIdentifier: "com.example.current", HashedPayloadUUID: "current-uuid", Installed: true, Type: "device"},
+		{PayloadIdentifier: "com.example.outdated", HashedPayloadUUID: "new-uuid", Installed: true, Type: "shared"},
+		{PayloadIdentifier: "com.example.missing", HashedPayloadUUID: "missing-uuid", Installed: true, Type: "group"},
+		{PayloadIdentifier: "com.example.removed", Installed: false, Type: "device"},
+		{PayloadIdentifier: "com.example.gone", Installed: false, Type: "device"},
+	}
+	for _, profile := range profiles {
+		require.NoError(t, planner.plan(device, profile))
+	}
+	planner.add(device, ProfileForVerification{PayloadIdentifier: "com.example.overridden", Type: "shared"}, planNotApplicable)
+
+	plans := planner.result()
+	require.Len(t, plans, 1)
+	require.Equal(t, device.SerialNumber, plans[0].SerialNumber)
+
+	actions := make(map[string]string)
+	for _, item := range plans[0].Profiles {
+		actions[item.PayloadIdentifier] = item.Action
+	}
+	require.Equal(t, map[string]string{
+		"com.example.current":    planUnchanged,
+		"com.example.outdated":   planInstall,
+		"com.example.missing":    planInstall,
+		"com.example.removed":    planRemove,
+		"com.example.gone":       planUnchanged,
+		"com.example.overridden": planNotApplicable,
+	}, actions)
+}
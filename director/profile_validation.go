@@ -0,0 +1,227 @@
+package director
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+// enrollmentProfileIdentifiers returns the PayloadIdentifier of the enrollment profile and of each of its payloads.
+// Uploaded profiles must not reuse them, or installing the profile would replace or break the MDM enrollment.
+func enrollmentProfileIdentifiers() (map[string]struct{}, error) {
+	identifiers := make(map[string]struct{})
+
+	enrollmentProfile := utils.EnrollmentProfile()
+	if enrollmentProfile == "" || !utils.FileExists(enrollmentProfile) {
+		return identifiers, nil
+	}
+
+	data, err := os.ReadFile(enrollmentProfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "enrollmentProfileIdentifiers: read enrollment profile")
+	}
+
+	if utils.SignedEnrollmentProfile() {
+		p7, err := pkcs7.Parse(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "enrollmentProfileIdentifiers: parse signed enrollment profile")
+		}
+		data = p7.Content
+	}
+
+	var profile struct {
+		PayloadIdentifier string
+		PayloadContent    []struct {
+			PayloadIdentifier string
+		}
+	}
+	err = plist.Unmarshal(data, &profile)
+	if err != nil {
+		return nil, errors.Wrap(err, "enrollmentProfileIdentifiers: unmarshal enrollment profile")
+	}
+
+	if profile.PayloadIdentifier != "" {
+		identifiers[profile.PayloadIdentifier] = struct{}{}
+	}
+	for _, payload := range profile.PayloadContent {
+		if payload.PayloadIdentifier != "" {
+			identifiers[payload.PayloadIdentifier] = struct{}{}
+		}
+	}
+
+	return identifiers, nil
+}
+
+// validateMobileconfigs checks each base64 encoded mobileconfig of a request and returns every problem found
+func validateMobileconfigs(mobileconfigs []string) ([]types.ProfileValidationIssue, error) {
+	var issues []types.ProfileValidationIssue
+
+	if len(mobileconfigs) == 0 {
+		issues = append(issues, types.ProfileValidationIssue{Field: "profiles", Message: "no profiles were provided"})
+		return issues, nil
+	}
+
+	enrollmentIdentifiers, err := enrollmentProfileIdentifiers()
+	if err != nil {
+		return nil, errors.Wrap(err, "validateMobileconfigs")
+	}
+
+	seenIdentifiers := make(map[string]int)
+	for i, payload := range mobileconfigs {
+		mobileconfig, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			issues = append(issues, types.ProfileValidationIssue{Profile: i, Message: "profile is not valid base64"})
+			continue
+		}
+
+		profileIssues, identifier := validateMobileconfig(mobileconfig, enrollmentIdentifiers)
+		for j := range profileIssues {
+			profileIssues[j].Profile = i
+		}
+		issues = append(issues, profileIssues...)
+
+		if identifier == "" {
+			continue
+		}
+		if first, ok := seenIdentifiers[identifier]; ok {
+			issues = append(issues, types.ProfileValidationIssue{
+				Profile:           i,
+				PayloadIdentifier: identifier,
+				Field:             "PayloadIdentifier",
+				Message:           fmt.Sprintf("PayloadIdentifier is also used by profile %v in this request", first),
+			})
+			continue
+		}
+		seenIdentifiers[identifier] = i
+	}
+
+	return issues, nil
+}
+
+// validateMobileconfig checks a single decoded mobileconfig, returning the problems found and its PayloadIdentifier
+func validateMobileconfig(
+	mobileconfig []byte,
+	enrollmentIdentifiers map[string]struct{},
+) ([]types.ProfileValidationIssue, string) {
+	var issues []types.ProfileValidationIssue
+	var profile map[string]interface{}
+
+	err := plist.Unmarshal(mobileconfig, &profile)
+	if err != nil {
+		issues = append(issues, types.ProfileValidationIssue{Message: "profile is not a valid property list: " + err.Error()})
+		return issues, ""
+	}
+
+	identifier, _ := profile["PayloadIdentifier"].(string)
+	addIssue := func(field, message string) {
+		issues = append(issues, types.ProfileValidationIssue{PayloadIdentifier: identifier, Field: field, Message: message})
+	}
+
+	if identifier == "" {
+		addIssue("PayloadIdentifier", "PayloadIdentifier is missing")
+	}
+	if payloadType, _ := profile["PayloadType"].(string); payloadType == "" {
+		addIssue("PayloadType", "PayloadType is missing")
+	}
+
+	if _, ok := enrollmentIdentifiers[identifier]; ok && identifier != "" {
+		addIssue("PayloadIdentifier", "PayloadIdentifier is used by the enrollment profile")
+	}
+
+	content, ok := profile["PayloadContent"]
+	if !ok {
+		addIssue("PayloadContent", "PayloadContent is missing")
+		return issues, identifier
+	}
+
+	payloads, ok := content.([]interface{})
+	if !ok {
+		addIssue("PayloadContent", "PayloadContent must be an array")
+		return issues, identifier
+	}
+
+	seenUUIDs := make(map[string]int)
+	for i, item := range payloads {
+		field := fmt.Sprintf("PayloadContent[%v]", i)
+		payload, ok := item.(map[string]interface{})
+		if !ok {
+			addIssue(field, "payload must be a dictionary")
+			continue
+		}
+
+		if payloadType, _ := payload["PayloadType"].(string); payloadType == "" {
+			addIssue(field+".PayloadType", "PayloadType is missing")
+		}
+
+		if payloadIdentifier, _ := payload["PayloadIdentifier"].(string); payloadIdentifier != "" {
+			if _, ok := enrollmentIdentifiers[payloadIdentifier]; ok {
+				addIssue(field+".PayloadIdentifier", fmt.Sprintf("PayloadIdentifier %v is used by the enrollment profile", payloadIdentifier))
+			}
+		}
+
+		payloadUUID, _ := payload["PayloadUUID"].(string)
+		if payloadUUID == "" {
+			continue
+		}
+		if first, ok := seenUUIDs[payloadUUID]; ok {
+			addIssue(field+".PayloadUUID", fmt.Sprintf("PayloadUUID %v is also used by PayloadContent[%v]", payloadUUID, first))
+			continue
+		}
+		seenUUIDs[payloadUUID] = i
+	}
+
+	return issues, identifier
+}
+
+func writeProfileValidation(w http.ResponseWriter, issues []types.ProfileValidationIssue, status int) {
+	response := types.ProfileValidationResponse{
+		Valid:  len(issues) == 0,
+		Errors: issues,
+	}
+	if response.Errors == nil {
+		response.Errors = []types.ProfileValidationIssue{}
+	}
+
+	output, err := json.MarshalIndent(&response, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// ValidateProfileHandler runs the upload checks against the profiles of a request without saving anything
+func ValidateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.ProfilePayload
+
+	err := json.NewDecoder(r.Body).Decode(&out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	issues, err := validateMobileconfigs(out.Mobileconfigs)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeProfileValidation(w, issues, http.StatusOK)
+}
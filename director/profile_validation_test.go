@@ -0,0 +1,95 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testMobileconfig(body string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+` + body + `
+</dict>
+</plist>`)
+}
+
+func TestValidateMobileconfig(t *testing.T) {
+	enrollmentIdentifiers := map[string]struct{}{
+		"com.example.enrollment":     {},
+		"com.example.enrollment.mdm": {},
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		identifier string
+		fields     []string
+	}{
+		{
+			name: "valid profile",
+			body: `<key>PayloadIdentifier</key><string>com.example.wifi</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><array>
+<dict><key>PayloadType</key><string>com.apple.wifi.managed</string><key>PayloadUUID</key><string>A</string></dict>
+<dict><key>PayloadType</key><string>com.apple.vpn.managed</string><key>PayloadUUID</key><string>B</string></dict>
+</array>`,
+			identifier: "com.example.wifi",
+		},
+		{
+			name:   "missing required keys",
+			body:   `<key>PayloadDisplayName</key><string>Empty</string>`,
+			fields: []string{"PayloadIdentifier", "PayloadType", "PayloadContent"},
+		},
+		{
+			name: "duplicate nested PayloadUUID",
+			body: `<key>PayloadIdentifier</key><string>com.example.wifi</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><array>
+<dict><key>PayloadType</key><string>com.apple.wifi.managed</string><key>PayloadUUID</key><string>A</string></dict>
+<dict><key>PayloadType</key><string>com.apple.vpn.managed</string><key>PayloadUUID</key><string>A</string></dict>
+</array>`,
+			identifier: "com.example.wifi",
+			fields:     []string{"PayloadContent[1].PayloadUUID"},
+		},
+		{
+			name: "PayloadContent is not an array",
+			body: `<key>PayloadIdentifier</key><string>com.example.wifi</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><string>nope</string>`,
+			identifier: "com.example.wifi",
+			fields:     []string{"PayloadContent"},
+		},
+		{
+			name: "collides with enrollment profile",
+			body: `<key>PayloadIdentifier</key><string>com.example.enrollment</string>
+<key>PayloadType</key><string>Configuration</string>
+<key>PayloadContent</key><array>
+<dict><key>PayloadType</key><string>com.apple.mdm</string><key>PayloadIdentifier</key><string>com.example.enrollment.mdm</string></dict>
+</array>`,
+			identifier: "com.example.enrollment",
+			fields:     []string{"PayloadIdentifier", "PayloadContent[0].PayloadIdentifier"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issues, identifier := validateMobileconfig(testMobileconfig(test.body), enrollmentIdentifiers)
+			require.Equal(t, test.identifier, identifier)
+
+			var fields []string
+			for _, issue := range issues {
+				fields = append(fields, issue.Field)
+			}
+			require.Equal(t, test.fields, fields)
+		})
+	}
+}
+
+func TestValidateMobileconfig_NotAPlist(t *testing.T) {
+	issues, identifier := validateMobileconfig([]byte("not a plist"), nil)
+	require.Empty(t, identifier)
+	require.Len(t, issues, 1)
+}
@@ -30,6 +30,55 @@ var (
 		Help:      "Number of InstallApplications pushed.",
 	})
 
+	SignedProfileCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "signed_profile_cache",
+		Name:      "hits_total",
+		Help:      "Number of profiles that were signed already and served from the cache.",
+	})
+
+	SignedProfileCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "signed_profile_cache",
+		Name:      "misses_total",
+		Help:      "Number of profiles that had to be signed.",
+	})
+
+	CommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "commands",
+		Name:      "errors_total",
+		Help:      "Number of Error responses to commands by the domain and code of the first error in the ErrorChain.",
+	}, []string{"domain", "code"})
+
+	DuplicateWebhookEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "webhook",
+		Name:      "duplicate_events_total",
+		Help:      "Number of webhook events that were delivered again and skipped.",
+	})
+
+	WebhookDeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "webhook",
+		Name:      "dead_letters_total",
+		Help:      "Number of webhook events that failed every retry and were saved as dead letters.",
+	})
+
+	RejectedWebhookEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "webhook",
+		Name:      "rejected_events_total",
+		Help:      "Number of webhook requests that failed validation.",
+	})
+
+	WebhookAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "micromdm",
+		Subsystem: "webhook",
+		Name:      "auth_failures_total",
+		Help:      "Number of webhook requests that failed verification, by the verification that failed.",
+	}, []string{"mode"})
+
 	TotalPushes60s               float64
 	ProfilesPushed60s            float64
 	InstallApplicationsPushed60s float64
@@ -41,6 +90,13 @@ func Metrics() {
 	prometheus.MustRegister(TotalPushes)
 	prometheus.MustRegister(ProfilesPushed)
 	prometheus.MustRegister(InstallApplicationsPushed)
+	prometheus.MustRegister(SignedProfileCacheHits)
+	prometheus.MustRegister(SignedProfileCacheMisses)
+	prometheus.MustRegister(CommandErrors)
+	prometheus.MustRegister(DuplicateWebhookEvents)
+	prometheus.MustRegister(WebhookDeadLetters)
+	prometheus.MustRegister(RejectedWebhookEvents)
+	prometheus.MustRegister(WebhookAuthFailures)
 }
 
 func totalDevices() {
@@ -107,6 +107,17 @@ func processScheduledCheckin(pushQueue taskq.Queue, task *taskq.Task, onceIn tim
 		return errors.Wrap(err, "processScheduledCheckin::CleanupNullProfileLists")
 	}
 
+	// The history is only housekeeping, the cleanup after it still runs if it can't be pruned
+	err = pruneCommandEvents()
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "processScheduledCheckin::PruneCommandEvents").Error()})
+	}
+
+	err = purgeDeletedGroupProfiles()
+	if err != nil {
+		return errors.Wrap(err, "processScheduledCheckin::PurgeDeletedGroupProfiles")
+	}
+
 	thirtyMinsAgo := time.Now().Add(-30 * time.Minute)
 	err = db.DB.Where("unlock_pins.pin_set < ?", thirtyMinsAgo).Delete(&types.UnlockPin{}).Error
 	if err != nil {
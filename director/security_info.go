@@ -68,5 +68,7 @@ func SaveSecurityInfo(securityInfoData types.SecurityInfoData, device types.Devi
 		return errors.Wrap(err, "Update LastSecurityInfo")
 	}
 
+	evaluateSmartGroupsLater(device.UDID)
+
 	return nil
 }
@@ -0,0 +1,410 @@
+package director
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	signerLocal = "local"
+	signerHTTP  = "http"
+)
+
+// Signer signs mobileconfigs before they are sent to devices
+type Signer interface {
+	// Sign returns the mobileconfig wrapped in CMS SignedData
+	Sign(mobileconfig []byte) ([]byte, error)
+	// Certificate is the certificate profiles are signed with, used to check the signer of installed profiles.
+	// It is nil when the certificate is not known.
+	Certificate() *x509.Certificate
+}
+
+// loadSigner returns the Signer selected with the -signer flag
+func loadSigner() (Signer, error) {
+	switch utils.SignerType() {
+	case "", signerLocal:
+		key, cert, err := loadSigningKey(utils.KeyPassword(), utils.KeyPath(), utils.CertPath())
+		if err != nil {
+			return nil, errors.Wrap(err, "loadSigner")
+		}
+		return &localSigner{key: key, cert: cert}, nil
+	case signerHTTP:
+		signer, err := newHTTPSigner(utils.SignerURL(), utils.CertPath())
+		return signer, errors.Wrap(err, "loadSigner")
+	}
+
+	return nil, errors.Errorf("loadSigner: unknown signer %q", utils.SignerType())
+}
+
+// signingCertificate returns the certificate of the configured signer, or nil if profiles aren't signed
+func signingCertificate() *x509.Certificate {
+	if !utils.Sign() {
+		return nil
+	}
+
+	signer, _, err := profileSigningCache.currentSigner()
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return nil
+	}
+
+	return signer.Certificate()
+}
+
+// signMobileconfig signs the mobileconfig if signing is enabled, otherwise it is returned unchanged. Cacheable
+// profiles are only signed once for as long as the signing key and certificate stay the same. The device decides
+// which certificate is used while a signing rotation is in progress.
+func (signers *profileSigners) signMobileconfig(udid string, mobileconfig []byte, cacheable bool) ([]byte, error) {
+	if !utils.Sign() {
+		return mobileconfig, nil
+	}
+
+	signed, err := signers.deviceSigningCache(udid).sign(mobileconfig, cacheable)
+	return signed, errors.Wrap(err, "signMobileconfig")
+}
+
+// localSigner signs with a key and certificate read from disk
+type localSigner struct {
+	key  crypto.PrivateKey
+	cert *x509.Certificate
+}
+
+func (signer *localSigner) Sign(mobileconfig []byte) ([]byte, error) {
+	return SignProfile(signer.key, signer.cert, mobileconfig)
+}
+
+func (signer *localSigner) Certificate() *x509.Certificate {
+	return signer.cert
+}
+
+// httpSigner sends the mobileconfig to an external signing service, which returns it as DER encoded SignedData.
+// The private key never has to be present on the director host.
+type httpSigner struct {
+	url    string
+	cert   *x509.Certificate
+	client *http.Client
+}
+
+func newHTTPSigner(url, certPath string) (*httpSigner, error) {
+	if url == "" {
+		return nil, errors.New("newHTTPSigner: -signer-url is required for the http signer")
+	}
+
+	signer := &httpSigner{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	// The certificate is optional, without it the signer of installed profiles isn't verified
+	if certPath != "" {
+		cert, err := loadCertificate(certPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "newHTTPSigner")
+		}
+		signer.cert = cert
+	}
+
+	return signer, nil
+}
+
+func (signer *httpSigner) Sign(mobileconfig []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", signer.url, bytes.NewReader(mobileconfig))
+	if err != nil {
+		return nil, errors.Wrap(err, "httpSigner: create request")
+	}
+	req.Header.Set("Content-Type", "application/x-apple-aspen-config")
+
+	resp, err := signer.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "httpSigner: send request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "httpSigner: read response")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("httpSigner: signing service returned %v", resp.Status)
+	}
+
+	// Don't send devices whatever came back unless it is signed data
+	_, err = pkcs7.Parse(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "httpSigner: response is not signed data")
+	}
+
+	return body, nil
+}
+
+func (signer *httpSigner) Certificate() *x509.Certificate {
+	return signer.cert
+}
+
+// SignProfile takes an unsigned payload and signs it with the provided private key and certificate.
+func SignProfile(
+	key crypto.PrivateKey,
+	cert *x509.Certificate,
+	mobileconfig []byte,
+) ([]byte, error) {
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		signedMobileconfig, err := signECDSA(ecKey, cert, mobileconfig)
+		return signedMobileconfig, errors.Wrap(err, "sign mobileconfig with ECDSA key")
+	}
+
+	var err error
+	sd, err := pkcs7.NewSignedData(mobileconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "create signed data for mobileconfig")
+	}
+
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.Wrap(err, "add crypto signer to mobileconfig signed data")
+	}
+
+	signedMobileconfig, err := sd.Finish()
+	return signedMobileconfig, errors.Wrap(err, "complete mobileconfig signing")
+}
+
+func loadSigningKey(
+	keyPass, keyPath, certPath string,
+) (crypto.PrivateKey, *x509.Certificate, error) {
+	var err error
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ext := filepath.Ext(certPath)
+	if ext == ".p12" || ext == ".pfx" {
+		pkey, cert, err := pkcs12.Decode(certData, keyPass)
+		return pkey, cert, errors.Wrap(err, "decode p12 contents")
+	}
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read key from file")
+	}
+
+	keyDataBlock, _ := pem.Decode(keyData)
+	if keyDataBlock == nil {
+		return nil, nil, errors.Errorf("invalid PEM data for private key %s", keyPath)
+	}
+	var pemKeyData []byte
+	if x509.IsEncryptedPEMBlock(keyDataBlock) { //nolint:staticcheck
+		pemKeyData, err = x509.DecryptPEMBlock(keyDataBlock, []byte(keyPass)) //nolint:staticcheck
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypting DES private key %s", err)
+		}
+	} else {
+		pemKeyData = keyDataBlock.Bytes
+	}
+
+	priv, err := parsePrivateKey(keyDataBlock.Type, pemKeyData)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse private key")
+	}
+
+	cert, err := parseCertificatePEM(certData)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "parse certificate %q", certPath)
+	}
+
+	return priv, cert, nil
+}
+
+// parsePrivateKey reads PKCS#1 RSA, SEC 1 EC and PKCS#8 RSA or ECDSA private keys
+func parsePrivateKey(blockType string, der []byte) (crypto.PrivateKey, error) {
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		// Unlabelled blocks were always treated as PKCS#1
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(der); rsaErr == nil {
+			return rsaKey, nil
+		}
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+
+	return nil, errors.Errorf("unsupported private key type %T", key)
+}
+
+func parseCertificatePEM(certData []byte) (*x509.Certificate, error) {
+	pub, _ := pem.Decode(certData)
+	if pub == nil {
+		return nil, errors.New("invalid PEM data for certificate")
+	}
+
+	cert, err := x509.ParseCertificate(pub.Bytes)
+	return cert, errors.Wrap(err, "parse PEM certificate data")
+}
+
+// loadCertificate reads a PEM or DER encoded certificate
+func loadCertificate(certPath string) (*x509.Certificate, error) {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read certificate")
+	}
+
+	if cert, err := parseCertificatePEM(certData); err == nil {
+		return cert, nil
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	return cert, errors.Wrapf(err, "parse certificate %q", certPath)
+}
+
+var (
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+// CMS SignedData (RFC 5652) with a single signer, used for keys the pkcs7 package can't sign with
+type cmsSignedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     cmsSignedData `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      cmsEncapsulatedContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsEncapsulatedContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// signedAttributes returns the DER encoded attributes in SET OF order, without the SET header
+func signedAttributes(content []byte) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttributeContentType, oidData},
+		{oidAttributeMessageDigest, digest[:]},
+		{oidAttributeSigningTime, time.Now().UTC()},
+	}
+
+	var encoded [][]byte
+	for _, attr := range values {
+		value, err := asn1.Marshal(attr.value)
+		if err != nil {
+			return nil, err
+		}
+		der, err := asn1.Marshal(cmsAttribute{
+			Type:   attr.oid,
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, der)
+	}
+
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+
+	return bytes.Join(encoded, nil), nil
+}
+
+func signECDSA(key *ecdsa.PrivateKey, cert *x509.Certificate, content []byte) ([]byte, error) {
+	attrs, err := signedAttributes(content)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode signed attributes")
+	}
+
+	// The signature covers the attributes encoded as an explicit SET
+	attrSet, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, errors.Wrap(err, "encode signed attributes")
+	}
+	digest := sha256.Sum256(attrSet)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "sign attributes")
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	contentInfo := cmsSignedContentInfo{
+		ContentType: oidSignedData,
+		Content: cmsSignedData{
+			Version:          1,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+			ContentInfo:      cmsEncapsulatedContentInfo{ContentType: oidData, Content: content},
+			// [0] IMPLICIT CertificateSet
+			Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+			SignerInfos: []cmsSignerInfo{
+				{
+					Version: 1,
+					Sid: cmsIssuerAndSerial{
+						IssuerName:   asn1.RawValue{FullBytes: cert.RawIssuer},
+						SerialNumber: new(big.Int).Set(cert.SerialNumber),
+					},
+					DigestAlgorithm: sha256Algorithm,
+					// [0] IMPLICIT SignedAttributes
+					SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+					SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+					Signature:          signature,
+				},
+			},
+		},
+	}
+
+	return asn1.Marshal(contentInfo)
+}
@@ -0,0 +1,132 @@
+package director
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/stretchr/testify/require"
+)
+
+func testSigningCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "profile signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	ecSEC1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		blockType string
+		der       []byte
+		key       crypto.Signer
+	}{
+		{"PKCS#1 RSA", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), rsaKey},
+		{"PKCS#8 RSA", "PRIVATE KEY", rsaPKCS8, rsaKey},
+		{"PKCS#8 ECDSA", "PRIVATE KEY", ecPKCS8, ecKey},
+		{"SEC 1 ECDSA", "EC PRIVATE KEY", ecSEC1, ecKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := testSigningCertificate(t, tt.key)
+			keyPath := writePEM(t, dir, "key.pem", tt.blockType, tt.der)
+			certPath := writePEM(t, dir, "cert.pem", "CERTIFICATE", cert.Raw)
+
+			key, loadedCert, err := loadSigningKey("", keyPath, certPath)
+			require.NoError(t, err)
+			require.Equal(t, cert.Raw, loadedCert.Raw)
+
+			signed, err := SignProfile(key, loadedCert, []byte(testTemplateProfile))
+			require.NoError(t, err)
+
+			p7, err := pkcs7.Parse(signed)
+			require.NoError(t, err)
+			require.NoError(t, p7.Verify())
+			require.Equal(t, []byte(testTemplateProfile), p7.Content)
+			require.Equal(t, cert.Raw, p7.GetOnlySigner().Raw)
+		})
+	}
+}
+
+func TestHTTPSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	cert := testSigningCertificate(t, key)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/x-apple-aspen-config", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if string(body) == "fail" {
+			http.Error(w, "no", http.StatusForbidden)
+			return
+		}
+		signed, err := SignProfile(key, cert, body)
+		require.NoError(t, err)
+		_, _ = w.Write(signed)
+	}))
+	defer server.Close()
+
+	certPath := writePEM(t, t.TempDir(), "cert.pem", "CERTIFICATE", cert.Raw)
+	signer, err := newHTTPSigner(server.URL, certPath)
+	require.NoError(t, err)
+	require.Equal(t, cert.Raw, signer.Certificate().Raw)
+
+	signed, err := signer.Sign([]byte(testTemplateProfile))
+	require.NoError(t, err)
+	p7, err := pkcs7.Parse(signed)
+	require.NoError(t, err)
+	require.NoError(t, p7.Verify())
+
+	_, err = signer.Sign([]byte("fail"))
+	require.Error(t, err)
+
+	_, err = newHTTPSigner("", "")
+	require.Error(t, err)
+}
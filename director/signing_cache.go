@@ -0,0 +1,132 @@
+package director
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+// signedProfileCacheSize is the number of signed profiles kept in memory
+const signedProfileCacheSize = 1024
+
+// signingCache keeps the loaded Signer and the profiles it has signed, so a profile pushed to many devices is only
+// signed once. Everything is dropped when the signing configuration or the key and certificate files change.
+type signingCache struct {
+	load        func() (Signer, error)
+	state       func() string
+	mu          sync.Mutex
+	signer      Signer
+	loadedState string
+	fingerprint string
+	signed      *lru.Cache
+}
+
+var profileSigningCache = newSigningCache(loadSigner, signingState)
+
+func newSigningCache(load func() (Signer, error), state func() string) *signingCache {
+	signed, err := lru.New(signedProfileCacheSize)
+	if err != nil {
+		// only returned for a non-positive size
+		panic(err)
+	}
+
+	return &signingCache{load: load, state: state, signed: signed}
+}
+
+// signingState describes the signing configuration, including the size and modification time of the key and
+// certificate files
+func signingState() string {
+	return signingFilesState([]string{utils.SignerType(), utils.SignerURL()}, utils.CertPath(), utils.KeyPath())
+}
+
+func signingFilesState(state []string, paths ...string) string {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			state = append(state, path)
+			continue
+		}
+		state = append(state, fmt.Sprintf("%v:%v:%v", path, info.Size(), info.ModTime().UnixNano()))
+	}
+
+	return strings.Join(state, "|")
+}
+
+// currentSigner returns the cached Signer, loading it again if the configuration changed
+func (cache *signingCache) currentSigner() (Signer, string, error) {
+	state := cache.state()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.signer != nil && cache.loadedState == state {
+		return cache.signer, cache.fingerprint, nil
+	}
+
+	signer, err := cache.load()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "currentSigner")
+	}
+
+	fingerprint := state
+	if cert := signer.Certificate(); cert != nil {
+		fingerprint = certificateFingerprint(cert)
+	}
+
+	if cache.signer != nil {
+		InfoLogger(LogHolder{Message: "Signing configuration changed, clearing signed profile cache", Metric: fingerprint})
+	}
+
+	cache.signer = signer
+	cache.loadedState = state
+	cache.fingerprint = fingerprint
+	cache.signed.Purge()
+
+	return signer, fingerprint, nil
+}
+
+// sign returns the signed profile from the cache, signing it on a miss. Profiles that are different on every push
+// are not cacheable, storing them would only push out useful entries.
+func (cache *signingCache) sign(mobileconfig []byte, cacheable bool) ([]byte, error) {
+	signer, fingerprint, err := cache.currentSigner()
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+
+	if !cacheable {
+		return signer.Sign(mobileconfig)
+	}
+
+	hash := sha256.Sum256(mobileconfig)
+	key := hex.EncodeToString(hash[:]) + "/" + fingerprint
+
+	if signed, ok := cache.signed.Get(key); ok {
+		SignedProfileCacheHits.Inc()
+		return signed.([]byte), nil
+	}
+
+	SignedProfileCacheMisses.Inc()
+	signed, err := signer.Sign(mobileconfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+	cache.signed.Add(key, signed)
+
+	return signed, nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
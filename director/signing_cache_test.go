@@ -0,0 +1,89 @@
+package director
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func setTestFlag(t *testing.T, name, value string) {
+	if flag.Lookup(name) == nil {
+		flag.String(name, "", "")
+	}
+	previous := flag.Lookup(name).Value.String()
+	require.NoError(t, flag.Set(name, value))
+	t.Cleanup(func() { flag.Set(name, previous) }) //nolint:errcheck
+}
+
+func writeTestSigningKey(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	cert := testSigningCertificate(t, key)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	keyPath := writePEM(t, dir, "key.pem", "PRIVATE KEY", der)
+	certPath := writePEM(t, dir, "cert.pem", "CERTIFICATE", cert.Raw)
+
+	return keyPath, certPath, cert
+}
+
+func TestSigningCache(t *testing.T) {
+	if flag.Lookup("sign") == nil {
+		flag.Bool("sign", false, "")
+	}
+	require.NoError(t, flag.Set("sign", "true"))
+	defer flag.Set("sign", "false") //nolint:errcheck
+
+	dir := t.TempDir()
+	keyPath, certPath, cert := writeTestSigningKey(t, dir)
+	setTestFlag(t, "signer", signerLocal)
+	setTestFlag(t, "signer-url", "")
+	setTestFlag(t, "key-password", "")
+	setTestFlag(t, "signing-private-key", keyPath)
+	setTestFlag(t, "cert", certPath)
+	setTestFlag(t, "next-cert", "")
+
+	profileSigningCache = newSigningCache(loadSigner, signingState)
+	hits := testutil.ToFloat64(SignedProfileCacheHits)
+	misses := testutil.ToFloat64(SignedProfileCacheMisses)
+
+	first, err := newProfileSigners().signMobileconfig("", []byte(testTemplateProfile), true)
+	require.NoError(t, err)
+	second, err := newProfileSigners().signMobileconfig("", []byte(testTemplateProfile), true)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	require.Equal(t, misses+1, testutil.ToFloat64(SignedProfileCacheMisses))
+	require.Equal(t, hits+1, testutil.ToFloat64(SignedProfileCacheHits))
+
+	// profiles that can't be cached are signed every time
+	_, err = newProfileSigners().signMobileconfig("", []byte(testTemplateProfile), false)
+	require.NoError(t, err)
+	require.Equal(t, hits+1, testutil.ToFloat64(SignedProfileCacheHits))
+	require.Equal(t, misses+1, testutil.ToFloat64(SignedProfileCacheMisses))
+
+	// replacing the key and certificate on disk clears the cache
+	_, _, newCert := writeTestSigningKey(t, dir)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	require.NoError(t, os.Chtimes(keyPath, later, later))
+
+	third, err := newProfileSigners().signMobileconfig("", []byte(testTemplateProfile), true)
+	require.NoError(t, err)
+	require.Equal(t, misses+2, testutil.ToFloat64(SignedProfileCacheMisses))
+
+	p7, err := pkcs7.Parse(third)
+	require.NoError(t, err)
+	require.NotEqual(t, cert.Raw, p7.GetOnlySigner().Raw)
+	require.Equal(t, newCert.Raw, p7.GetOnlySigner().Raw)
+	require.Equal(t, newCert.Raw, signingCertificate().Raw)
+}
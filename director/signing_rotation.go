@@ -0,0 +1,681 @@
+package director
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	intErrors "errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+
+	"gorm.io/gorm"
+)
+
+const (
+	rotationActive     = "active"
+	rotationPaused     = "paused"
+	rotationComplete   = "complete"
+	rotationCancelling = "cancelling"
+	rotationCancelled  = "cancelled"
+
+	rotationDevicePending  = "pending"
+	rotationDevicePushed   = "pushed"
+	rotationDeviceVerified = "verified"
+	rotationDeviceSkipped  = "skipped"
+
+	defaultRotationBatchSize       = 50
+	defaultRotationIntervalMinutes = 10
+)
+
+// ErrNoNextSigningCertificate is returned when a rotation is requested without -next-cert
+var ErrNoNextSigningCertificate = errors.New("no next signing certificate configured")
+
+var nextSigningCache = newSigningCache(loadNextSigner, nextSigningState)
+
+// loadNextSigner loads the key and certificate set with -next-cert and -next-signing-private-key
+func loadNextSigner() (Signer, error) {
+	if utils.NextCertPath() == "" {
+		return nil, ErrNoNextSigningCertificate
+	}
+
+	key, cert, err := loadSigningKey(utils.KeyPassword(), utils.NextKeyPath(), utils.NextCertPath())
+	if err != nil {
+		return nil, errors.Wrap(err, "loadNextSigner")
+	}
+
+	return &localSigner{key: key, cert: cert}, nil
+}
+
+func nextSigningState() string {
+	return signingFilesState(nil, utils.NextCertPath(), utils.NextKeyPath())
+}
+
+// currentSigningRotation returns the latest rotation that hasn't been cancelled, as long as it is for the certificate
+// that is configured as the next one. It returns nil when there is no such rotation. A rotation that is still moving
+// devices back to the current certificate counts, so profiles signed with either are accepted until it is done.
+func currentSigningRotation() (*types.SigningRotation, error) {
+	var rotation types.SigningRotation
+
+	if utils.NextCertPath() == "" {
+		return nil, nil
+	}
+
+	err := db.DB.Where("status IN ?", []string{rotationActive, rotationPaused, rotationComplete, rotationCancelling}).
+		Order("created_at desc").
+		First(&rotation).
+		Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "currentSigningRotation")
+	}
+
+	_, fingerprint, err := nextSigningCache.currentSigner()
+	if err != nil {
+		return nil, errors.Wrap(err, "currentSigningRotation")
+	}
+	if fingerprint != rotation.CertificateFingerprint {
+		return nil, nil
+	}
+
+	return &rotation, nil
+}
+
+// profileSigners picks the signer for each device's profiles during a single push. The rotation is looked up once
+// per push and the progress of each device once, rather than for every profile signed.
+type profileSigners struct {
+	loaded   bool
+	rotation *types.SigningRotation
+	devices  map[string]*signingCache
+}
+
+func newProfileSigners() *profileSigners {
+	return &profileSigners{devices: make(map[string]*signingCache)}
+}
+
+// deviceSigningCache returns the signer for a device's profiles. A device moves to the next certificate once a
+// rotation has re-pushed its profiles, and every device does once the rotation is complete.
+func (signers *profileSigners) deviceSigningCache(udid string) *signingCache {
+	if !signers.loaded {
+		rotation, err := currentSigningRotation()
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: udid, Message: err.Error()})
+		}
+		signers.rotation = rotation
+		signers.loaded = true
+	}
+
+	if signers.rotation == nil {
+		return profileSigningCache
+	}
+	if signers.rotation.Status == rotationComplete {
+		return nextSigningCache
+	}
+
+	if cache, ok := signers.devices[udid]; ok {
+		return cache
+	}
+
+	var count int64
+	err := db.DB.Model(&types.SigningRotationDevice{}).
+		Where("rotation_id = ? AND device_ud_id = ? AND status IN ?", signers.rotation.ID, udid, []string{rotationDevicePushed, rotationDeviceVerified}).
+		Count(&count).
+		Error
+	if err != nil {
+		ErrorLogger(LogHolder{DeviceUDID: udid, Message: err.Error()})
+		return profileSigningCache
+	}
+
+	cache := profileSigningCache
+	if count > 0 {
+		cache = nextSigningCache
+	}
+	signers.devices[udid] = cache
+
+	return cache
+}
+
+// acceptedSigningCertificates returns the certificates installed profiles may be signed with. During a rotation
+// profiles signed with either certificate are accepted, so devices only move over in their batch.
+func acceptedSigningCertificates() []*x509.Certificate {
+	var certs []*x509.Certificate
+
+	if cert := signingCertificate(); cert != nil {
+		certs = append(certs, cert)
+	}
+
+	if !utils.Sign() {
+		return certs
+	}
+
+	rotation, err := currentSigningRotation()
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return certs
+	}
+	if rotation == nil {
+		return certs
+	}
+
+	signer, _, err := nextSigningCache.currentSigner()
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return certs
+	}
+
+	return append(certs, signer.Certificate())
+}
+
+// StartSigningRotation registers every device for a rotation to the next signing certificate. The first batch is
+// pushed by the scheduler.
+func StartSigningRotation(payload types.SigningRotationPayload) (types.SigningRotation, error) {
+	var rotation types.SigningRotation
+	var devices []types.Device
+
+	signer, fingerprint, err := nextSigningCache.currentSigner()
+	if err != nil {
+		return rotation, errors.Wrap(err, "StartSigningRotation")
+	}
+
+	rotation = types.SigningRotation{
+		Status:                 rotationActive,
+		CertificateFingerprint: fingerprint,
+		CertificateSubject:     signer.Certificate().Subject.String(),
+		BatchSize:              payload.BatchSize,
+		IntervalMinutes:        payload.IntervalMinutes,
+		NextBatchAt:            time.Now(),
+	}
+	if rotation.BatchSize <= 0 {
+		rotation.BatchSize = defaultRotationBatchSize
+	}
+	if rotation.IntervalMinutes <= 0 {
+		rotation.IntervalMinutes = defaultRotationIntervalMinutes
+	}
+
+	err = db.DB.Select("ud_id").Find(&devices).Error
+	if err != nil {
+		return rotation, errors.Wrap(err, "StartSigningRotation: load devices")
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&rotation).Error
+		if err != nil {
+			return err
+		}
+
+		rotationDevices := make([]types.SigningRotationDevice, 0, len(devices))
+		for _, device := range devices {
+			rotationDevices = append(rotationDevices, types.SigningRotationDevice{
+				RotationID: rotation.ID,
+				DeviceUDID: device.UDID,
+				Status:     rotationDevicePending,
+			})
+		}
+		if len(rotationDevices) == 0 {
+			return nil
+		}
+
+		return tx.CreateInBatches(&rotationDevices, 500).Error
+	})
+	if err != nil {
+		return rotation, errors.Wrap(err, "StartSigningRotation: create rotation")
+	}
+
+	InfoLogger(LogHolder{Message: "Starting signing certificate rotation", Metric: rotation.CertificateSubject})
+
+	return rotation, nil
+}
+
+// advanceSigningRotation re-signs and re-pushes the profiles of the next batch of devices. The rotation is complete
+// once no devices are left to push.
+func advanceSigningRotation(rotation types.SigningRotation) (types.SigningRotation, error) {
+	var batch []types.SigningRotationDevice
+
+	// Devices that failed before were moved to the back by their updated_at
+	err := db.DB.Where("rotation_id = ? AND status = ?", rotation.ID, rotationDevicePending).
+		Order("updated_at").
+		Limit(rotation.BatchSize).
+		Find(&batch).
+		Error
+	if err != nil {
+		return rotation, errors.Wrap(err, "advanceSigningRotation: load batch")
+	}
+
+	if len(batch) == 0 {
+		InfoLogger(LogHolder{Message: "Signing certificate rotation complete", Metric: rotation.CertificateSubject})
+		rotation.Status = rotationComplete
+		err = db.DB.Model(&rotation).Update("status", rotationComplete).Error
+		return rotation, errors.Wrap(err, "advanceSigningRotation: complete rotation")
+	}
+
+	for _, rotationDevice := range batch {
+		err = pushSigningRotationDevice(rotationDevice)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: rotationDevice.DeviceUDID, Message: err.Error()})
+		}
+	}
+
+	rotation.NextBatchAt = time.Now().Add(time.Duration(rotation.IntervalMinutes) * time.Minute)
+	err = db.DB.Model(&rotation).Update("next_batch_at", rotation.NextBatchAt).Error
+	if err != nil {
+		return rotation, errors.Wrap(err, "advanceSigningRotation: save rotation")
+	}
+
+	return rotation, nil
+}
+
+// pushSigningRotationDevice moves a device to the next certificate and pushes all of its profiles again
+func pushSigningRotationDevice(rotationDevice types.SigningRotationDevice) error {
+	device, err := GetDevice(rotationDevice.DeviceUDID)
+	if err != nil {
+		// The device is no longer enrolled
+		return updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+			"status": rotationDeviceSkipped,
+			"error":  err.Error(),
+		})
+	}
+
+	// The device has to be marked first, the push signs with whichever certificate the device is on
+	now := time.Now()
+	err = updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+		"status":    rotationDevicePushed,
+		"pushed_at": &now,
+		"error":     "",
+	})
+	if err != nil {
+		return err
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: "Pushing profiles signed with the next signing certificate"})
+
+	// Only an enrollment profile we sign ourselves has to move to the new certificate
+	if utils.EnrollmentProfile() != "" && !utils.SignedEnrollmentProfile() {
+		err = reinstallEnrollmentProfile(device)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+		}
+	}
+
+	_, err = InstallAllProfiles(device)
+	if err != nil {
+		// Back to pending so a later batch tries again
+		updateErr := updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+			"status":    rotationDevicePending,
+			"pushed_at": nil,
+			"error":     err.Error(),
+		})
+		if updateErr != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: updateErr.Error()})
+		}
+		return errors.Wrap(err, "pushSigningRotationDevice")
+	}
+
+	return nil
+}
+
+// revertSigningRotation moves the next batch of devices that were already pushed back to the current certificate.
+// The rotation is cancelled once none are left, until then profiles signed with either certificate are accepted.
+func revertSigningRotation(rotation types.SigningRotation) (types.SigningRotation, error) {
+	var batch []types.SigningRotationDevice
+
+	err := db.DB.Where("rotation_id = ? AND status IN ?", rotation.ID, []string{rotationDevicePushed, rotationDeviceVerified}).
+		Order("updated_at").
+		Limit(rotation.BatchSize).
+		Find(&batch).
+		Error
+	if err != nil {
+		return rotation, errors.Wrap(err, "revertSigningRotation: load batch")
+	}
+
+	if len(batch) == 0 {
+		InfoLogger(LogHolder{Message: "Signing certificate rotation cancelled", Metric: rotation.CertificateSubject})
+		rotation.Status = rotationCancelled
+		err = db.DB.Model(&rotation).Update("status", rotationCancelled).Error
+		return rotation, errors.Wrap(err, "revertSigningRotation: cancel rotation")
+	}
+
+	for _, rotationDevice := range batch {
+		err = revertSigningRotationDevice(rotationDevice)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: rotationDevice.DeviceUDID, Message: err.Error()})
+		}
+	}
+
+	rotation.NextBatchAt = time.Now().Add(time.Duration(rotation.IntervalMinutes) * time.Minute)
+	err = db.DB.Model(&rotation).Update("next_batch_at", rotation.NextBatchAt).Error
+	if err != nil {
+		return rotation, errors.Wrap(err, "revertSigningRotation: save rotation")
+	}
+
+	return rotation, nil
+}
+
+// revertSigningRotationDevice moves a device back to the current certificate and pushes all of its profiles again
+func revertSigningRotationDevice(rotationDevice types.SigningRotationDevice) error {
+	device, err := GetDevice(rotationDevice.DeviceUDID)
+	if err != nil {
+		// The device is no longer enrolled
+		return updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+			"status": rotationDeviceSkipped,
+			"error":  err.Error(),
+		})
+	}
+
+	err = updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+		"status":      rotationDevicePending,
+		"pushed_at":   nil,
+		"verified_at": nil,
+		"error":       "",
+	})
+	if err != nil {
+		return err
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: "Pushing profiles signed with the current signing certificate"})
+
+	if utils.EnrollmentProfile() != "" && !utils.SignedEnrollmentProfile() {
+		err = reinstallEnrollmentProfile(device)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: err.Error()})
+		}
+	}
+
+	_, err = InstallAllProfiles(device)
+	if err != nil {
+		// Still on the next certificate, a later batch tries again
+		updateErr := updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+			"status": rotationDevicePushed,
+			"error":  err.Error(),
+		})
+		if updateErr != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: updateErr.Error()})
+		}
+		return errors.Wrap(err, "revertSigningRotationDevice")
+	}
+
+	return nil
+}
+
+func updateSigningRotationDevice(rotationDevice types.SigningRotationDevice, updates map[string]interface{}) error {
+	err := db.DB.Model(&types.SigningRotationDevice{}).
+		Where("rotation_id = ? AND device_ud_id = ?", rotationDevice.RotationID, rotationDevice.DeviceUDID).
+		Updates(updates).
+		Error
+	return errors.Wrap(err, "updateSigningRotationDevice")
+}
+
+// updateSigningRotationProgress marks a pushed device as verified once every profile we manage on it is signed with
+// the next certificate
+func updateSigningRotationProgress(device types.Device, profileLists []types.ProfileList, managedIdentifiers map[string]struct{}) error {
+	var rotationDevice types.SigningRotationDevice
+
+	rotation, err := currentSigningRotation()
+	if err != nil || rotation == nil || rotation.Status == rotationCancelling {
+		return err
+	}
+
+	err = db.DB.Where("rotation_id = ? AND device_ud_id = ? AND status = ?", rotation.ID, device.UDID, rotationDevicePushed).
+		First(&rotationDevice).
+		Error
+	if err != nil {
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.Wrap(err, "updateSigningRotationProgress")
+	}
+
+	for _, profileList := range profileLists {
+		if _, ok := managedIdentifiers[profileList.PayloadIdentifier]; !ok {
+			continue
+		}
+		if !signedWithFingerprint(profileList, rotation.CertificateFingerprint) {
+			return nil
+		}
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, Message: "Profiles verified with the next signing certificate"})
+	now := time.Now()
+	return updateSigningRotationDevice(rotationDevice, map[string]interface{}{
+		"status":      rotationDeviceVerified,
+		"verified_at": &now,
+	})
+}
+
+func signedWithFingerprint(profileList types.ProfileList, fingerprint string) bool {
+	for _, certData := range profileList.SignerCertificates {
+		cert, err := x509.ParseCertificate(certData)
+		if err != nil {
+			continue
+		}
+		if certificateFingerprint(cert) == fingerprint {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScheduledSigningRotations pushes the next batch of every active or cancelling rotation that is due
+func ScheduledSigningRotations() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		var rotations []types.SigningRotation
+		err := db.DB.Where("status IN ? AND next_batch_at <= ?", []string{rotationActive, rotationCancelling}, time.Now()).Find(&rotations).Error
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			continue
+		}
+
+		for _, rotation := range rotations {
+			if rotation.Status == rotationCancelling {
+				_, err = revertSigningRotation(rotation)
+			} else {
+				_, err = advanceSigningRotation(rotation)
+			}
+			if err != nil {
+				ErrorLogger(LogHolder{Message: err.Error(), Metric: rotation.CertificateSubject})
+			}
+		}
+	}
+}
+
+func signingRotationStatus(rotation types.SigningRotation, details bool, status string) (types.SigningRotationStatus, error) {
+	var counts []struct {
+		Status string
+		Count  int
+	}
+
+	rotationStatus := types.SigningRotationStatus{SigningRotation: rotation, Devices: make(map[string]int)}
+
+	err := db.DB.Model(&types.SigningRotationDevice{}).
+		Select("status, count(*) as count").
+		Where("rotation_id = ?", rotation.ID).
+		Group("status").
+		Scan(&counts).
+		Error
+	if err != nil {
+		return rotationStatus, errors.Wrap(err, "signingRotationStatus: count devices")
+	}
+	for _, count := range counts {
+		rotationStatus.Devices[count.Status] = count.Count
+	}
+
+	if details {
+		tx := db.DB.Where("rotation_id = ?", rotation.ID)
+		if status != "" {
+			tx = tx.Where("status = ?", status)
+		}
+		err = tx.Order("device_ud_id").Find(&rotationStatus.Details).Error
+		if err != nil {
+			return rotationStatus, errors.Wrap(err, "signingRotationStatus: load devices")
+		}
+	}
+
+	return rotationStatus, nil
+}
+
+func writeSigningRotation(w http.ResponseWriter, v interface{}, status int) {
+	output, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// GetSigningRotationsHandler lists every rotation with the number of devices in each state
+func GetSigningRotationsHandler(w http.ResponseWriter, r *http.Request) {
+	var rotations []types.SigningRotation
+
+	err := db.DB.Order("created_at desc").Find(&rotations).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	statuses := make([]types.SigningRotationStatus, 0, len(rotations))
+	for _, rotation := range rotations {
+		rotationStatus, err := signingRotationStatus(rotation, false, "")
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, rotationStatus)
+	}
+
+	writeSigningRotation(w, &statuses, http.StatusOK)
+}
+
+// GetSigningRotationHandler returns a rotation with the progress of each device. The status query parameter
+// limits the devices to those in that state.
+func GetSigningRotationHandler(w http.ResponseWriter, r *http.Request) {
+	var rotation types.SigningRotation
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("id = ?", vars["id"]).First(&rotation).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rotationStatus, err := signingRotationStatus(rotation, true, r.URL.Query().Get("status"))
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeSigningRotation(w, &rotationStatus, http.StatusOK)
+}
+
+// PostSigningRotationHandler starts a rotation to the certificate set with -next-cert
+func PostSigningRotationHandler(w http.ResponseWriter, r *http.Request) {
+	var out types.SigningRotationPayload
+	var running int64
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&out)
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !utils.Sign() || utils.NextCertPath() == "" {
+		http.Error(w, "signing rotation requires -sign and -next-cert", http.StatusBadRequest)
+		return
+	}
+
+	err := db.DB.Model(&types.SigningRotation{}).
+		Where("status IN ?", []string{rotationActive, rotationPaused, rotationCancelling}).
+		Count(&running).
+		Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if running > 0 {
+		http.Error(w, "a signing rotation is already in progress", http.StatusConflict)
+		return
+	}
+
+	rotation, err := StartSigningRotation(out)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rotationStatus, err := signingRotationStatus(rotation, false, "")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeSigningRotation(w, &rotationStatus, http.StatusCreated)
+}
+
+// PostSigningRotationActionHandler pauses, resumes or cancels a rotation. A cancelled rotation moves the devices that
+// were already pushed back to the current certificate in batches, and is only cancelled once they all are.
+func PostSigningRotationActionHandler(w http.ResponseWriter, r *http.Request) {
+	var rotation types.SigningRotation
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("id = ? AND status IN ?", vars["id"], []string{rotationActive, rotationPaused}).First(&rotation).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch vars["action"] {
+	case "pause":
+		rotation.Status = rotationPaused
+	case "resume":
+		rotation.Status = rotationActive
+	case "cancel":
+		rotation.Status = rotationCancelling
+		rotation.NextBatchAt = time.Now()
+	default:
+		http.Error(w, "action must be pause, resume or cancel", http.StatusBadRequest)
+		return
+	}
+
+	err = db.DB.Model(&rotation).Updates(map[string]interface{}{"status": rotation.Status, "next_batch_at": rotation.NextBatchAt}).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	InfoLogger(LogHolder{Message: "Signing certificate rotation " + rotation.Status, Metric: rotation.CertificateSubject})
+
+	writeSigningRotation(w, &rotation, http.StatusOK)
+}
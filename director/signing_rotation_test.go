@@ -0,0 +1,148 @@
+package director
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func testNamedCertificate(t *testing.T, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestValidateProfileInProfileList_SigningRotation(t *testing.T) {
+	log.SetLevel(log.PanicLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	if flag.Lookup("sign") == nil {
+		flag.Bool("sign", false, "")
+	}
+	require.NoError(t, flag.Set("sign", "true"))
+	defer flag.Set("sign", "false") //nolint:errcheck
+
+	current := testNamedCertificate(t, "current signing")
+	next := testNamedCertificate(t, "next signing")
+	other := testNamedCertificate(t, "other signing")
+
+	profile := ProfileForVerification{
+		PayloadUUID:       "1234-567",
+		PayloadIdentifier: "com.example.profile",
+		HashedPayloadUUID: "5432-765",
+		Installed:         true,
+	}
+	profileList := func(cert *x509.Certificate) []types.ProfileList {
+		return []types.ProfileList{
+			{
+				PayloadUUID:        "5432-765",
+				PayloadIdentifier:  "com.example.profile",
+				SignerCertificates: [][]byte{cert.Raw},
+			},
+		}
+	}
+
+	tests := []struct {
+		name           string
+		signedWith     *x509.Certificate
+		accepted       []*x509.Certificate
+		needsReinstall bool
+	}{
+		{"current certificate", current, []*x509.Certificate{current}, false},
+		{"next certificate before rotation", next, []*x509.Certificate{current}, true},
+		{"current certificate during rotation", current, []*x509.Certificate{current, next}, false},
+		{"next certificate during rotation", next, []*x509.Certificate{current, next}, false},
+		{"unknown certificate during rotation", other, []*x509.Certificate{current, next}, true},
+		{"nil certificates are ignored", next, []*x509.Certificate{nil, next}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed, needsReinstall, err := validateProfileInProfileList(profile, profileList(tt.signedWith), tt.accepted...)
+			require.NoError(t, err)
+			require.True(t, installed)
+			require.Equal(t, tt.needsReinstall, needsReinstall)
+		})
+	}
+}
+
+func TestSignedWithFingerprint(t *testing.T) {
+	current := testNamedCertificate(t, "current signing")
+	next := testNamedCertificate(t, "next signing")
+
+	profileList := types.ProfileList{SignerCertificates: [][]byte{current.Raw, []byte("not a certificate")}}
+	require.True(t, signedWithFingerprint(profileList, certificateFingerprint(current)))
+	require.False(t, signedWithFingerprint(profileList, certificateFingerprint(next)))
+}
+
+func TestProfileSigners_LooksUpEachDeviceOnce(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	rotation := &types.SigningRotation{ID: uuid.New(), Status: rotationCancelling}
+	signers := &profileSigners{loaded: true, rotation: rotation, devices: make(map[string]*signingCache)}
+
+	mockSpy.ExpectQuery(`^SELECT count\(\*\) FROM "signing_rotation_devices" WHERE rotation_id = \$1 AND device_ud_id = \$2 AND status IN \(\$3,\$4\)`).
+		WithArgs(rotation.ID, "1234-5678-123456", rotationDevicePushed, rotationDeviceVerified).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	// a device that was pushed stays on the next certificate until a cancelled rotation moves it back
+	for i := 0; i < 3; i++ {
+		require.Equal(t, nextSigningCache, signers.deviceSigningCache("1234-5678-123456"))
+	}
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestRevertSigningRotation_CancelsWhenNoDevicesLeft(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	rotation := types.SigningRotation{ID: uuid.New(), Status: rotationCancelling, BatchSize: 50}
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "signing_rotation_devices" WHERE rotation_id = \$1 AND status IN \(\$2,\$3\) ORDER BY updated_at LIMIT 50`).
+		WithArgs(rotation.ID, rotationDevicePushed, rotationDeviceVerified).
+		WillReturnRows(sqlmock.NewRows([]string{"rotation_id", "device_ud_id", "status"}))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "signing_rotations" SET "status"=\$1`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+
+	rotation, err := revertSigningRotation(rotation)
+	require.NoError(t, err)
+	require.Equal(t, rotationCancelled, rotation.Status)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
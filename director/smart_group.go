@@ -0,0 +1,362 @@
+package director
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-version"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// profileIdentifierAttribute matches against the PayloadIdentifier of every profile in the device's ProfileList
+const profileIdentifierAttribute = "ProfileIdentifier"
+
+// smartGroupEvaluationDelay is how long webhook events for a device are gathered before its smart groups are
+// evaluated once for all of them
+const smartGroupEvaluationDelay = 30 * time.Second
+
+var pendingSmartGroupEvaluations = struct {
+	sync.Mutex
+	udids map[string]struct{}
+}{udids: make(map[string]struct{})}
+
+var smartGroupOperators = map[string]struct{}{
+	"eq":          {},
+	"ne":          {},
+	"starts_with": {},
+	"ends_with":   {},
+	"contains":    {},
+	"lt":          {},
+	"lte":         {},
+	"gt":          {},
+	"gte":         {},
+}
+
+// secretDeviceAttributes can't be used in rules, group membership would otherwise reveal their values
+var secretDeviceAttributes = map[string]struct{}{
+	"UnlockPin":      {},
+	"TempUnlockPin":  {},
+	"PushToken":      {},
+	"PushMagic":      {},
+	"Token":          {},
+	"UnlockToken":    {},
+	"BootstrapToken": {},
+}
+
+// smartGroupOperatorAliases lets rules be written with the usual comparison symbols
+var smartGroupOperatorAliases = map[string]string{
+	"=":  "eq",
+	"==": "eq",
+	"!=": "ne",
+	"<":  "lt",
+	"<=": "lte",
+	">":  "gt",
+	">=": "gte",
+}
+
+func normalizeSmartGroupRules(rules []types.DeviceGroupRule) []types.DeviceGroupRule {
+	normalized := make([]types.DeviceGroupRule, 0, len(rules))
+	for _, rule := range rules {
+		operator := strings.ToLower(strings.TrimSpace(rule.Operator))
+		if alias, ok := smartGroupOperatorAliases[operator]; ok {
+			operator = alias
+		}
+		normalized = append(normalized, types.DeviceGroupRule{
+			Attribute: strings.TrimSpace(rule.Attribute),
+			Operator:  operator,
+			Value:     rule.Value,
+		})
+	}
+
+	return normalized
+}
+
+func validateSmartGroupRules(rules []types.DeviceGroupRule) error {
+	if len(rules) == 0 {
+		return errors.New("smart groups need at least one rule")
+	}
+
+	for _, rule := range rules {
+		if rule.Attribute == "" {
+			return errors.New("rule attribute cannot be empty")
+		}
+		if _, ok := secretDeviceAttributes[rule.Attribute]; ok {
+			return errors.Errorf("rule attribute %q cannot be used", rule.Attribute)
+		}
+		if _, ok := smartGroupOperators[rule.Operator]; !ok {
+			return errors.Errorf("unknown rule operator %q", rule.Operator)
+		}
+	}
+
+	return nil
+}
+
+// deviceAttributes flattens the inventory we hold for a device into attribute name -> values.
+// Scalar fields of Device and SecurityInfo are keyed by their field name, ProfileList entries by ProfileIdentifier.
+// Secrets such as the escrowed unlock PIN are left out.
+func deviceAttributes(
+	device types.Device,
+	securityInfo types.SecurityInfo,
+	profileLists []types.ProfileList,
+) map[string][]string {
+	attributes := make(map[string][]string)
+
+	addScalarFields(attributes, reflect.ValueOf(securityInfo))
+	// Device fields win where both structs carry the same name
+	addScalarFields(attributes, reflect.ValueOf(device))
+
+	for _, profileList := range profileLists {
+		attributes[profileIdentifierAttribute] = append(
+			attributes[profileIdentifierAttribute],
+			profileList.PayloadIdentifier,
+		)
+	}
+
+	return attributes
+}
+
+func addScalarFields(attributes map[string][]string, value reflect.Value) {
+	valueType := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if _, ok := secretDeviceAttributes[field.Name]; ok {
+			continue
+		}
+		fieldValue := value.Field(i)
+		switch fieldValue.Kind() {
+		case reflect.String:
+			attributes[field.Name] = []string{fieldValue.String()}
+		case reflect.Bool:
+			attributes[field.Name] = []string{strconv.FormatBool(fieldValue.Bool())}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			attributes[field.Name] = []string{strconv.FormatInt(fieldValue.Int(), 10)}
+		case reflect.Float32, reflect.Float64:
+			attributes[field.Name] = []string{strconv.FormatFloat(fieldValue.Float(), 'f', -1, 64)}
+		}
+	}
+}
+
+// deviceMatchesRules returns true when the device attributes satisfy every rule
+func deviceMatchesRules(attributes map[string][]string, rules []types.DeviceGroupRule) bool {
+	if len(rules) == 0 {
+		return false
+	}
+
+	for _, rule := range rules {
+		if !ruleMatches(rule, attributes[rule.Attribute]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func ruleMatches(rule types.DeviceGroupRule, values []string) bool {
+	// ne on a multi-valued attribute means none of the values may be equal
+	if rule.Operator == "ne" {
+		for _, value := range values {
+			if compareValues(rule.Attribute, value, rule.Value) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, value := range values {
+		if valueMatches(rule, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func valueMatches(rule types.DeviceGroupRule, value string) bool {
+	expected := rule.Value
+	switch rule.Operator {
+	case "eq":
+		return compareValues(rule.Attribute, value, expected) == 0
+	case "starts_with":
+		return strings.HasPrefix(strings.ToLower(value), strings.ToLower(expected))
+	case "ends_with":
+		return strings.HasSuffix(strings.ToLower(value), strings.ToLower(expected))
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(expected))
+	case "lt":
+		return value != "" && compareValues(rule.Attribute, value, expected) < 0
+	case "lte":
+		return value != "" && compareValues(rule.Attribute, value, expected) <= 0
+	case "gt":
+		return value != "" && compareValues(rule.Attribute, value, expected) > 0
+	case "gte":
+		return value != "" && compareValues(rule.Attribute, value, expected) >= 0
+	}
+
+	return false
+}
+
+// compareValues compares numbers as numbers and dotted versions such as 13.6.1 as versions, falling back to a
+// case-insensitive string comparison. Attributes named *Version are always treated as versions so 14.10 > 14.9.
+func compareValues(attribute, a, b string) int {
+	if !strings.Contains(attribute, "Version") {
+		aFloat, aErr := strconv.ParseFloat(a, 64)
+		bFloat, bErr := strconv.ParseFloat(b, 64)
+		if aErr == nil && bErr == nil {
+			switch {
+			case aFloat < bFloat:
+				return -1
+			case aFloat > bFloat:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	aVersion, aErr := version.NewVersion(a)
+	bVersion, bErr := version.NewVersion(b)
+	if aErr == nil && bErr == nil {
+		return aVersion.Compare(bVersion)
+	}
+
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// EvaluateSmartGroups recalculates the smart group membership of a device. If the membership changed, a ProfileList
+// is requested so VerifyMDMProfiles installs or removes the affected group profiles.
+func EvaluateSmartGroups(udid string) error {
+	var smartGroups []types.DeviceGroup
+	var securityInfo types.SecurityInfo
+	var profileLists []types.ProfileList
+	var members []types.DeviceGroupMember
+
+	if udid == "" {
+		return nil
+	}
+
+	err := db.DB.Preload("Rules").Where("smart = ?", true).Find(&smartGroups).Error
+	if err != nil {
+		return errors.Wrap(err, "EvaluateSmartGroups: load smart groups")
+	}
+
+	if len(smartGroups) == 0 {
+		return nil
+	}
+
+	device, err := GetDevice(udid)
+	if err != nil {
+		return errors.Wrap(err, "EvaluateSmartGroups")
+	}
+
+	err = db.DB.Where("device_ud_id = ?", udid).Limit(1).Find(&securityInfo).Error
+	if err != nil {
+		return errors.Wrap(err, "EvaluateSmartGroups: load SecurityInfo")
+	}
+
+	err = db.DB.Where("device_ud_id = ?", udid).Find(&profileLists).Error
+	if err != nil {
+		return errors.Wrap(err, "EvaluateSmartGroups: load ProfileList")
+	}
+
+	err = db.DB.Where("device_ud_id = ?", udid).Find(&members).Error
+	if err != nil {
+		return errors.Wrap(err, "EvaluateSmartGroups: load group membership")
+	}
+
+	currentGroups := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		currentGroups[member.GroupID.String()] = struct{}{}
+	}
+
+	attributes := deviceAttributes(device, securityInfo, profileLists)
+	changed := false
+	for _, group := range smartGroups {
+		_, isMember := currentGroups[group.ID.String()]
+		shouldBeMember := deviceMatchesRules(attributes, group.Rules)
+		member := types.DeviceGroupMember{GroupID: group.ID, DeviceUDID: udid}
+
+		switch {
+		case shouldBeMember && !isMember:
+			err = db.DB.Where(&member).FirstOrCreate(&member).Error
+			if err != nil {
+				return errors.Wrap(err, "EvaluateSmartGroups: add member")
+			}
+			InfoLogger(LogHolder{DeviceUDID: udid, DeviceSerial: device.SerialNumber, Message: "Device joined smart group", Metric: group.Name})
+			changed = true
+		case !shouldBeMember && isMember:
+			err = db.DB.Transaction(func(tx *gorm.DB) error {
+				return removeDeviceGroupMember(tx, group.ID, udid)
+			})
+			if err != nil {
+				return errors.Wrap(err, "EvaluateSmartGroups: remove member")
+			}
+			InfoLogger(LogHolder{DeviceUDID: udid, DeviceSerial: device.SerialNumber, Message: "Device left smart group", Metric: group.Name})
+			changed = true
+		}
+	}
+
+	if changed {
+		err = RequestProfileList(device)
+		if err != nil {
+			return errors.Wrap(err, "EvaluateSmartGroups")
+		}
+	}
+
+	return nil
+}
+
+// evaluateSmartGroupsLater evaluates the smart groups of a device in the background, so webhook events don't wait on
+// it. Events that arrive while an evaluation is pending for the device share it. Pending evaluations only live in
+// memory and are lost on restart, the device's next webhook event queues another one, at the latest after its
+// scheduled check-in.
+func evaluateSmartGroupsLater(udid string) {
+	if udid == "" {
+		return
+	}
+
+	pendingSmartGroupEvaluations.Lock()
+	_, pending := pendingSmartGroupEvaluations.udids[udid]
+	pendingSmartGroupEvaluations.udids[udid] = struct{}{}
+	pendingSmartGroupEvaluations.Unlock()
+	if pending {
+		return
+	}
+
+	time.AfterFunc(smartGroupEvaluationDelay, func() {
+		pendingSmartGroupEvaluations.Lock()
+		delete(pendingSmartGroupEvaluations.udids, udid)
+		pendingSmartGroupEvaluations.Unlock()
+
+		err := EvaluateSmartGroups(udid)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: udid, Message: err.Error()})
+		}
+	})
+}
+
+// evaluateSmartGroupForAllDevices populates a smart group after it has been created or its rules have changed
+func evaluateSmartGroupForAllDevices(group types.DeviceGroup) {
+	var devices []types.Device
+	err := db.DB.Select("ud_id").Find(&devices).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		return
+	}
+
+	InfoLogger(LogHolder{Message: "Evaluating smart group for all devices", Metric: group.Name})
+	for _, device := range devices {
+		err = EvaluateSmartGroups(device.UDID)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, Message: fmt.Sprintf("evaluating smart group %v: %v", group.Name, err)})
+		}
+	}
+}
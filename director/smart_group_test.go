@@ -0,0 +1,136 @@
+package director
+
+import (
+	"testing"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAttributes(t *testing.T) {
+	device := types.Device{
+		UDID:        "1234-5678-123456",
+		ProductName: "iPad8,1",
+		OSVersion:   "13.6.1",
+	}
+	securityInfo := types.SecurityInfo{FDEEnabled: true}
+	profileLists := []types.ProfileList{
+		{PayloadIdentifier: "com.example.wifi"},
+		{PayloadIdentifier: "com.example.vpn"},
+	}
+
+	attributes := deviceAttributes(device, securityInfo, profileLists)
+
+	assert.Equal(t, []string{"iPad8,1"}, attributes["ProductName"])
+	assert.Equal(t, []string{"13.6.1"}, attributes["OSVersion"])
+	assert.Equal(t, []string{"true"}, attributes["FDEEnabled"])
+	assert.Equal(t, []string{"com.example.wifi", "com.example.vpn"}, attributes[profileIdentifierAttribute])
+}
+
+func TestDeviceMatchesRules(t *testing.T) {
+	attributes := map[string][]string{
+		"ProductName":              {"iPad8,1"},
+		"OSVersion":                {"13.6.1"},
+		"FDEEnabled":               {"false"},
+		"BatteryLevel":             {"0.45"},
+		profileIdentifierAttribute: {"com.example.wifi", "com.example.vpn"},
+	}
+
+	tests := []struct {
+		name  string
+		rules []types.DeviceGroupRule
+		want  bool
+	}{
+		{
+			name:  "no rules never match",
+			rules: nil,
+			want:  false,
+		},
+		{
+			name:  "starts with",
+			rules: []types.DeviceGroupRule{{Attribute: "ProductName", Operator: "starts_with", Value: "ipad"}},
+			want:  true,
+		},
+		{
+			name:  "version less than",
+			rules: []types.DeviceGroupRule{{Attribute: "OSVersion", Operator: "lt", Value: "14.0"}},
+			want:  true,
+		},
+		{
+			name:  "version compared numerically",
+			rules: []types.DeviceGroupRule{{Attribute: "OSVersion", Operator: "gt", Value: "9.0"}},
+			want:  true,
+		},
+		{
+			name:  "versions with two digit components",
+			rules: []types.DeviceGroupRule{{Attribute: "OSVersion", Operator: "lt", Value: "13.10"}},
+			want:  true,
+		},
+		{
+			name:  "bool equals",
+			rules: []types.DeviceGroupRule{{Attribute: "FDEEnabled", Operator: "eq", Value: "false"}},
+			want:  true,
+		},
+		{
+			name:  "float compare",
+			rules: []types.DeviceGroupRule{{Attribute: "BatteryLevel", Operator: "lte", Value: "0.5"}},
+			want:  true,
+		},
+		{
+			name:  "any profile identifier matches",
+			rules: []types.DeviceGroupRule{{Attribute: profileIdentifierAttribute, Operator: "eq", Value: "com.example.vpn"}},
+			want:  true,
+		},
+		{
+			name:  "not equal checks every value",
+			rules: []types.DeviceGroupRule{{Attribute: profileIdentifierAttribute, Operator: "ne", Value: "com.example.vpn"}},
+			want:  false,
+		},
+		{
+			name:  "missing attribute does not compare",
+			rules: []types.DeviceGroupRule{{Attribute: "Missing", Operator: "lt", Value: "1"}},
+			want:  false,
+		},
+		{
+			name: "all rules must match",
+			rules: []types.DeviceGroupRule{
+				{Attribute: "ProductName", Operator: "starts_with", Value: "iPad"},
+				{Attribute: "OSVersion", Operator: "gte", Value: "14.0"},
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, deviceMatchesRules(attributes, tt.rules))
+		})
+	}
+}
+
+func TestValidateSmartGroupRules(t *testing.T) {
+	rules := normalizeSmartGroupRules([]types.DeviceGroupRule{
+		{Attribute: " OSVersion ", Operator: "<", Value: "14.0"},
+	})
+	assert.NoError(t, validateSmartGroupRules(rules))
+	assert.Equal(t, "OSVersion", rules[0].Attribute)
+	assert.Equal(t, "lt", rules[0].Operator)
+
+	assert.Error(t, validateSmartGroupRules(nil))
+	assert.Error(t, validateSmartGroupRules([]types.DeviceGroupRule{{Attribute: "OSVersion", Operator: "like"}}))
+	assert.Error(t, validateSmartGroupRules([]types.DeviceGroupRule{{Operator: "eq"}}))
+}
+
+func TestValidateSmartGroupRules_RejectsSecrets(t *testing.T) {
+	for _, attribute := range []string{"UnlockPin", "TempUnlockPin", "PushToken", "PushMagic"} {
+		t.Run(attribute, func(t *testing.T) {
+			assert.Error(t, validateSmartGroupRules([]types.DeviceGroupRule{{Attribute: attribute, Operator: "eq", Value: "123456"}}))
+		})
+	}
+
+	// rules saved before the check never match on the secret
+	attributes := deviceAttributes(types.Device{UnlockPin: "123456", PushToken: "token"}, types.SecurityInfo{}, nil)
+	assert.NotContains(t, attributes, "UnlockPin")
+	assert.NotContains(t, attributes, "PushToken")
+	assert.False(t, deviceMatchesRules(attributes, []types.DeviceGroupRule{{Attribute: "UnlockPin", Operator: "eq", Value: "123456"}}))
+}
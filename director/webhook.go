@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -38,32 +39,78 @@ func profileListDataJSON(profileListData types.ProfileListData) ([]byte, error)
 	return jsonBlob, nil
 }
 
+// WebhookHandler acknowledges an event from MicroMDM once it has been queued, the event is processed by the webhook
+// workers so MicroMDM isn't held up by the database
 func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	var out types.PostPayload
 
-	err := json.NewDecoder(r.Body).Decode(&out)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		ErrorLogger(LogHolder{Message: err.Error()})
+		err = errors.Wrap(err, "reading body")
+	} else if err = json.Unmarshal(body, &out); err != nil {
+		err = errors.Wrap(err, "body is not a JSON webhook event")
+	} else {
+		err = validateWebhookEvent(out)
 	}
+	if err != nil {
+		rejectWebhookEvent(r, out, body, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if duplicateWebhookEvent(r.Context(), out.EventID) {
+		InfoLogger(LogHolder{Message: "Skipping webhook event that was already processed", Metric: out.EventID})
+		return
+	}
+
+	dispatchWebhookEvent(string(body), webhookEventUDID(out))
+}
 
+// webhookEventDevice reads the device fields from the raw payload of the event
+func webhookEventDevice(out types.PostPayload) (types.Device, error) {
 	var device types.Device
+	var err error
 
 	if out.CheckinEvent != nil {
 		err = plist.Unmarshal(out.CheckinEvent.RawPayload, &device)
-		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
-		}
 	} else if out.AcknowledgeEvent != nil {
 		err = plist.Unmarshal(out.AcknowledgeEvent.RawPayload, &device)
-		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
-		}
+	}
+	if err != nil {
+		return device, errors.Wrap(err, "webhookEventDevice")
+	}
+
+	return device, nil
+}
+
+// webhookEventUDID is the UDID MicroMDM received the event from
+func webhookEventUDID(out types.PostPayload) string {
+	if out.CheckinEvent != nil {
+		return out.CheckinEvent.UDID
+	}
+	if out.AcknowledgeEvent != nil {
+		return out.AcknowledgeEvent.UDID
+	}
+
+	return ""
+}
+
+// processWebhookEvent applies an event to the device. The event is saved first and errors saving it are returned so
+// the event is retried, nothing has been sent to the device by then. Errors from the work that sends commands are
+// logged as they always have been, so a retried event never sends them twice.
+func processWebhookEvent(out types.PostPayload) error {
+	device, err := webhookEventDevice(out)
+	if err != nil {
+		return err
+	}
+	if device.UDID == "" {
+		return fmt.Errorf("%v event has no device UDID", out.Topic)
 	}
 
 	if out.Topic == "mdm.CheckOut" {
 		err = ResetDevice(device)
 		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
+			return errors.Wrap(err, "processWebhookEvent: check out")
 		}
 	} else {
 		device.Active = true
@@ -73,34 +120,54 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 	case "mdm.Authenticate":
 		err = ResetDevice(device)
 		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
+			return errors.Wrap(err, "processWebhookEvent: authenticate")
 		}
 	case "mdm.TokenUpdate":
 		tokenUpdateDevice, err := SetTokenUpdate(device)
 		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
+			return errors.Wrap(err, "processWebhookEvent: token update")
 		}
 
 		if !tokenUpdateDevice.InitialTasksRun {
-			_, err := UpdateDevice(device)
+			_, err := saveDevice(&device)
 			if err != nil {
-				ErrorLogger(LogHolder{Message: err.Error()})
+				return errors.Wrap(err, "processWebhookEvent: token update")
+			}
+			err = configureDevice(device)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
 			}
 			InfoLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: "Running initial tasks due to device update"})
 			err = RunInitialTasks(device.UDID)
 			if err != nil {
 				ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
 			}
-			return
+			return nil
 		}
 	}
 	oldUDID := device.UDID
 	oldBuild := device.BuildVersion
-	if device.UDID == "" {
-		log.Error(out)
-		log.Fatal("No device UDID set")
+	updatedDevice, err := saveDevice(&device)
+	if err != nil {
+		return errors.Wrap(err, "processWebhookEvent")
+	}
+
+	var payloadDict map[string]interface{}
+	if out.AcknowledgeEvent != nil {
+		err = plist.Unmarshal(out.AcknowledgeEvent.RawPayload, &payloadDict)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
+		}
+
+		if out.AcknowledgeEvent.CommandUUID != "" {
+			err = UpdateCommand(out.AcknowledgeEvent, device, payloadDict)
+			if err != nil {
+				return errors.Wrap(err, "processWebhookEvent")
+			}
+		}
 	}
-	updatedDevice, err := UpdateDevice(device)
+
+	err = configureDevice(device)
 	if err != nil {
 		ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
 	}
@@ -111,7 +178,7 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
 		}
-		return
+		return nil
 	}
 
 	if utils.PushOnNewBuild() {
@@ -123,22 +190,9 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 
 	if out.AcknowledgeEvent != nil {
 
-		var payloadDict map[string]interface{}
-		err = plist.Unmarshal(out.AcknowledgeEvent.RawPayload, &payloadDict)
-		if err != nil {
-			ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
-		}
-
-		if out.AcknowledgeEvent.CommandUUID != "" {
-			err = UpdateCommand(out.AcknowledgeEvent, device, payloadDict)
-			if err != nil {
-				ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
-			}
-		}
-
 		if out.AcknowledgeEvent.Status == "Idle" {
 			RequestDeviceUpdate(device)
-			return
+			return nil
 		}
 
 		// Is this a ProfileList response?
@@ -150,7 +204,7 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 			err = plist.Unmarshal(out.AcknowledgeEvent.RawPayload, &profileListData)
 			if err != nil {
 				ErrorLogger(LogHolder{DeviceSerial: device.SerialNumber, DeviceUDID: device.UDID, Message: err.Error()})
-				return
+				return nil
 			}
 			jsonBlob, err := profileListDataJSON(profileListData)
 			if err != nil {
@@ -228,6 +282,8 @@ func WebhookHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+
+	return nil
 }
 
 func RequestDeviceUpdate(device types.Device) {
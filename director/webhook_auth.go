@@ -0,0 +1,114 @@
+package director
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookAuthSecret     = "secret"
+	webhookAuthHMAC       = "hmac"
+	webhookAuthClientCert = "client_cert"
+
+	webhookSecretHeader    = "X-Webhook-Secret"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookAuthConfig holds the verifications a webhook request has to pass, each is skipped when it isn't set
+type webhookAuthConfig struct {
+	secret           string
+	hmacKey          string
+	clientCertSHA256 map[string]bool
+}
+
+// WebhookAuth verifies webhook requests with the -webhook-secret, -webhook-hmac-key and
+// -webhook-client-cert-sha256 that are set
+func WebhookAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return webhookAuthHandler(handler, webhookAuthConfig{
+		secret:           utils.WebhookSecret(),
+		hmacKey:          utils.WebhookHMACKey(),
+		clientCertSHA256: parseCertificateFingerprints(utils.WebhookClientCertSHA256()),
+	})
+}
+
+func webhookAuthHandler(handler http.HandlerFunc, config webhookAuthConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode, err := verifyWebhookRequest(r, config)
+		if err != nil {
+			WebhookAuthFailures.WithLabelValues(mode).Inc()
+			WarnLogger(LogHolder{Message: "Unauthorised webhook request", Metric: fmt.Sprintf("%v: %v", r.RemoteAddr, err.Error())})
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// parseCertificateFingerprints reads comma separated SHA-256 fingerprints, in hex with or without colons
+func parseCertificateFingerprints(fingerprints string) map[string]bool {
+	parsed := make(map[string]bool)
+	for _, fingerprint := range strings.Split(fingerprints, ",") {
+		fingerprint = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if fingerprint != "" {
+			parsed[fingerprint] = true
+		}
+	}
+
+	return parsed
+}
+
+// verifyWebhookRequest returns the verification the request failed and why
+func verifyWebhookRequest(r *http.Request, config webhookAuthConfig) (string, error) {
+	if len(config.clientCertSHA256) > 0 {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return webhookAuthClientCert, errors.New("no client certificate")
+		}
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+		if !config.clientCertSHA256[fingerprint] {
+			return webhookAuthClientCert, fmt.Errorf("client certificate %v is not pinned", fingerprint)
+		}
+	}
+
+	if config.secret != "" {
+		secret := r.Header.Get(webhookSecretHeader)
+		if secret == "" {
+			secret = r.URL.Query().Get("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(config.secret)) != 1 {
+			return webhookAuthSecret, errors.New("secret does not match")
+		}
+	}
+
+	if config.hmacKey != "" {
+		signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(webhookSignatureHeader), "sha256="))
+		if err != nil || len(signature) == 0 {
+			return webhookAuthHMAC, errors.New("no hex encoded signature")
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return webhookAuthHMAC, errors.Wrap(err, "reading body")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		mac := hmac.New(sha256.New, []byte(config.hmacKey))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return webhookAuthHMAC, errors.New("signature does not match")
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,164 @@
+package director
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCertificateFingerprints(t *testing.T) {
+	require.Equal(t, map[string]bool{"abcd": true, "ef01": true}, parseCertificateFingerprints(" AB:CD ,ef01,,"))
+	require.Empty(t, parseCertificateFingerprints(""))
+}
+
+func TestWebhookAuthHandler(t *testing.T) {
+	body := `{"topic": "mdm.Connect"}`
+	mac := hmac.New(sha256.New, []byte("hmac-key"))
+	mac.Write([]byte(body))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	clientCert := &x509.Certificate{Raw: []byte("client certificate")}
+	sum := sha256.Sum256(clientCert.Raw)
+	pinned := map[string]bool{hex.EncodeToString(sum[:]): true}
+
+	tests := []struct {
+		name       string
+		config     webhookAuthConfig
+		target     string
+		headers    map[string]string
+		clientCert *x509.Certificate
+		failedMode string
+	}{
+		{
+			name:   "no verification",
+			target: "/webhook",
+		},
+		{
+			name:   "secret in query",
+			config: webhookAuthConfig{secret: "supersecret"},
+			target: "/webhook?secret=supersecret",
+		},
+		{
+			name:    "secret in header",
+			config:  webhookAuthConfig{secret: "supersecret"},
+			target:  "/webhook",
+			headers: map[string]string{webhookSecretHeader: "supersecret"},
+		},
+		{
+			name:       "missing secret",
+			config:     webhookAuthConfig{secret: "supersecret"},
+			target:     "/webhook",
+			failedMode: webhookAuthSecret,
+		},
+		{
+			name:       "wrong secret",
+			config:     webhookAuthConfig{secret: "supersecret"},
+			target:     "/webhook?secret=guess",
+			failedMode: webhookAuthSecret,
+		},
+		{
+			name:    "signed body",
+			config:  webhookAuthConfig{hmacKey: "hmac-key"},
+			target:  "/webhook",
+			headers: map[string]string{webhookSignatureHeader: "sha256=" + signature},
+		},
+		{
+			name:    "signed body without prefix",
+			config:  webhookAuthConfig{hmacKey: "hmac-key"},
+			target:  "/webhook",
+			headers: map[string]string{webhookSignatureHeader: signature},
+		},
+		{
+			name:       "unsigned body",
+			config:     webhookAuthConfig{hmacKey: "hmac-key"},
+			target:     "/webhook",
+			failedMode: webhookAuthHMAC,
+		},
+		{
+			name:       "signed with another key",
+			config:     webhookAuthConfig{hmacKey: "another-key"},
+			target:     "/webhook",
+			headers:    map[string]string{webhookSignatureHeader: signature},
+			failedMode: webhookAuthHMAC,
+		},
+		{
+			name:       "pinned client certificate",
+			config:     webhookAuthConfig{clientCertSHA256: pinned},
+			target:     "/webhook",
+			clientCert: clientCert,
+		},
+		{
+			name:       "no client certificate",
+			config:     webhookAuthConfig{clientCertSHA256: pinned},
+			target:     "/webhook",
+			failedMode: webhookAuthClientCert,
+		},
+		{
+			name:       "client certificate that isn't pinned",
+			config:     webhookAuthConfig{clientCertSHA256: pinned},
+			target:     "/webhook",
+			clientCert: &x509.Certificate{Raw: []byte("another certificate")},
+			failedMode: webhookAuthClientCert,
+		},
+		{
+			name:       "every verification",
+			config:     webhookAuthConfig{secret: "supersecret", hmacKey: "hmac-key", clientCertSHA256: pinned},
+			target:     "/webhook?secret=supersecret",
+			headers:    map[string]string{webhookSignatureHeader: signature},
+			clientCert: clientCert,
+		},
+		{
+			name:       "every verification but the signature",
+			config:     webhookAuthConfig{secret: "supersecret", hmacKey: "hmac-key", clientCertSHA256: pinned},
+			target:     "/webhook?secret=supersecret",
+			clientCert: clientCert,
+			failedMode: webhookAuthHMAC,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			handler := webhookAuthHandler(func(w http.ResponseWriter, r *http.Request) {
+				read, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				received = string(read)
+			}, tt.config)
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(body))
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			if tt.clientCert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.clientCert}}
+			}
+
+			var failures float64
+			if tt.failedMode != "" {
+				failures = testutil.ToFloat64(WebhookAuthFailures.WithLabelValues(tt.failedMode))
+			}
+
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if tt.failedMode != "" {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Empty(t, received)
+				require.Equal(t, failures+1, testutil.ToFloat64(WebhookAuthFailures.WithLabelValues(tt.failedMode)))
+				return
+			}
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, body, received)
+		})
+	}
+}
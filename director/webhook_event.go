@@ -0,0 +1,100 @@
+package director
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookEventKeyPrefix = "mdmdirector:webhook_event:"
+	// webhookEventInFlightTTL is how long an event that was received but not processed yet is treated as a duplicate.
+	// It covers the retries of the event and its wait for the earlier events of the device.
+	webhookEventInFlightTTL = 15 * time.Minute
+)
+
+// webhookEventStore remembers the webhook events that are being processed or have been processed
+type webhookEventStore interface {
+	// claim records the event as in flight, returning false if it is already in flight or processed
+	claim(ctx context.Context, eventID string, ttl time.Duration) (bool, error)
+	// markProcessed records the event as processed
+	markProcessed(ctx context.Context, eventID string, ttl time.Duration) error
+	// release forgets the event, so it is processed if MicroMDM delivers it again
+	release(ctx context.Context, eventID string) error
+}
+
+type redisWebhookEventStore struct {
+	client *redis.Client
+}
+
+func (store redisWebhookEventStore) claim(ctx context.Context, eventID string, ttl time.Duration) (bool, error) {
+	return store.client.SetNX(ctx, webhookEventKeyPrefix+eventID, "in_flight", ttl).Result()
+}
+
+func (store redisWebhookEventStore) markProcessed(ctx context.Context, eventID string, ttl time.Duration) error {
+	return store.client.Set(ctx, webhookEventKeyPrefix+eventID, "processed", ttl).Err()
+}
+
+func (store redisWebhookEventStore) release(ctx context.Context, eventID string) error {
+	return store.client.Del(ctx, webhookEventKeyPrefix+eventID).Err()
+}
+
+// webhookEvents is nil until StartWebhookEventDeduplication is called, every event is processed until then
+var webhookEvents webhookEventStore
+
+// StartWebhookEventDeduplication records the ID of each processed webhook event in Redis for -webhook-event-ttl, so
+// events MicroMDM delivers again are acknowledged without being processed twice
+func StartWebhookEventDeduplication(client *redis.Client) {
+	if utils.WebhookEventTTL() <= 0 {
+		return
+	}
+
+	webhookEvents = redisWebhookEventStore{client: client}
+}
+
+// duplicateWebhookEvent reports whether the event is being processed or was processed already, otherwise it is
+// recorded as in flight. Events without an ID, and events that can't be checked because the store is unavailable,
+// are processed.
+func duplicateWebhookEvent(ctx context.Context, eventID string) bool {
+	if webhookEvents == nil || eventID == "" {
+		return false
+	}
+
+	first, err := webhookEvents.claim(ctx, eventID, webhookEventInFlightTTL)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "duplicateWebhookEvent").Error(), Metric: eventID})
+		return false
+	}
+	if !first {
+		DuplicateWebhookEvents.Inc()
+	}
+
+	return !first
+}
+
+// webhookEventProcessed records the event as processed for -webhook-event-ttl
+func webhookEventProcessed(eventID string) {
+	if webhookEvents == nil || eventID == "" {
+		return
+	}
+
+	err := webhookEvents.markProcessed(context.Background(), eventID, time.Duration(utils.WebhookEventTTL())*time.Minute)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "webhookEventProcessed").Error(), Metric: eventID})
+	}
+}
+
+// releaseWebhookEvent forgets an event that failed, so it is processed if MicroMDM delivers it again
+func releaseWebhookEvent(eventID string) {
+	if webhookEvents == nil || eventID == "" {
+		return
+	}
+
+	err := webhookEvents.release(context.Background(), eventID)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "releaseWebhookEvent").Error(), Metric: eventID})
+	}
+}
@@ -0,0 +1,111 @@
+package director
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryWebhookEventStore struct {
+	events map[string]string
+	err    error
+}
+
+func (store *memoryWebhookEventStore) claim(ctx context.Context, eventID string, ttl time.Duration) (bool, error) {
+	if store.err != nil {
+		return false, store.err
+	}
+	if store.events[eventID] != "" {
+		return false, nil
+	}
+	store.events[eventID] = "in_flight"
+	return true, nil
+}
+
+func (store *memoryWebhookEventStore) markProcessed(ctx context.Context, eventID string, ttl time.Duration) error {
+	if store.err != nil {
+		return store.err
+	}
+	store.events[eventID] = "processed"
+	return nil
+}
+
+func (store *memoryWebhookEventStore) release(ctx context.Context, eventID string) error {
+	if store.err != nil {
+		return store.err
+	}
+	delete(store.events, eventID)
+	return nil
+}
+
+func useWebhookEventStore(t *testing.T, store webhookEventStore) {
+	if flag.Lookup("webhook-event-ttl") == nil {
+		flag.Int("webhook-event-ttl", 60, "")
+	}
+	previous := webhookEvents
+	webhookEvents = store
+	t.Cleanup(func() { webhookEvents = previous })
+}
+
+func TestDuplicateWebhookEvent(t *testing.T) {
+	useWebhookEventStore(t, &memoryWebhookEventStore{events: make(map[string]string)})
+	duplicates := testutil.ToFloat64(DuplicateWebhookEvents)
+
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-1"))
+	require.True(t, duplicateWebhookEvent(context.Background(), "event-1"))
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-2"))
+	require.False(t, duplicateWebhookEvent(context.Background(), ""))
+	require.False(t, duplicateWebhookEvent(context.Background(), ""))
+	require.Equal(t, duplicates+1, testutil.ToFloat64(DuplicateWebhookEvents))
+}
+
+func TestDuplicateWebhookEvent_ReleasedWhenFailed(t *testing.T) {
+	store := &memoryWebhookEventStore{events: make(map[string]string)}
+	useWebhookEventStore(t, store)
+
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-1"))
+	require.Equal(t, "in_flight", store.events["event-1"])
+	require.True(t, duplicateWebhookEvent(context.Background(), "event-1"))
+
+	releaseWebhookEvent("event-1")
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-1"))
+
+	webhookEventProcessed("event-1")
+	require.Equal(t, "processed", store.events["event-1"])
+	require.True(t, duplicateWebhookEvent(context.Background(), "event-1"))
+}
+
+func TestDuplicateWebhookEvent_StoreUnavailable(t *testing.T) {
+	useWebhookEventStore(t, &memoryWebhookEventStore{err: errors.New("connection refused")})
+
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-1"))
+	require.False(t, duplicateWebhookEvent(context.Background(), "event-1"))
+}
+
+func TestWebhookHandler_SkipsDuplicateEvent(t *testing.T) {
+	useWebhookEventStore(t, &memoryWebhookEventStore{events: map[string]string{"event-1": "processed"}})
+
+	body := testWebhookBody(t, types.PostPayload{
+		Topic:   "mdm.Connect",
+		EventID: "event-1",
+		AcknowledgeEvent: &types.AcknowledgeEvent{
+			UDID:       "1234-5678-123456",
+			Status:     "Idle",
+			RawPayload: testRawPayload(t, map[string]string{"UDID": "1234-5678-123456"}),
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	WebhookHandler(rr, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+}
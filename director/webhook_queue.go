@@ -0,0 +1,241 @@
+package director
+
+import (
+	"context"
+	"encoding/json"
+	intErrors "errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/taskq/v3"
+	"gorm.io/gorm"
+)
+
+const (
+	// webhookEventOrderWait is how long an event waits for the events of its device received before it, after that
+	// they are treated as lost
+	webhookEventOrderWait = 10 * time.Minute
+	// webhookEventOrderDelay is how long an event that is waiting is put back on the queue for
+	webhookEventOrderDelay = time.Second
+)
+
+var ErrWebhookQueueNotStarted = errors.New("webhook queue has not been started")
+
+var webhookQueue taskq.Queue
+
+var webhookTask *taskq.Task
+
+// StartWebhookQueue processes webhook events from the queue. An event is tried -webhook-retry-limit times before it
+// is saved as a dead letter.
+func StartWebhookQueue(queue taskq.Queue) {
+	webhookTask = taskq.RegisterTask(&taskq.TaskOptions{
+		Name:       "webhook_event",
+		RetryLimit: utils.WebhookRetryLimit(),
+		Handler:    processQueuedWebhookEvent,
+		FallbackHandler: func(msg *taskq.Message) error {
+			return taskq.NewHandler(func(body string, sequence int64, _ time.Time) error {
+				return deadLetterWebhookEvent(body, msg.Err, msg.ReservedCount, sequence)
+			}).HandleMessage(msg)
+		},
+	})
+
+	err := queue.Consumer().Start(context.Background())
+	if err != nil {
+		ErrorLogger(LogHolder{Message: fmt.Errorf("starting webhook consumer: %v", err.Error()).Error()})
+		return
+	}
+
+	webhookQueue = queue
+}
+
+func enqueueWebhookEvent(body string, sequence int64, receivedAt time.Time, delay time.Duration) error {
+	if webhookQueue == nil {
+		return ErrWebhookQueueNotStarted
+	}
+
+	msg := webhookTask.WithArgs(context.Background(), body, sequence, receivedAt)
+	msg.Delay = delay
+	err := webhookQueue.Add(msg)
+	if err != nil {
+		return errors.Wrap(err, "enqueueWebhookEvent")
+	}
+
+	return nil
+}
+
+// dispatchWebhookEvent numbers the event in the order the device's events were received and queues it for the webhook
+// workers. If it can't be queued it is processed straight away and saved as a dead letter if that fails, so the
+// event isn't lost.
+func dispatchWebhookEvent(body string, udid string) {
+	sequence := nextDeviceEvent(udid)
+
+	err := enqueueWebhookEvent(body, sequence, time.Now(), 0)
+	if err == nil {
+		return
+	}
+	if !intErrors.Is(err, ErrWebhookQueueNotStarted) {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+
+	err = processWebhookBody(body, sequence, false)
+	if err != nil {
+		deadLetterErr := deadLetterWebhookEvent(body, err, 1, sequence)
+		if deadLetterErr != nil {
+			ErrorLogger(LogHolder{Message: deadLetterErr.Error()})
+		}
+	}
+}
+
+// processQueuedWebhookEvent processes an event from the queue. An event received before another of the device that
+// is still to be processed is put back on the queue, and one received after events that were already processed is
+// saved as a dead letter.
+func processQueuedWebhookEvent(body string, sequence int64, receivedAt time.Time) error {
+	err := processWebhookBody(body, sequence, time.Since(receivedAt) > webhookEventOrderWait)
+	if intErrors.Is(err, errDeviceEventNotNext) {
+		return enqueueWebhookEvent(body, sequence, receivedAt, webhookEventOrderDelay)
+	}
+	if intErrors.Is(err, errDeviceEventLate) {
+		return deadLetterWebhookEvent(body, err, 1, sequence)
+	}
+
+	return err
+}
+
+func processWebhookBody(body string, sequence int64, skipGap bool) error {
+	var out types.PostPayload
+
+	err := json.Unmarshal([]byte(body), &out)
+	if err != nil {
+		return errors.Wrap(err, "processWebhookBody")
+	}
+
+	udid := webhookEventUDID(out)
+	err = withDeviceLock(udid, func() error {
+		return inDeviceOrder(udid, sequence, skipGap, func() error {
+			return processWebhookEvent(out)
+		})
+	})
+	if err != nil {
+		if !intErrors.Is(err, errDeviceEventNotNext) {
+			ErrorLogger(LogHolder{Message: err.Error(), Metric: out.EventID})
+		}
+		return err
+	}
+
+	webhookEventProcessed(out.EventID)
+
+	return nil
+}
+
+// deadLetterWebhookEvent saves an event that couldn't be processed, the later events of the device carry on without it
+func deadLetterWebhookEvent(body string, eventErr error, attempts int, sequence int64) error {
+	var out types.PostPayload
+
+	deadLetter := types.WebhookDeadLetter{Payload: body, Attempts: attempts}
+	if eventErr != nil {
+		deadLetter.Error = eventErr.Error()
+	}
+	if json.Unmarshal([]byte(body), &out) == nil {
+		deadLetter.EventID = out.EventID
+		deadLetter.Topic = out.Topic
+		deadLetter.DeviceUDID = webhookEventUDID(out)
+	}
+
+	err := db.DB.Create(&deadLetter).Error
+	if err != nil {
+		return errors.Wrap(err, "deadLetterWebhookEvent")
+	}
+
+	WebhookDeadLetters.Inc()
+	ErrorLogger(LogHolder{DeviceUDID: deadLetter.DeviceUDID, Message: "Webhook event failed, saved as a dead letter", Metric: deadLetter.ID.String()})
+	skipDeviceEvent(deadLetter.DeviceUDID, sequence)
+	releaseWebhookEvent(deadLetter.EventID)
+
+	return nil
+}
+
+func writeWebhookDeadLetters(w http.ResponseWriter, v interface{}) {
+	output, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
+
+// GetWebhookDeadLettersHandler lists the webhook events that failed, newest first. They can be filtered by topic, udid
+// and replayed=true or false.
+func GetWebhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	var deadLetters []types.WebhookDeadLetter
+	query := r.URL.Query()
+
+	tx := db.DB.Model(&types.WebhookDeadLetter{})
+	if topic := query.Get("topic"); topic != "" {
+		tx = tx.Where("topic = ?", topic)
+	}
+	if udid := query.Get("udid"); udid != "" {
+		tx = tx.Where("device_ud_id = ?", udid)
+	}
+	switch query.Get("replayed") {
+	case "":
+	case "true":
+		tx = tx.Where("replayed_at IS NOT NULL")
+	case "false":
+		tx = tx.Where("replayed_at IS NULL")
+	default:
+		http.Error(w, "replayed must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	err := tx.Order("created_at desc").Find(&deadLetters).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeWebhookDeadLetters(w, &deadLetters)
+}
+
+// PostWebhookDeadLetterReplayHandler sends a dead letter through the webhook workers again. If it fails again it is
+// saved as a new dead letter.
+func PostWebhookDeadLetterReplayHandler(w http.ResponseWriter, r *http.Request) {
+	var deadLetter types.WebhookDeadLetter
+	vars := mux.Vars(r)
+
+	err := db.DB.Where("id = ?", vars["id"]).First(&deadLetter).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		if intErrors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	now := time.Now()
+	err = db.DB.Model(&deadLetter).Update("replayed_at", now).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	deadLetter.ReplayedAt = &now
+
+	InfoLogger(LogHolder{DeviceUDID: deadLetter.DeviceUDID, Message: "Replaying webhook event", Metric: deadLetter.ID.String()})
+	dispatchWebhookEvent(deadLetter.Payload, deadLetter.DeviceUDID)
+
+	writeWebhookDeadLetters(w, &deadLetter)
+}
@@ -0,0 +1,99 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestDeadLetterWebhookEvent(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	rawPayload, err := plist.Marshal(map[string]string{"UDID": "1234-5678-123456", "Status": "Acknowledged"})
+	require.NoError(t, err)
+	body, err := json.Marshal(types.PostPayload{
+		Topic:            "mdm.Connect",
+		EventID:          "event-1",
+		AcknowledgeEvent: &types.AcknowledgeEvent{UDID: "1234-5678-123456", RawPayload: rawPayload, Status: "Acknowledged"},
+	})
+	require.NoError(t, err)
+
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectQuery(`^INSERT INTO "webhook_dead_letters"`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "event-1", "mdm.Connect", "1234-5678-123456", string(body), "connection refused", 5, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mockSpy.ExpectCommit()
+
+	store := &memoryWebhookEventStore{events: map[string]string{"event-1": "in_flight"}}
+	useWebhookEventStore(t, store)
+
+	deadLetters := testutil.ToFloat64(WebhookDeadLetters)
+	require.NoError(t, deadLetterWebhookEvent(string(body), errors.New("connection refused"), 5, 0))
+	require.Equal(t, deadLetters+1, testutil.ToFloat64(WebhookDeadLetters))
+	require.NotContains(t, store.events, "event-1")
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestGetWebhookDeadLettersHandler(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "webhook_dead_letters" WHERE topic = \$1 AND replayed_at IS NULL ORDER BY created_at desc`).
+		WithArgs("mdm.Connect").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "error", "attempts"}).
+			AddRow(uuid.New(), "mdm.Connect", "connection refused", 5))
+
+	rr := httptest.NewRecorder()
+	GetWebhookDeadLettersHandler(rr, httptest.NewRequest(http.MethodGet, "/webhook/dead-letters?topic=mdm.Connect&replayed=false", nil))
+
+	var deadLetters []types.WebhookDeadLetter
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &deadLetters))
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, "connection refused", deadLetters[0].Error)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+
+	rr = httptest.NewRecorder()
+	GetWebhookDeadLettersHandler(rr, httptest.NewRequest(http.MethodGet, "/webhook/dead-letters?replayed=maybe", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestPostWebhookDeadLetterReplayHandler_NotFound(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	id := uuid.New().String()
+	mockSpy.ExpectQuery(`^SELECT \* FROM "webhook_dead_letters" WHERE id = \$1`).
+		WithArgs(id).
+		WillReturnError(gorm.ErrRecordNotFound)
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/webhook/dead-letters/"+id+"/replay", nil), map[string]string{"id": id})
+	rr := httptest.NewRecorder()
+	PostWebhookDeadLetterReplayHandler(rr, req)
+
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
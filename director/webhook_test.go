@@ -0,0 +1,200 @@
+package director
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func testRawPayload(t *testing.T, payload map[string]string) []byte {
+	rawPayload, err := plist.Marshal(payload)
+	require.NoError(t, err)
+	return rawPayload
+}
+
+func testWebhookBody(t *testing.T, out types.PostPayload) string {
+	body, err := json.Marshal(out)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestValidateWebhookEvent(t *testing.T) {
+	device := testRawPayload(t, map[string]string{"UDID": "1234-5678-123456"})
+
+	tests := []struct {
+		name string
+		out  types.PostPayload
+	}{
+		{
+			name: "check in",
+			out:  types.PostPayload{Topic: "mdm.TokenUpdate", CheckinEvent: &types.CheckinEvent{UDID: "1234-5678-123456", RawPayload: device}},
+		},
+		{
+			name: "acknowledged command",
+			out: types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{
+				UDID: "1234-5678-123456", Status: "Acknowledged", CommandUUID: "command-1", RawPayload: device,
+			}},
+		},
+		{
+			name: "idle",
+			out:  types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{UDID: "1234-5678-123456", Status: "Idle", RawPayload: device}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, validateWebhookEvent(tt.out))
+		})
+	}
+}
+
+func TestWebhookHandler_RejectsMalformedEvents(t *testing.T) {
+	device := testRawPayload(t, map[string]string{"UDID": "1234-5678-123456"})
+	noUDID := testRawPayload(t, map[string]string{"Status": "Acknowledged"})
+
+	tests := []struct {
+		name   string
+		body   string
+		topic  string
+		reason string
+	}{
+		{
+			name:   "empty body",
+			body:   "",
+			reason: "body is not a JSON webhook event",
+		},
+		{
+			name:   "truncated JSON",
+			body:   `{"topic": "mdm.Connect", "acknowledge_event": {`,
+			reason: "body is not a JSON webhook event",
+		},
+		{
+			name:   "raw payload is not base64",
+			body:   `{"topic": "mdm.Connect", "acknowledge_event": {"raw_payload": "not base64!"}}`,
+			topic:  "mdm.Connect",
+			reason: "body is not a JSON webhook event",
+		},
+		{
+			name:   "no topic",
+			body:   testWebhookBody(t, types.PostPayload{CheckinEvent: &types.CheckinEvent{RawPayload: device}}),
+			reason: "topic is required",
+		},
+		{
+			name:   "connect without acknowledge event",
+			body:   `{"topic": "mdm.Connect", "event_id": "event-1"}`,
+			topic:  "mdm.Connect",
+			reason: "mdm.Connect event has no acknowledge_event",
+		},
+		{
+			name:   "check in without checkin event",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Authenticate"}),
+			topic:  "mdm.Authenticate",
+			reason: "mdm.Authenticate event has no checkin_event",
+		},
+		{
+			name: "both events",
+			body: testWebhookBody(t, types.PostPayload{
+				Topic:            "mdm.Connect",
+				CheckinEvent:     &types.CheckinEvent{RawPayload: device},
+				AcknowledgeEvent: &types.AcknowledgeEvent{Status: "Acknowledged", CommandUUID: "command-1", RawPayload: device},
+			}),
+			topic:  "mdm.Connect",
+			reason: "event has both a checkin_event and an acknowledge_event",
+		},
+		{
+			name:   "check in without raw payload",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.TokenUpdate", CheckinEvent: &types.CheckinEvent{UDID: "1234-5678-123456"}}),
+			topic:  "mdm.TokenUpdate",
+			reason: "checkin_event has no raw_payload",
+		},
+		{
+			name:   "raw payload is not a property list",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.CheckOut", CheckinEvent: &types.CheckinEvent{RawPayload: []byte("not a plist")}}),
+			topic:  "mdm.CheckOut",
+			reason: "checkin_event raw_payload is not a property list",
+		},
+		{
+			name:   "check in without UDID",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Authenticate", CheckinEvent: &types.CheckinEvent{RawPayload: noUDID}}),
+			topic:  "mdm.Authenticate",
+			reason: "checkin_event raw_payload has no UDID",
+		},
+		{
+			name:   "acknowledge without status",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{CommandUUID: "command-1", RawPayload: device}}),
+			topic:  "mdm.Connect",
+			reason: "acknowledge_event has no status",
+		},
+		{
+			name:   "acknowledge with unknown status",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{Status: "Maybe", CommandUUID: "command-1", RawPayload: device}}),
+			topic:  "mdm.Connect",
+			reason: "acknowledge_event status Maybe is unknown",
+		},
+		{
+			name:   "acknowledge without command UUID",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{Status: "Error", RawPayload: device}}),
+			topic:  "mdm.Connect",
+			reason: "acknowledge_event with status Error has no command_uuid",
+		},
+		{
+			name:   "acknowledge without UDID",
+			body:   testWebhookBody(t, types.PostPayload{Topic: "mdm.Connect", AcknowledgeEvent: &types.AcknowledgeEvent{Status: "Acknowledged", CommandUUID: "command-1", RawPayload: noUDID}}),
+			topic:  "mdm.Connect",
+			reason: "acknowledge_event raw_payload has no UDID",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			postgresMock, mockSpy, _ := sqlmock.New()
+			defer postgresMock.Close()
+
+			DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+			db.DB = DB
+
+			mockSpy.ExpectBegin()
+			mockSpy.ExpectQuery(`^INSERT INTO "rejected_webhook_events"`).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), tt.topic, sqlmock.AnyArg(), sqlmock.AnyArg(), tt.body).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+			mockSpy.ExpectCommit()
+
+			rr := httptest.NewRecorder()
+			WebhookHandler(rr, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body)))
+
+			require.Equal(t, http.StatusBadRequest, rr.Code)
+			require.Contains(t, rr.Body.String(), tt.reason)
+			require.NoError(t, mockSpy.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRejectWebhookEvent_TruncatesPayload(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	body := "\x00\xff" + strings.Repeat("a", rejectedWebhookPayloadBytes)
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectQuery(`^INSERT INTO "rejected_webhook_events"`).
+		WithArgs(sqlmock.AnyArg(), "", "", "192.0.2.1:1234", "topic is required", strings.Repeat("a", rejectedWebhookPayloadBytes-2)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mockSpy.ExpectCommit()
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	rejectWebhookEvent(r, types.PostPayload{}, []byte(body), validateWebhookEvent(types.PostPayload{}))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
@@ -0,0 +1,131 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/groob/plist"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/pkg/errors"
+)
+
+const rejectedWebhookPayloadBytes = 64 * 1024
+
+var acknowledgeStatuses = map[string]bool{
+	"Acknowledged":       true,
+	"Error":              true,
+	"CommandFormatError": true,
+	"NotNow":             true,
+	"Idle":               true,
+}
+
+// validateWebhookEvent checks the event has what processing it relies on. mdm.Connect events carry a command
+// response, every other topic is a check in.
+func validateWebhookEvent(out types.PostPayload) error {
+	if out.Topic == "" {
+		return errors.New("topic is required")
+	}
+	if out.CheckinEvent != nil && out.AcknowledgeEvent != nil {
+		return errors.New("event has both a checkin_event and an acknowledge_event")
+	}
+
+	if out.Topic == "mdm.Connect" {
+		if out.AcknowledgeEvent == nil {
+			return fmt.Errorf("%v event has no acknowledge_event", out.Topic)
+		}
+		return validateAcknowledgeEvent(*out.AcknowledgeEvent)
+	}
+
+	if out.CheckinEvent == nil {
+		return fmt.Errorf("%v event has no checkin_event", out.Topic)
+	}
+	return validateRawPayload("checkin_event", out.CheckinEvent.RawPayload)
+}
+
+func validateAcknowledgeEvent(event types.AcknowledgeEvent) error {
+	if event.Status == "" {
+		return errors.New("acknowledge_event has no status")
+	}
+	if !acknowledgeStatuses[event.Status] {
+		return fmt.Errorf("acknowledge_event status %v is unknown", event.Status)
+	}
+	if event.Status != "Idle" && event.CommandUUID == "" {
+		return fmt.Errorf("acknowledge_event with status %v has no command_uuid", event.Status)
+	}
+
+	return validateRawPayload("acknowledge_event", event.RawPayload)
+}
+
+// validateRawPayload checks the raw payload is a property list naming the device
+func validateRawPayload(event string, rawPayload []byte) error {
+	var device types.Device
+
+	if len(rawPayload) == 0 {
+		return fmt.Errorf("%v has no raw_payload", event)
+	}
+	err := plist.Unmarshal(rawPayload, &device)
+	if err != nil {
+		return fmt.Errorf("%v raw_payload is not a property list: %v", event, err)
+	}
+	if device.UDID == "" {
+		return fmt.Errorf("%v raw_payload has no UDID", event)
+	}
+
+	return nil
+}
+
+// rejectWebhookEvent saves a webhook request that failed validation
+func rejectWebhookEvent(r *http.Request, out types.PostPayload, body []byte, reason error) {
+	if len(body) > rejectedWebhookPayloadBytes {
+		body = body[:rejectedWebhookPayloadBytes]
+	}
+
+	rejected := types.RejectedWebhookEvent{
+		EventID:    out.EventID,
+		Topic:      out.Topic,
+		RemoteAddr: r.RemoteAddr,
+		Reason:     reason.Error(),
+		Payload:    strings.ReplaceAll(strings.ToValidUTF8(string(body), ""), "\x00", ""),
+	}
+
+	WarnLogger(LogHolder{Message: "Rejected webhook event", Metric: rejected.Reason})
+	RejectedWebhookEvents.Inc()
+
+	err := db.DB.Create(&rejected).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: errors.Wrap(err, "rejectWebhookEvent").Error()})
+	}
+}
+
+// GetRejectedWebhookEventsHandler lists the webhook requests that failed validation, newest first. They can be
+// filtered by topic.
+func GetRejectedWebhookEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var rejected []types.RejectedWebhookEvent
+
+	tx := db.DB.Model(&types.RejectedWebhookEvent{})
+	if topic := r.URL.Query().Get("topic"); topic != "" {
+		tx = tx.Where("topic = ?", topic)
+	}
+
+	err := tx.Order("created_at desc").Find(&rejected).Error
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	output, err := json.MarshalIndent(&rejected, "", "    ")
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = w.Write(output)
+	if err != nil {
+		ErrorLogger(LogHolder{Message: err.Error()})
+	}
+}
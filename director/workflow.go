@@ -0,0 +1,229 @@
+package director
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/mdmdirector/mdmdirector/utils"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	workflowStepWaiting    = "waiting"
+	workflowStepReleased   = "released"
+	workflowStepTimedOut   = "timed_out"
+	workflowStepSuperseded = "superseded"
+
+	workflowInitialTasks = "initial_tasks"
+)
+
+// holdCommandUntil saves a step that sends the command once every prerequisite has been answered, replacing any
+// step of the workflow that is still waiting for the device. Without prerequisites the command is sent straight away.
+func holdCommandUntil(workflow string, device types.Device, commandPayload types.CommandPayload, prerequisites []types.Command) error {
+	var step types.WorkflowStep
+
+	err := db.DB.Model(&step).
+		Where("device_ud_id = ? AND workflow = ? AND status = ?", device.UDID, workflow, workflowStepWaiting).
+		Update("status", workflowStepSuperseded).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "holdCommandUntil: supersede steps")
+	}
+
+	command, err := json.Marshal(commandPayload)
+	if err != nil {
+		return errors.Wrap(err, "holdCommandUntil: marshal command")
+	}
+
+	step = types.WorkflowStep{
+		Workflow:    workflow,
+		DeviceUDID:  device.UDID,
+		RequestType: commandPayload.RequestType,
+		Command:     string(command),
+		Status:      workflowStepWaiting,
+		TimeoutAt:   time.Now().Add(time.Duration(utils.WorkflowStepTimeout()) * time.Minute),
+	}
+	for _, prerequisite := range prerequisites {
+		if prerequisite.CommandUUID != "" {
+			step.Prerequisites = append(step.Prerequisites, prerequisite.CommandUUID)
+		}
+	}
+
+	if len(step.Prerequisites) == 0 {
+		step.Status = workflowStepReleased
+		now := time.Now()
+		step.ReleasedAt = &now
+		err = db.DB.Create(&step).Error
+		if err != nil {
+			return errors.Wrap(err, "holdCommandUntil")
+		}
+		return releaseWorkflowStep(step)
+	}
+
+	err = db.DB.Create(&step).Error
+	if err != nil {
+		return errors.Wrap(err, "holdCommandUntil")
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandRequestType: step.RequestType, Message: "Holding command until prerequisites are acknowledged", Metric: fmt.Sprintf("%v commands", len(step.Prerequisites))})
+
+	return nil
+}
+
+// deviceHasWaitingStep reports whether a command of the request type is being held for the device
+func deviceHasWaitingStep(udid string, requestType string) (bool, error) {
+	var count int64
+
+	err := db.DB.Model(&types.WorkflowStep{}).
+		Where("device_ud_id = ? AND request_type = ? AND status = ?", udid, requestType, workflowStepWaiting).
+		Count(&count).
+		Error
+	if err != nil {
+		return false, errors.Wrap(err, "deviceHasWaitingStep")
+	}
+
+	return count > 0, nil
+}
+
+// advanceWorkflows releases the steps of the device that were waiting on the answered command and have no
+// prerequisites left. A prerequisite is answered once it is Acknowledged, or returned an Error that won't be retried.
+func advanceWorkflows(udid string, commandUUID string) error {
+	var steps []types.WorkflowStep
+
+	err := db.DB.Where("device_ud_id = ? AND status = ? AND ? = ANY(prerequisites)", udid, workflowStepWaiting, commandUUID).
+		Find(&steps).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "advanceWorkflows")
+	}
+
+	for _, step := range steps {
+		var unanswered int64
+		err = db.DB.Model(&types.Command{}).
+			Where("command_uuid IN ?", []string(step.Prerequisites)).
+			Where("NOT (status = ? OR (status = ? AND next_retry_at IS NULL))", "Acknowledged", "Error").
+			Count(&unanswered).
+			Error
+		if err != nil {
+			return errors.Wrap(err, "advanceWorkflows: count prerequisites")
+		}
+		if unanswered > 0 {
+			continue
+		}
+
+		err = claimWorkflowStep(&step, workflowStepReleased)
+		if err != nil {
+			ErrorLogger(LogHolder{DeviceUDID: udid, CommandRequestType: step.RequestType, Message: err.Error()})
+		}
+	}
+
+	return nil
+}
+
+// claimWorkflowStep moves a waiting step to the status and releases it. A step that was already claimed by another
+// acknowledgement is left alone.
+func claimWorkflowStep(step *types.WorkflowStep, status string) error {
+	var failed []types.Command
+
+	err := db.DB.Select("command_uuid", "request_type", "error_domain", "error_code").
+		Where("command_uuid IN ? AND status = ?", []string(step.Prerequisites), "Error").
+		Find(&failed).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "claimWorkflowStep: load failed prerequisites")
+	}
+	failures := make([]string, 0, len(failed))
+	for _, command := range failed {
+		failures = append(failures, fmt.Sprintf("%v %v failed with %v %v", command.RequestType, command.CommandUUID, command.ErrorDomain, command.ErrorCode))
+	}
+
+	now := time.Now()
+	result := db.DB.Model(&types.WorkflowStep{}).
+		Where("id = ? AND status = ?", step.ID, workflowStepWaiting).
+		Updates(map[string]interface{}{"status": status, "released_at": now, "error": strings.Join(failures, ", ")})
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "claimWorkflowStep")
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	step.Status = status
+	step.ReleasedAt = &now
+	return releaseWorkflowStep(*step)
+}
+
+// releaseWorkflowStep sends the held command. DeviceConfigured is sent the way initial tasks always have.
+func releaseWorkflowStep(step types.WorkflowStep) error {
+	var commandPayload types.CommandPayload
+
+	err := json.Unmarshal([]byte(step.Command), &commandPayload)
+	if err != nil {
+		return errors.Wrap(err, "releaseWorkflowStep: unmarshal command")
+	}
+
+	device, err := GetDevice(step.DeviceUDID)
+	if err != nil {
+		return errors.Wrap(err, "releaseWorkflowStep")
+	}
+
+	InfoLogger(LogHolder{DeviceUDID: device.UDID, DeviceSerial: device.SerialNumber, CommandRequestType: step.RequestType, Message: "Releasing held command", Metric: step.Status})
+
+	if commandPayload.RequestType == "DeviceConfigured" {
+		err = processDeviceConfigured(device)
+	} else {
+		_, err = SendCommand(commandPayload)
+	}
+	if err != nil {
+		updateErr := db.DB.Model(&types.WorkflowStep{}).Where("id = ?", step.ID).Update("error", err.Error()).Error
+		if updateErr != nil {
+			ErrorLogger(LogHolder{DeviceUDID: device.UDID, Message: updateErr.Error()})
+		}
+		return errors.Wrap(err, "releaseWorkflowStep")
+	}
+
+	return nil
+}
+
+// replaceWorkflowPrerequisite makes the steps waiting on a command wait on the command it was retried as instead
+func replaceWorkflowPrerequisite(commandUUID string, retriedAs string) error {
+	err := db.DB.Model(&types.WorkflowStep{}).
+		Where("status = ? AND ? = ANY(prerequisites)", workflowStepWaiting, commandUUID).
+		Update("prerequisites", gorm.Expr("array_replace(prerequisites, ?, ?)", commandUUID, retriedAs)).
+		Error
+	if err != nil {
+		return errors.Wrap(err, "replaceWorkflowPrerequisite")
+	}
+
+	return nil
+}
+
+// ScheduledWorkflowTimeouts releases the steps whose prerequisites weren't answered in -workflow-step-timeout, so a
+// device that never answers isn't held forever
+func ScheduledWorkflowTimeouts() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		var steps []types.WorkflowStep
+
+		err := db.DB.Where("status = ? AND timeout_at <= ?", workflowStepWaiting, time.Now()).Find(&steps).Error
+		if err != nil {
+			ErrorLogger(LogHolder{Message: err.Error()})
+			continue
+		}
+
+		for i := range steps {
+			WarnLogger(LogHolder{DeviceUDID: steps[i].DeviceUDID, CommandRequestType: steps[i].RequestType, Message: "Prerequisites were not acknowledged in time, releasing held command"})
+			err = claimWorkflowStep(&steps[i], workflowStepTimedOut)
+			if err != nil {
+				ErrorLogger(LogHolder{DeviceUDID: steps[i].DeviceUDID, CommandRequestType: steps[i].RequestType, Message: err.Error()})
+			}
+		}
+	}
+}
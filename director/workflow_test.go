@@ -0,0 +1,86 @@
+package director
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/mdmdirector/mdmdirector/db"
+	"github.com/mdmdirector/mdmdirector/types"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestHoldCommandUntil(t *testing.T) {
+	if flag.Lookup("workflow-step-timeout") == nil {
+		flag.Int("workflow-step-timeout", 15, "")
+	}
+
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "workflow_steps" SET "status"=\$1,"updated_at"=\$2 WHERE device_ud_id = \$3 AND workflow = \$4 AND status = \$5`).
+		WithArgs(workflowStepSuperseded, sqlmock.AnyArg(), "1234-5678-123456", workflowInitialTasks, workflowStepWaiting).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mockSpy.ExpectCommit()
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectQuery(`^INSERT INTO "workflow_steps"`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), workflowInitialTasks, "1234-5678-123456", "DeviceConfigured", sqlmock.AnyArg(),
+			`{"command-1","command-2"}`, workflowStepWaiting, sqlmock.AnyArg(), nil, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mockSpy.ExpectCommit()
+
+	err := holdCommandUntil(
+		workflowInitialTasks,
+		types.Device{UDID: "1234-5678-123456"},
+		types.CommandPayload{UDID: "1234-5678-123456", RequestType: "DeviceConfigured"},
+		[]types.Command{{CommandUUID: "command-1"}, {CommandUUID: ""}, {CommandUUID: "command-2"}},
+	)
+	require.NoError(t, err)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestAdvanceWorkflows_WaitsForPrerequisites(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT \* FROM "workflow_steps" WHERE device_ud_id = \$1 AND status = \$2 AND \$3 = ANY\(prerequisites\)`).
+		WithArgs("1234-5678-123456", workflowStepWaiting, "command-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "device_ud_id", "request_type", "prerequisites", "status"}).
+			AddRow(1, "1234-5678-123456", "DeviceConfigured", `{"command-1","command-2"}`, workflowStepWaiting))
+	mockSpy.ExpectQuery(`^SELECT count\(\*\) FROM "commands" WHERE command_uuid IN \(\$1,\$2\) AND \(NOT \(status = \$3 OR \(status = \$4 AND next_retry_at IS NULL\)\)\)`).
+		WithArgs("command-1", "command-2", "Acknowledged", "Error").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	require.NoError(t, advanceWorkflows("1234-5678-123456", "command-1"))
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
+
+func TestClaimWorkflowStep_AlreadyClaimed(t *testing.T) {
+	postgresMock, mockSpy, _ := sqlmock.New()
+	defer postgresMock.Close()
+
+	DB, _ := gorm.Open(postgres.New(postgres.Config{Conn: postgresMock}), &gorm.Config{})
+	db.DB = DB
+
+	mockSpy.ExpectQuery(`^SELECT "command_uuid","request_type","error_domain","error_code" FROM "commands" WHERE command_uuid IN \(\$1\) AND status = \$2`).
+		WithArgs("command-1", "Error").
+		WillReturnRows(sqlmock.NewRows([]string{"command_uuid"}))
+	mockSpy.ExpectBegin()
+	mockSpy.ExpectExec(`^UPDATE "workflow_steps" SET .* WHERE id = \$\d+ AND status = \$\d+`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mockSpy.ExpectCommit()
+
+	step := types.WorkflowStep{ID: 1, DeviceUDID: "1234-5678-123456", Prerequisites: []string{"command-1"}, Status: workflowStepWaiting}
+	require.NoError(t, claimWorkflowStep(&step, workflowStepReleased))
+	require.Equal(t, workflowStepWaiting, step.Status)
+	require.NoError(t, mockSpy.ExpectationsWereMet())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"net/http"
 	"time"
@@ -36,9 +37,60 @@ var KeyPath string
 // CertPath is the path for the signing cert or p12 file
 var CertPath string
 
+// NextCertPath is the path for the signing cert or p12 file that replaces CertPath in a signing rotation
+var NextCertPath string
+
+// NextKeyPath is the path for the private key of NextCertPath
+var NextKeyPath string
+
+// SignerType selects how profiles are signed, either local or http
+var SignerType string
+
+// SignerURL is the endpoint of the external signing service used by the http signer
+var SignerURL string
+
 // PushNewBuild is whether to push all profiles if the device's build number changes
 var PushNewBuild bool
 
+// RemoveUnmanagedProfiles is whether to remove MDM installed profiles that mdmdirector doesn't know about
+var RemoveUnmanagedProfiles bool
+
+// UnmanagedProfileAllowlist is a comma separated list of profile identifiers that are never removed
+var UnmanagedProfileAllowlist string
+
+// CommandRetryPolicy is the path to a JSON file of command retry policies by request type
+var CommandRetryPolicy string
+
+// WebhookEventTTL is the number of minutes the IDs of processed webhook events are remembered for
+var WebhookEventTTL int
+
+// WebhookRetryLimit is the number of times a webhook event is tried before it is saved as a dead letter
+var WebhookRetryLimit int
+
+// DeviceLockTimeout is the number of seconds a webhook event waits for another event of the same device
+var DeviceLockTimeout int
+
+// WebhookSecret is the shared secret webhook requests have to carry
+var WebhookSecret string
+
+// WebhookHMACKey is the key webhook request bodies are signed with
+var WebhookHMACKey string
+
+// WebhookClientCertSHA256 is a comma separated list of the client certificates allowed to send webhook requests
+var WebhookClientCertSHA256 string
+
+// TLSCert is the path to the certificate mdmdirector serves HTTPS with
+var TLSCert string
+
+// TLSKey is the path to the private key of TLSCert
+var TLSKey string
+
+// WorkflowStepTimeout is the number of minutes a held command waits for its prerequisites
+var WorkflowStepTimeout int
+
+// CommandHistoryDays is the number of days command responses are kept for
+var CommandHistoryDays int
+
 // BasicAuthPass is the password used for basic auth
 var BasicAuthPass string
 
@@ -104,6 +156,74 @@ func main() {
 		env.Bool("PUSH_NEW_BUILD", true),
 		"Re-push profiles if the device's build number changes.",
 	)
+	flag.BoolVar(
+		&RemoveUnmanagedProfiles,
+		"remove-unmanaged-profiles",
+		env.Bool("REMOVE_UNMANAGED_PROFILES", false),
+		"Remove MDM installed profiles that aren't device, group or shared profiles.",
+	)
+	flag.StringVar(
+		&UnmanagedProfileAllowlist,
+		"unmanaged-profile-allowlist",
+		env.String("UNMANAGED_PROFILE_ALLOWLIST", ""),
+		"Comma separated profile identifiers that -remove-unmanaged-profiles leaves installed. A trailing * matches a prefix.",
+	)
+	flag.StringVar(
+		&CommandRetryPolicy,
+		"command-retry-policy",
+		env.String("COMMAND_RETRY_POLICY", ""),
+		"Path to a JSON file of retry policies by request type.",
+	)
+	flag.IntVar(
+		&WebhookEventTTL,
+		"webhook-event-ttl",
+		env.Int("WEBHOOK_EVENT_TTL", 60),
+		"Number of minutes to remember processed webhook events for, so redelivered events are skipped. 0 disables deduplication.",
+	)
+	flag.IntVar(
+		&WebhookRetryLimit,
+		"webhook-retry-limit",
+		env.Int("WEBHOOK_RETRY_LIMIT", 5),
+		"Number of times a webhook event is tried before it is saved as a dead letter.",
+	)
+	flag.IntVar(
+		&DeviceLockTimeout,
+		"device-lock-timeout",
+		env.Int("DEVICE_LOCK_TIMEOUT", 120),
+		"Number of seconds a webhook event waits for the events of the same device to be processed before it is retried.",
+	)
+	flag.StringVar(
+		&WebhookSecret,
+		"webhook-secret",
+		env.String("WEBHOOK_SECRET", ""),
+		"Shared secret webhook requests must send in the secret query parameter or the X-Webhook-Secret header.",
+	)
+	flag.StringVar(
+		&WebhookHMACKey,
+		"webhook-hmac-key",
+		env.String("WEBHOOK_HMAC_KEY", ""),
+		"Key webhook request bodies must be signed with, as a hex HMAC-SHA256 in the X-Webhook-Signature header.",
+	)
+	flag.StringVar(
+		&WebhookClientCertSHA256,
+		"webhook-client-cert-sha256",
+		env.String("WEBHOOK_CLIENT_CERT_SHA256", ""),
+		"Comma separated SHA-256 fingerprints of the client certificates allowed to send webhook requests. Requires -tls-cert.",
+	)
+	flag.StringVar(&TLSCert, "tls-cert", env.String("TLS_CERT", ""), "Path to the certificate to serve HTTPS with")
+	flag.StringVar(&TLSKey, "tls-key", env.String("TLS_KEY", ""), "Path to the private key of -tls-cert")
+	flag.IntVar(
+		&WorkflowStepTimeout,
+		"workflow-step-timeout",
+		env.Int("WORKFLOW_STEP_TIMEOUT", 15),
+		"Number of minutes a held command, such as DeviceConfigured, waits for the commands it depends on before it is sent anyway.",
+	)
+	flag.IntVar(
+		&CommandHistoryDays,
+		"command-history-days",
+		env.Int("COMMAND_HISTORY_DAYS", 30),
+		"Number of days to keep the responses devices return for commands. 0 keeps them forever.",
+	)
 	flag.StringVar(
 		&port,
 		"port",
@@ -141,6 +261,30 @@ func main() {
 		env.String("SIGNING_CERT", ""),
 		"Path to the signing certificate or p12 file.",
 	)
+	flag.StringVar(
+		&NextCertPath,
+		"next-cert",
+		env.String("NEXT_SIGNING_CERT", ""),
+		"Path to the signing certificate or p12 file that replaces -cert during a signing rotation.",
+	)
+	flag.StringVar(
+		&NextKeyPath,
+		"next-signing-private-key",
+		env.String("NEXT_SIGNING_KEY", ""),
+		"Path to the private key of -next-cert. Don't use with p12 file.",
+	)
+	flag.StringVar(
+		&SignerType,
+		"signer",
+		env.String("SIGNER", "local"),
+		"How profiles are signed. local uses -cert and -signing-private-key, http sends them to -signer-url.",
+	)
+	flag.StringVar(
+		&SignerURL,
+		"signer-url",
+		env.String("SIGNER_URL", ""),
+		"URL of the external signing service used by the http signer.",
+	)
 	flag.StringVar(
 		&BasicAuthPass,
 		"password",
@@ -309,12 +453,47 @@ func main() {
 		log.Fatal("loglevel value is not one of debug, info, warn or error.")
 	}
 
+	if (TLSCert == "") != (TLSKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be set together.")
+	}
+
+	if WebhookClientCertSHA256 != "" && TLSCert == "" {
+		log.Fatal("-webhook-client-cert-sha256 requires -tls-cert and -tls-key.")
+	}
+
+	if err := director.LoadCommandRetryPolicies(CommandRetryPolicy); err != nil {
+		log.Fatalf("Unable to load the command retry policies - %s \n", err)
+	}
+
 	r := mux.NewRouter()
-	r.HandleFunc("/webhook", director.WebhookHandler).Methods("POST")
+	r.HandleFunc("/webhook", director.WebhookAuth(director.WebhookHandler)).Methods("POST")
+	r.HandleFunc("/webhook/dead-letters", utils.BasicAuth(director.GetWebhookDeadLettersHandler)).Methods("GET")
+	r.HandleFunc("/webhook/dead-letters/{id}/replay", utils.BasicAuth(director.PostWebhookDeadLetterReplayHandler)).
+		Methods("POST")
+	r.HandleFunc("/webhook/rejected", utils.BasicAuth(director.GetRejectedWebhookEventsHandler)).Methods("GET")
 	r.HandleFunc("/profile", utils.BasicAuth(director.PostProfileHandler)).Methods("POST")
 	r.HandleFunc("/profile", utils.BasicAuth(director.DeleteProfileHandler)).Methods("DELETE")
 	r.HandleFunc("/profile", utils.BasicAuth(director.GetSharedProfiles)).Methods("GET")
+	r.HandleFunc("/profile/validate", utils.BasicAuth(director.ValidateProfileHandler)).Methods("POST")
+	r.HandleFunc("/profile/drift", utils.BasicAuth(director.GetProfileDriftHandler)).Methods("GET")
+	r.HandleFunc("/profile/rollouts", utils.BasicAuth(director.GetProfileRolloutsHandler)).Methods("GET")
+	r.HandleFunc("/profile/rollouts/{id}/{action}", utils.BasicAuth(director.PostProfileRolloutActionHandler)).
+		Methods("POST")
+	r.HandleFunc("/profile/revisions/{identifier}", utils.BasicAuth(director.GetProfileRevisionsHandler)).
+		Methods("GET")
+	r.HandleFunc("/profile/revisions/{id}/rollback", utils.BasicAuth(director.PostProfileRollbackHandler)).
+		Methods("POST")
 	r.HandleFunc("/profile/{udid}", utils.BasicAuth(director.GetDeviceProfiles)).Methods("GET")
+	r.HandleFunc("/profile/{identifier}/status", utils.BasicAuth(director.GetProfileStatusHandler)).
+		Methods("GET")
+	r.HandleFunc("/signing/rotation", utils.BasicAuth(director.GetSigningRotationsHandler)).Methods("GET")
+	r.HandleFunc("/signing/rotation", utils.BasicAuth(director.PostSigningRotationHandler)).Methods("POST")
+	r.HandleFunc("/signing/rotation/{id}", utils.BasicAuth(director.GetSigningRotationHandler)).Methods("GET")
+	r.HandleFunc("/signing/rotation/{id}/{action}", utils.BasicAuth(director.PostSigningRotationActionHandler)).
+		Methods("POST")
+	r.HandleFunc("/commands", utils.BasicAuth(director.PostCommandHandler)).Methods("POST")
+	r.HandleFunc("/commands/types", utils.BasicAuth(director.GetCommandTypesHandler)).Methods("GET")
+	r.HandleFunc("/jobs/{id}", utils.BasicAuth(director.GetJobHandler)).Methods("GET")
 	r.HandleFunc("/device", utils.BasicAuth(director.DeviceHandler)).Methods("GET")
 	r.HandleFunc("/device/command/{command}", utils.BasicAuth(director.PostDeviceCommandHandler)).
 		Methods("POST")
@@ -323,6 +502,24 @@ func main() {
 	r.HandleFunc("/device/push/{udid}", utils.BasicAuth(director.PushDeviceHandler)).Methods("GET")
 	r.HandleFunc("/device/{udid}", utils.BasicAuth(director.SingleDeviceHandler)).Methods("GET")
 	r.HandleFunc("/device/{udid}/commands", utils.BasicAuth(director.InspectDeviceCommands)).Methods("GET")
+	r.HandleFunc("/device/{udid}/commands/history", utils.BasicAuth(director.GetDeviceCommandHistoryHandler)).
+		Methods("GET")
+	r.HandleFunc("/device/{udid}/profiles/status", utils.BasicAuth(director.GetDeviceProfilesStatusHandler)).
+		Methods("GET")
+	r.HandleFunc("/device/{udid}/attributes", utils.BasicAuth(director.GetDeviceAttributesHandler)).
+		Methods("GET")
+	r.HandleFunc("/device/{udid}/attributes", utils.BasicAuth(director.PostDeviceAttributesHandler)).
+		Methods("POST")
+	r.HandleFunc("/device/{udid}/attributes/{name}", utils.BasicAuth(director.DeleteDeviceAttributeHandler)).
+		Methods("DELETE")
+	r.HandleFunc("/group", utils.BasicAuth(director.GetDeviceGroups)).Methods("GET")
+	r.HandleFunc("/group", utils.BasicAuth(director.PostDeviceGroupHandler)).Methods("POST")
+	r.HandleFunc("/group/{name}", utils.BasicAuth(director.GetDeviceGroupHandler)).Methods("GET")
+	r.HandleFunc("/group/{name}", utils.BasicAuth(director.DeleteDeviceGroupHandler)).Methods("DELETE")
+	r.HandleFunc("/group/{name}/devices", utils.BasicAuth(director.PostDeviceGroupMembersHandler)).
+		Methods("POST")
+	r.HandleFunc("/group/{name}/devices", utils.BasicAuth(director.DeleteDeviceGroupMembersHandler)).
+		Methods("DELETE")
 	r.HandleFunc("/installapplication", utils.BasicAuth(director.PostInstallApplicationHandler)).
 		Methods("POST")
 	r.HandleFunc("/installapplication", utils.BasicAuth(director.GetSharedApplicationss)).
@@ -361,12 +558,35 @@ func main() {
 		&types.Certificate{},
 		&types.ProfileList{},
 		&types.UnlockPin{},
+		&types.DeviceGroup{},
+		&types.DeviceGroupMember{},
+		&types.DeviceGroupDeparture{},
+		&types.DeviceGroupRule{},
+		&types.GroupProfile{},
+		&types.GroupInstallApplication{},
+		&types.ProfileRollout{},
+		&types.ProfileRevision{},
+		&types.DeviceAttribute{},
+		&types.SigningRotation{},
+		&types.SigningRotationDevice{},
+		&types.ProfileAssignment{},
+		&types.Job{},
+		&types.JobItem{},
+		&types.CommandEvent{},
+		&types.WorkflowStep{},
+		&types.WebhookDeadLetter{},
+		&types.RejectedWebhookEvent{},
 	)
 	if err != nil {
 		director.ErrorLogger(director.LogHolder{Message: err.Error()})
 		log.Fatal(err)
 	}
 
+	err = director.ClearStoredCommandSecrets()
+	if err != nil {
+		director.ErrorLogger(director.LogHolder{Message: err.Error()})
+	}
+
 	director.InfoLogger(
 		director.LogHolder{Message: "mdmdirector is running, hold onto your butts..."},
 	)
@@ -382,6 +602,20 @@ func main() {
 		log.Error(err)
 	}
 
+	var JobQueue = QueueFactory.RegisterQueue(&taskq.QueueOptions{
+		Name:  "jobs",
+		Redis: director.RedisClient(),
+	})
+
+	var WebhookQueue = QueueFactory.RegisterQueue(&taskq.QueueOptions{
+		Name:  "webhooks",
+		Redis: director.RedisClient(),
+	})
+
+	director.StartWebhookEventDeduplication(director.RedisClient())
+	director.StartDeviceLocks(director.RedisClient())
+	director.StartWebhookQueue(WebhookQueue)
+
 	if utils.Prometheus() {
 		director.Metrics()
 		r.Handle("/metrics", promhttp.Handler())
@@ -397,6 +631,22 @@ func main() {
 	onceInDuration := (time.Minute * time.Duration(OnceIn))
 	go director.ScheduledCheckin(PushQueue, onceInDuration)
 	go director.ProcessScheduledCheckinQueue(PushQueue)
+	go director.ScheduledProfileRollouts()
+	go director.ScheduledSigningRotations()
+	go director.RetryCommands()
+	go director.StartJobQueue(JobQueue)
+	go director.ScheduledWorkflowTimeouts()
+
+	if TLSCert != "" {
+		// Client certificates are requested but not verified against a CA, -webhook-client-cert-sha256 pins them
+		server := &http.Server{
+			Addr:      ":" + port,
+			Handler:   r,
+			TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert, MinVersion: tls.VersionTLS12},
+		}
+		log.Info(server.ListenAndServeTLS(TLSCert, TLSKey))
+		return
+	}
 
 	log.Info(http.ListenAndServe(":"+port, r))
 }
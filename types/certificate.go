@@ -15,6 +15,7 @@ type Certificate struct {
 	NotBefore  time.Time
 	Data       []byte
 	Issuer     string
+	IsIdentity bool
 	DeviceUDID string
 }
 
@@ -18,6 +18,21 @@ type Command struct {
 	ManifestURL  string         `json:"manifest_url,omitempty"`
 	ErrorString  string
 	AttemptCount int
+	// ErrorChain is decoded from the last Error response. ErrorDomain and ErrorCode are its first error.
+	ErrorChain  ErrorChain `gorm:"type:jsonb" json:"error_chain,omitempty"`
+	ErrorDomain string     `gorm:"index" json:"error_domain,omitempty"`
+	ErrorCode   int        `gorm:"index" json:"error_code,omitempty"`
+	// The profile an InstallProfile or RemoveProfile command carries, so responses can be traced back to it
+	ProfileIdentifier string `json:"profile_identifier,omitempty"`
+	ProfileUUID       string `json:"profile_uuid,omitempty"`
+	// Params of a generic command, JSON encoded so the command can be sent again
+	Params string `json:"-"`
+	// NextRetryAt is when an Error command is sent again, or the device of a NotNow command is pushed again
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+	// RetriesExhausted is set once the command won't be sent or pushed again
+	RetriesExhausted bool `json:"retries_exhausted"`
+	// RetriedAs is the UUID of the command this one was sent again as
+	RetriedAs string `json:"retried_as,omitempty"`
 }
 
 type CommandPayload struct {
@@ -28,6 +43,54 @@ type CommandPayload struct {
 	Identifier  string   `json:"identifier,omitempty"`
 	ManifestURL string   `json:"manifest_url,omitempty"`
 	Pin         string   `json:"pin,omitempty"`
+	// Recorded on the Command, not sent to MicroMDM
+	ProfileIdentifier string `json:"-"`
+	ProfileUUID       string `json:"-"`
+	// Params are the fields of other request types, merged into the request sent to MicroMDM
+	Params map[string]interface{} `json:"-"`
+	// Attempt is the number of times the command has been sent, including this one
+	Attempt int `json:"-"`
+}
+
+// GenericCommandPayload - struct to unpack a request to send any supported MDM command
+type GenericCommandPayload struct {
+	RequestType   string                 `json:"request_type"`
+	SerialNumbers []string               `json:"serial_numbers,omitempty"`
+	DeviceUDIDs   []string               `json:"udids,omitempty"`
+	Params        map[string]interface{} `json:"params,omitempty"`
+}
+
+// GenericCommandResult - the command sent to a device, or why it couldn't be sent
+type GenericCommandResult struct {
+	DeviceUDID   string `json:"udid,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	CommandUUID  string `json:"command_uuid,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// CommandParam describes a parameter of a request type
+type CommandParam struct {
+	// Type is one of string, bool, integer, array or object
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// CommandErrorGroup - the number of Error commands with a domain and code
+type CommandErrorGroup struct {
+	ErrorDomain string `json:"error_domain"`
+	ErrorCode   int    `json:"error_code"`
+	Count       int    `json:"count"`
+}
+
+// CommandRetryPolicy - how commands of a request type are retried
+type CommandRetryPolicy struct {
+	// MaxAttempts is the number of sends and pushes before a command is given up on
+	MaxAttempts    int     `json:"max_attempts"`
+	InitialBackoff int     `json:"initial_backoff_seconds"`
+	MaxBackoff     int     `json:"max_backoff_seconds"`
+	Multiplier     float64 `json:"multiplier"`
+	// RetryableErrorCodes are the ErrorChain codes an Error response is retried for, other errors aren't retried
+	RetryableErrorCodes []int `json:"retryable_error_codes,omitempty"`
 }
 
 type CommandResponse struct {
@@ -0,0 +1,59 @@
+package types
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CommandEvent is a response a device returned for a command. Every acknowledgement is kept, so a command that was
+// answered NotNow before it was acknowledged has a row for each response.
+type CommandEvent struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+	CommandUUID string    `gorm:"index" json:"command_uuid"`
+	DeviceUDID  string    `gorm:"index" json:"udid"`
+	RequestType string    `gorm:"index" json:"request_type"`
+	Status      string    `json:"status"`
+	// ErrorChain is decoded from the payload of an Error response
+	ErrorChain ErrorChain `gorm:"type:jsonb" json:"error_chain,omitempty"`
+	// Payload is the plist the device responded with. Data that is saved on the device, such as a ProfileList, is
+	// replaced by its number of items and the payload is capped at 16KiB.
+	Payload string `json:"payload,omitempty"`
+}
+
+// ErrorChainItem is an error from the ErrorChain of a command response
+type ErrorChainItem struct {
+	ErrorCode            int    `plist:"ErrorCode" json:"error_code"`
+	ErrorDomain          string `plist:"ErrorDomain" json:"error_domain"`
+	LocalizedDescription string `plist:"LocalizedDescription" json:"localized_description,omitempty"`
+	USEnglishDescription string `plist:"USEnglishDescription" json:"us_english_description,omitempty"`
+}
+
+// ErrorChain is stored as JSON
+type ErrorChain []ErrorChainItem
+
+// Value implements driver.Valuer
+func (chain ErrorChain) Value() (driver.Value, error) {
+	if chain == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(chain)
+}
+
+// Scan implements sql.Scanner
+func (chain *ErrorChain) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*chain = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, chain)
+	case string:
+		return json.Unmarshal([]byte(data), chain)
+	}
+
+	return fmt.Errorf("cannot scan %T into ErrorChain", value)
+}
@@ -0,0 +1,14 @@
+package types
+
+// DeviceAttribute is a custom value that can be substituted into profiles as $NAME when they are pushed to the device
+type DeviceAttribute struct {
+	DeviceUDID string `gorm:"primaryKey" json:"udid"`
+	Name       string `gorm:"primaryKey" json:"name"`
+	Value      string `json:"value"`
+}
+
+// DeviceAttributesPayload - struct to unpack custom attributes sent to mdmdirector
+type DeviceAttributesPayload struct {
+	Attributes map[string]string `json:"attributes"`
+	PushNow    bool              `json:"push_now"`
+}
@@ -0,0 +1,76 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceGroup is a named set of devices that profiles and applications can be scoped to.
+type DeviceGroup struct {
+	ID          uuid.UUID           `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	Name        string              `gorm:"uniqueIndex;not null" json:"name"`
+	Description string              `json:"description,omitempty"`
+	Smart       bool                `gorm:"default:false" json:"smart"`
+	Rules       []DeviceGroupRule   `gorm:"foreignKey:GroupID" json:"rules,omitempty"`
+	Members     []DeviceGroupMember `gorm:"foreignKey:GroupID" json:"members,omitempty"`
+}
+
+// DeviceGroupRule is a single condition on a device's inventory. A device is a member of a smart group when it
+// matches every rule of the group.
+type DeviceGroupRule struct {
+	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"-"`
+	GroupID   uuid.UUID `gorm:"type:uuid;index" json:"-"`
+	Attribute string    `json:"attribute"`
+	Operator  string    `json:"operator"`
+	Value     string    `json:"value"`
+}
+
+// DeviceGroupMember links a device to a DeviceGroup.
+type DeviceGroupMember struct {
+	GroupID    uuid.UUID `gorm:"primaryKey;type:uuid" json:"group_id"`
+	DeviceUDID string    `gorm:"primaryKey" json:"udid"`
+}
+
+// DeviceGroupDeparture records a device that left a DeviceGroup, until its ProfileList shows the group's profiles
+// have been removed.
+type DeviceGroupDeparture struct {
+	GroupID    uuid.UUID `gorm:"primaryKey;type:uuid"`
+	DeviceUDID string    `gorm:"primaryKey"`
+	LeftAt     time.Time
+}
+
+// GroupProfile (s) are profiles that go on every device in a DeviceGroup.
+type GroupProfile struct {
+	ID                uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
+	GroupID           uuid.UUID `gorm:"type:uuid;index"`
+	PayloadUUID       string
+	HashedPayloadUUID string
+	PayloadIdentifier string
+	MobileconfigData  []byte
+	MobileconfigHash  []byte
+	Installed         bool `gorm:"default:true"`
+	Encrypted         bool `gorm:"default:false"`
+}
+
+// GroupInstallApplication (s) are applications that go on every device in a DeviceGroup.
+type GroupInstallApplication struct {
+	ID          uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
+	GroupID     uuid.UUID `gorm:"type:uuid;index"`
+	ManifestURL string
+}
+
+// DeviceGroupPayload - struct to unpack a group sent to mdmdirector
+type DeviceGroupPayload struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Smart       bool              `json:"smart"`
+	Rules       []DeviceGroupRule `json:"rules,omitempty"`
+}
+
+// DeviceGroupMembersPayload - struct to unpack a change in group membership
+type DeviceGroupMembersPayload struct {
+	SerialNumbers []string `json:"serial_numbers,omitempty"`
+	DeviceUDIDs   []string `json:"udids,omitempty"`
+	PushNow       bool     `json:"push_now"`
+}
@@ -16,6 +16,7 @@ type SharedInstallApplication struct {
 type InstallApplicationPayload struct {
 	SerialNumbers []string      `json:"serial_numbers,omitempty"`
 	DeviceUDIDs   []string      `json:"udids,omitempty"`
+	Groups        []string      `json:"groups,omitempty"`
 	ManifestURLs  []ManifestURL `json:"manifest_urls"`
 }
 
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job is a bulk operation run in the background from the jobs queue, with the progress of each device in its items
+type Job struct {
+	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Type is shared_profile_push or device_command
+	Type string `gorm:"index" json:"type"`
+	// Status is one of queued, running, complete or failed
+	Status string `gorm:"index" json:"status"`
+	// Params are the JSON encoded inputs of the operation. They are never returned and are cleared once the job is
+	// done.
+	Params string `json:"-"`
+	// LeaseExpiresAt is when the instance running the job stops being trusted to finish it, it is extended while the
+	// job runs
+	LeaseExpiresAt *time.Time `json:"-"`
+	Error          string     `json:"error,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// JobItem is the progress of a single device through a job
+type JobItem struct {
+	JobID uuid.UUID `gorm:"primaryKey;type:uuid" json:"-"`
+	// Target is the UDID or serial number the device was requested by
+	Target       string `gorm:"primaryKey" json:"target"`
+	DeviceUDID   string `json:"udid,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	// Status is one of pending, sending, complete or failed
+	Status    string    `gorm:"index" json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// JobStatus - a job with the number of devices in each state
+type JobStatus struct {
+	Job
+	Devices map[string]int `json:"devices"`
+	Items   []JobItem      `json:"items,omitempty"`
+}
+
+// SharedProfilePushJobParams - the shared profiles a shared_profile_push job pushes
+type SharedProfilePushJobParams struct {
+	PayloadIdentifiers []string `json:"payload_identifiers"`
+}
+
+// DeviceCommandJobParams - the command a device_command job applies, as posted to /device/command/{command}
+type DeviceCommandJobParams struct {
+	Command string `json:"command"`
+	Value   bool   `json:"value"`
+	PushNow bool   `json:"push_now"`
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 
 	"gorm.io/gorm"
 )
@@ -16,6 +17,8 @@ type DeviceProfile struct {
 	MobileconfigHash  []byte
 	DeviceUDID        string `gorm:"primaryKey"`
 	Installed         bool   `gorm:"default:true"`
+	// Encrypted profiles have their PayloadContent encrypted to the device identity certificate when pushed
+	Encrypted bool `gorm:"default:false"`
 }
 
 // SharedProfile (s) are profiles that go on every device.
@@ -27,23 +30,47 @@ type SharedProfile struct {
 	MobileconfigData  []byte
 	MobileconfigHash  []byte
 	Installed         bool `gorm:"default:true"`
+	Encrypted         bool `gorm:"default:false"`
+	// DeviceScope limits the devices the profile is pushed to
+	DeviceScope ProfileScope `gorm:"embedded;embeddedPrefix:device_scope_"`
+}
+
+// ProfileScope limits a shared profile to the devices it applies to. Empty fields don't constrain the profile.
+type ProfileScope struct {
+	// ProductNames and Models are patterns such as "Mac*" or "iPad1?,*", * matches any characters and ? one
+	ProductNames   pq.StringArray `gorm:"type:text[]" json:"product_names,omitempty"`
+	Models         pq.StringArray `gorm:"type:text[]" json:"models,omitempty"`
+	MinOSVersion   string         `json:"min_os_version,omitempty"`
+	MaxOSVersion   string         `json:"max_os_version,omitempty"`
+	SupervisedOnly bool           `json:"supervised_only,omitempty"`
 }
 
 // ProfilePayload - struct to unpack the payload sent to mdmdirector
 type ProfilePayload struct {
 	SerialNumbers []string `json:"serial_numbers,omitempty"`
 	DeviceUDIDs   []string `json:"udids,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
 	Mobileconfigs []string `json:"profiles"`
 	PushNow       bool     `json:"push_now"`
 	Metadata      bool     `json:"metadata"`
+	// Rollout pushes a new version of a shared profile in waves rather than to every device at once
+	Rollout *ProfileRolloutPayload `json:"rollout,omitempty"`
+	// DryRun returns what the request would do to each device without saving or sending anything
+	DryRun bool `json:"dry_run"`
+	// Encrypt sends the profiles with their PayloadContent encrypted to each device's identity certificate
+	Encrypt bool `json:"encrypt"`
+	// DeviceScope limits shared profiles to the matching devices, other devices report them as not applicable
+	DeviceScope *ProfileScope `json:"device_scope,omitempty"`
 }
 
 type DeleteProfilePayload struct {
 	SerialNumbers []string                     `json:"serial_numbers,omitempty"`
 	DeviceUDIDs   []string                     `json:"udids,omitempty"`
+	Groups        []string                     `json:"groups,omitempty"`
 	PushNow       bool                         `json:"push_now"`
 	Mobileconfigs []DeletedMobileconfigPayload `json:"profiles"`
 	Metadata      bool                         `json:"metadata"`
+	DryRun        bool                         `json:"dry_run"`
 }
 
 type DeletedMobileconfigPayload struct {
@@ -84,6 +111,48 @@ type ProfileMetadata struct {
 	HashedPayloadUUID string `json:"hashed_payload_uuid"`
 }
 
+// ProfilePlan - what a profile change would do to a device, returned for dry runs
+type ProfilePlan struct {
+	DeviceUDID   string            `json:"udid"`
+	SerialNumber string            `json:"serial_number"`
+	Profiles     []ProfilePlanItem `json:"profiles"`
+}
+
+type ProfilePlanItem struct {
+	PayloadIdentifier string `json:"payload_identifier"`
+	HashedPayloadUUID string `json:"hashed_payload_uuid,omitempty"`
+	Scope             string `json:"scope"`
+	// Action is one of install, remove, unchanged or not_applicable
+	Action string `json:"action"`
+}
+
+// ProfileDrift is a profile installed on a device that isn't a device, group or shared profile
+type ProfileDrift struct {
+	DeviceUDID          string `json:"udid"`
+	SerialNumber        string `json:"serial_number"`
+	PayloadIdentifier   string `json:"payload_identifier"`
+	PayloadUUID         string `json:"payload_uuid"`
+	PayloadDisplayName  string `json:"payload_display_name,omitempty"`
+	PayloadOrganization string `json:"payload_organization,omitempty"`
+	// IsManaged profiles were installed over MDM and can be removed with RemoveProfile
+	IsManaged   bool `json:"is_managed"`
+	Allowlisted bool `json:"allowlisted"`
+}
+
+// ProfileValidationIssue describes a problem found in an uploaded mobileconfig
+type ProfileValidationIssue struct {
+	// Profile is the index of the mobileconfig in the profiles array of the request
+	Profile           int    `json:"profile"`
+	PayloadIdentifier string `json:"payload_identifier,omitempty"`
+	Field             string `json:"field,omitempty"`
+	Message           string `json:"message"`
+}
+
+type ProfileValidationResponse struct {
+	Valid  bool                     `json:"valid"`
+	Errors []ProfileValidationIssue `json:"errors"`
+}
+
 // https://developer.apple.com/documentation/devicemanagement/profilelistresponse/profilelistitem/payloadcontentitem
 type PayloadContentItem struct {
 	PayloadDescription  string `plist:"PayloadDescription"`
@@ -0,0 +1,25 @@
+package types
+
+import "time"
+
+// ProfileAssignment is the install state of a profile on a device
+type ProfileAssignment struct {
+	DeviceUDID        string `gorm:"primaryKey" json:"udid"`
+	PayloadIdentifier string `gorm:"primaryKey" json:"payload_identifier"`
+	// Status is one of pending, sent, installed, failed, removed or not_applicable
+	Status            string `gorm:"index" json:"status"`
+	HashedPayloadUUID string `json:"hashed_payload_uuid,omitempty"`
+	// RequestType of the last command sent for the profile, InstallProfile or RemoveProfile
+	RequestType string    `json:"request_type,omitempty"`
+	CommandUUID string    `json:"command_uuid,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ProfileAssignmentStatus - the state of a profile across devices
+type ProfileAssignmentStatus struct {
+	PayloadIdentifier string              `json:"payload_identifier"`
+	Devices           map[string]int      `json:"devices"`
+	Assignments       []ProfileAssignment `json:"assignments"`
+}
@@ -0,0 +1,38 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProfileRevision is an immutable copy of a profile as it was posted. Revisions are never updated or deleted, so
+// any earlier version of a profile can be inspected or rolled back to.
+type ProfileRevision struct {
+	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	// CreatedBy is the Basic Auth user and address of the request, with any unverified X-Requested-By header
+	CreatedBy string `json:"created_by"`
+	// Scope is one of shared, device or group
+	Scope             string `gorm:"index" json:"scope"`
+	DeviceUDID        string `gorm:"index" json:"udid,omitempty"`
+	GroupName         string `gorm:"index" json:"group,omitempty"`
+	PayloadIdentifier string `gorm:"index" json:"payload_identifier"`
+	PayloadUUID       string `json:"payload_uuid"`
+	HashedPayloadUUID string `json:"hashed_payload_uuid"`
+	MobileconfigData  []byte `json:"mobileconfig_data,omitempty"`
+	MobileconfigHash  []byte `json:"mobileconfig_hash"`
+	Encrypted         bool   `gorm:"default:false" json:"encrypted"`
+	// DeviceScope of a shared profile
+	DeviceScope ProfileScope `gorm:"embedded;embeddedPrefix:device_scope_" json:"device_scope"`
+	// RolloutCandidate is set for a shared profile that was posted with a rollout, it only replaces the shared profile
+	// once the rollout completes
+	RolloutCandidate bool `gorm:"default:false" json:"rollout_candidate,omitempty"`
+	// RolledBackFrom is set when the revision was created by rolling back to an earlier one
+	RolledBackFrom *uuid.UUID `gorm:"type:uuid" json:"rolled_back_from,omitempty"`
+}
+
+// ProfileRollbackPayload - struct to unpack a rollback request
+type ProfileRollbackPayload struct {
+	PushNow bool `json:"push_now"`
+}
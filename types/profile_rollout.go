@@ -0,0 +1,48 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ProfileRollout holds a new version of a shared profile while it is being pushed to the fleet in waves. Once the
+// rollout reaches every device the candidate replaces the SharedProfile.
+type ProfileRollout struct {
+	ID                uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	PayloadIdentifier string    `gorm:"index" json:"payload_identifier"`
+	PayloadUUID       string    `json:"payload_uuid"`
+	HashedPayloadUUID string    `gorm:"index" json:"hashed_payload_uuid"`
+	MobileconfigData  []byte    `json:"-"`
+	MobileconfigHash  []byte    `json:"-"`
+	Encrypted         bool      `gorm:"default:false" json:"encrypted"`
+	// DeviceScope limits the devices the new version is pushed to
+	DeviceScope ProfileScope `gorm:"embedded;embeddedPrefix:device_scope_" json:"device_scope"`
+	// Status is one of active, paused, complete or cancelled
+	Status          string         `gorm:"index" json:"status"`
+	Percentage      int            `json:"percentage"`
+	Step            int            `json:"step"`
+	IntervalMinutes int            `json:"interval_minutes"`
+	NextWaveAt      time.Time      `json:"next_wave_at"`
+	MaxErrors       int            `json:"max_errors"`
+	ErrorCount      int            `json:"error_count"`
+	DeviceUDIDs     pq.StringArray `gorm:"type:text[]" json:"udids,omitempty"`
+}
+
+// ProfileRolloutPayload - rollout options sent with a shared profile
+type ProfileRolloutPayload struct {
+	// Percentage of devices that receive the profile in the first wave
+	Percentage int `json:"percentage"`
+	// Step is the percentage added with each following wave, defaults to Percentage
+	Step int `json:"step,omitempty"`
+	// IntervalMinutes between waves, defaults to 60
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+	// MaxErrors is the number of failed InstallProfile commands that pauses the rollout, 0 never pauses
+	MaxErrors int `json:"max_errors,omitempty"`
+	// Devices that are always part of the first wave
+	SerialNumbers []string `json:"serial_numbers,omitempty"`
+	DeviceUDIDs   []string `json:"udids,omitempty"`
+}
@@ -0,0 +1,19 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RejectedWebhookEvent is a webhook request that failed validation, kept so the sender can be debugged
+type RejectedWebhookEvent struct {
+	ID         uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+	EventID    string    `json:"event_id,omitempty"`
+	Topic      string    `gorm:"index" json:"topic,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Reason     string    `json:"reason"`
+	// Payload is the request body, truncated to 64 KiB
+	Payload string `json:"payload"`
+}
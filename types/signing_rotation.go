@@ -0,0 +1,51 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SigningRotation moves the fleet from the signing certificate to the next one in batches. Profiles signed with
+// either certificate are accepted until the operator makes the next certificate the current one.
+type SigningRotation struct {
+	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Status is one of active, paused, complete, cancelling or cancelled. A cancelling rotation is moving devices
+	// back to the current certificate.
+	Status string `gorm:"index" json:"status"`
+	// CertificateFingerprint is the SHA-256 fingerprint of the certificate devices are moved to
+	CertificateFingerprint string    `json:"certificate_fingerprint"`
+	CertificateSubject     string    `json:"certificate_subject"`
+	BatchSize              int       `json:"batch_size"`
+	IntervalMinutes        int       `json:"interval_minutes"`
+	NextBatchAt            time.Time `json:"next_batch_at"`
+}
+
+// SigningRotationDevice is the progress of a single device through a rotation
+type SigningRotationDevice struct {
+	RotationID uuid.UUID `gorm:"primaryKey;type:uuid" json:"-"`
+	DeviceUDID string    `gorm:"primaryKey" json:"udid"`
+	// Status is one of pending, pushed, verified or skipped
+	Status     string     `gorm:"index" json:"status"`
+	PushedAt   *time.Time `json:"pushed_at,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// SigningRotationPayload - struct to unpack a request to start a rotation
+type SigningRotationPayload struct {
+	// BatchSize is the number of devices re-signed and re-pushed in each batch, defaults to 50
+	BatchSize int `json:"batch_size,omitempty"`
+	// IntervalMinutes between batches, defaults to 10
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+}
+
+// SigningRotationStatus - a rotation with the number of devices in each state
+type SigningRotationStatus struct {
+	SigningRotation
+	Devices map[string]int          `json:"devices"`
+	Details []SigningRotationDevice `json:"device_details,omitempty"`
+}
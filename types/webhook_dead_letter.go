@@ -0,0 +1,22 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebhookDeadLetter is a webhook event that still failed after every retry, kept so it can be inspected and replayed
+type WebhookDeadLetter struct {
+	ID         uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	EventID    string    `gorm:"index" json:"event_id,omitempty"`
+	Topic      string    `gorm:"index" json:"topic"`
+	DeviceUDID string    `gorm:"index" json:"udid,omitempty"`
+	// Payload is the webhook request body as MicroMDM sent it
+	Payload    string     `json:"payload"`
+	Error      string     `json:"error"`
+	Attempts   int        `json:"attempts"`
+	ReplayedAt *time.Time `json:"replayed_at,omitempty"`
+}
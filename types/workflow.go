@@ -0,0 +1,29 @@
+package types
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WorkflowStep is a command held back until the commands it depends on have been answered by the device
+type WorkflowStep struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Workflow names the sequence of commands the step belongs to, such as initial_tasks
+	Workflow    string `gorm:"index" json:"workflow"`
+	DeviceUDID  string `gorm:"index" json:"udid"`
+	RequestType string `json:"request_type"`
+	// Command is the JSON encoded CommandPayload sent when the step is released
+	Command string `json:"-"`
+	// Prerequisites are the UUIDs of the commands that must be acknowledged before the step is released
+	Prerequisites pq.StringArray `gorm:"type:text[]" json:"prerequisites"`
+	// Status is one of waiting, released, timed_out or superseded
+	Status string `gorm:"index" json:"status"`
+	// TimeoutAt is when the step is released even though prerequisites are unanswered
+	TimeoutAt  time.Time  `json:"timeout_at"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	// Error lists the prerequisites that failed, or why the command couldn't be sent
+	Error string `json:"error,omitempty"`
+}
@@ -34,10 +34,41 @@ func CertPath() string {
 	return flag.Lookup("cert").Value.(flag.Getter).Get().(string)
 }
 
+func NextCertPath() string {
+	return flag.Lookup("next-cert").Value.(flag.Getter).Get().(string)
+}
+
+func NextKeyPath() string {
+	return flag.Lookup("next-signing-private-key").Value.(flag.Getter).Get().(string)
+}
+
+func SignerType() string {
+	return flag.Lookup("signer").Value.(flag.Getter).Get().(string)
+}
+
+func SignerURL() string {
+	return flag.Lookup("signer-url").Value.(flag.Getter).Get().(string)
+}
+
 func PushOnNewBuild() bool {
 	return flag.Lookup("push-new-build").Value.(flag.Getter).Get().(bool)
 }
 
+func RemoveUnmanagedProfiles() bool {
+	return flag.Lookup("remove-unmanaged-profiles").Value.(flag.Getter).Get().(bool)
+}
+
+func UnmanagedProfileAllowlist() []string {
+	var allowlist []string
+	for _, identifier := range strings.Split(flag.Lookup("unmanaged-profile-allowlist").Value.(flag.Getter).Get().(string), ",") {
+		identifier = strings.TrimSpace(identifier)
+		if identifier != "" {
+			allowlist = append(allowlist, identifier)
+		}
+	}
+	return allowlist
+}
+
 func GetBasicAuthUser() string {
 	return "mdmdirector"
 }
@@ -132,6 +163,38 @@ func OnceIn() int {
 	return flag.Lookup("once-in").Value.(flag.Getter).Get().(int)
 }
 
+func CommandHistoryDays() int {
+	return flag.Lookup("command-history-days").Value.(flag.Getter).Get().(int)
+}
+
+func WorkflowStepTimeout() int {
+	return flag.Lookup("workflow-step-timeout").Value.(flag.Getter).Get().(int)
+}
+
+func WebhookEventTTL() int {
+	return flag.Lookup("webhook-event-ttl").Value.(flag.Getter).Get().(int)
+}
+
+func WebhookRetryLimit() int {
+	return flag.Lookup("webhook-retry-limit").Value.(flag.Getter).Get().(int)
+}
+
+func DeviceLockTimeout() int {
+	return flag.Lookup("device-lock-timeout").Value.(flag.Getter).Get().(int)
+}
+
+func WebhookSecret() string {
+	return flag.Lookup("webhook-secret").Value.(flag.Getter).Get().(string)
+}
+
+func WebhookHMACKey() string {
+	return flag.Lookup("webhook-hmac-key").Value.(flag.Getter).Get().(string)
+}
+
+func WebhookClientCertSHA256() string {
+	return flag.Lookup("webhook-client-cert-sha256").Value.(flag.Getter).Get().(string)
+}
+
 func InfoRequestInterval() int {
 	return flag.Lookup("info-request-interval").Value.(flag.Getter).Get().(int)
 }